@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/libgit2/git2go"
+
+	"tools.net.cs.uni-bonn.de/social-aspects-of-vulnerabilities/github-data/tools"
+)
+
+// AnalyzedCommit is the record written for each commit in offline analyze mode
+type AnalyzedCommit struct {
+	Repository             string            `json:"repository"`
+	Sha                    string            `json:"sha"`
+	Type                   string            `json:"type"`
+	CVE                    string            `json:"cve,omitempty"`
+	BlamedSha              string            `json:"blamed_sha,omitempty"`
+	AuthorEmail            string            `json:"author_email"`
+	AuthorName             string            `json:"author_name"`
+	AuthorWhen             time.Time         `json:"author_when"`
+	CommitterEmail         string            `json:"committer_email"`
+	CommitterName          string            `json:"committer_name"`
+	CommitterWhen          time.Time         `json:"committer_when"`
+	Additions              int64             `json:"additions"`
+	Deletions              int64             `json:"deletions"`
+	PastChanges            int64             `json:"past_changes"`
+	FutureChanges          int64             `json:"future_changes"`
+	PastDifferentAuthors   int64             `json:"past_different_authors"`
+	FutureDifferentAuthors int64             `json:"future_different_authors"`
+	HunkCount              int64             `json:"hunk_count"`
+	FilesChanged           int64             `json:"files_changed"`
+	Message                string            `json:"message"`
+	Patch                  string            `json:"patch"`
+	Functions              []*Function       `json:"functions"`
+	ToolResults            []tools.Result    `json:"tool_results"`
+	Error                  string            `json:"error,omitempty"`
+	Failures               []CommitFailure   `json:"failures,omitempty"`
+	ParsedFiles            []ParsedFile      `json:"parsed_files,omitempty"`
+	BlameCandidates        []*BlameCandidate `json:"blame_candidates,omitempty"`
+	DisclosureFiltered     bool              `json:"disclosure_filtered,omitempty"`
+	DeclaredBlames         []*DeclaredBlame  `json:"declared_blames,omitempty"`
+}
+
+// NewLocalRepository opens an existing clone without consulting the database.
+// The name is derived from the last two path components (e.g.
+// repos/openssl/openssl -> openssl/openssl) so that known CVEs still match.
+func NewLocalRepository(dir string) (*Repository, error) {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	gitRepo, err := git.OpenRepository(abs)
+	if err != nil {
+		return nil, fmt.Errorf("opening %s: %v", dir, err)
+	}
+	return &Repository{
+		Name:          filepath.Base(filepath.Dir(abs)) + "/" + filepath.Base(abs),
+		gitRepository: gitRepo,
+	}, nil
+}
+
+// CommitsInRange returns the shas of all commits in revRange, which is either
+// a single revision (all its ancestors) or a range like "v1.0..v2.0".
+func (r *Repository) CommitsInRange(revRange string) (shas []string, err error) {
+	repo, err := r.GitRepository()
+	if err != nil {
+		return
+	}
+	walk, err := repo.Walk()
+	if err != nil {
+		return
+	}
+	defer walk.Free()
+
+	if strings.Contains(revRange, "..") {
+		err = walk.PushRange(revRange)
+	} else {
+		var obj git.Object
+		if obj, err = repo.RevparseSingle(revRange); err == nil {
+			err = walk.Push(obj.Id())
+			obj.Free()
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("resolving %s: %v", revRange, err)
+	}
+	err = walk.Iterate(func(co *git.Commit) bool {
+		shas = append(shas, co.Id().String())
+		return true
+	})
+	return
+}
+
+// Analyze runs the commit pipeline on a local clone and writes one JSON
+// object per commit to out. Neither the database nor redis is used.
+func Analyze(dir, revRange string, out io.Writer) error {
+	r, err := NewLocalRepository(dir)
+	if err != nil {
+		return err
+	}
+	defer r.gitRepository.Free()
+
+	shas, err := r.CommitsInRange(revRange)
+	if err != nil {
+		return err
+	}
+	log.Infof("%v: analyzing %d commits in %s", r, len(shas), revRange)
+
+	enc := json.NewEncoder(out)
+	for _, sha := range shas {
+		c := &Commit{Repository: r, Sha: sha, Type: "other_commit"}
+		if err := enc.Encode(c.Analyze(context.Background())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Analyze gathers the same information as Update, but returns it instead of
+// writing it to the database
+func (c *Commit) Analyze(ctx context.Context) *AnalyzedCommit {
+	var blamedSha string
+
+	c.stage = StageMetadata
+	err := c.GetGitMetadata(ctx)
+	if err == nil && !c.IsLarge() {
+		c.stage = StageBlame
+		c.fixCommit()
+		if c.Type == "fixing_commit" {
+			blamedSha, err = c.getBlameCommitSha(ctx)
+		}
+	}
+
+	res := &AnalyzedCommit{
+		Repository:             c.Repository.Name,
+		Sha:                    c.Sha,
+		Type:                   c.Type,
+		CVE:                    c.CVE,
+		BlamedSha:              blamedSha,
+		AuthorEmail:            c.AuthorEmail,
+		AuthorName:             c.AuthorName,
+		AuthorWhen:             c.AuthorWhen,
+		CommitterEmail:         c.CommitterEmail,
+		CommitterName:          c.CommitterName,
+		CommitterWhen:          c.CommitterWhen,
+		Additions:              c.Additions,
+		Deletions:              c.Deletions,
+		PastChanges:            c.PastChanges,
+		FutureChanges:          c.FutureChanges,
+		PastDifferentAuthors:   c.PastDifferentAuthors,
+		FutureDifferentAuthors: c.FutureDifferentAuthors,
+		HunkCount:              c.HunkCount,
+		FilesChanged:           c.FilesChanged,
+		Message:                c.Message,
+		Patch:                  c.Patch,
+		Functions:              c.Functions,
+		ToolResults:            c.ToolResults,
+	}
+	if err != nil {
+		log.Warnf("analyzing %v: %v", c, err)
+		res.Error = err.Error()
+		c.Fail(c.stage, err, nil)
+	}
+	res.Failures = c.Failures
+	res.ParsedFiles = c.ParsedFiles
+	res.BlameCandidates = c.BlameCandidates
+	res.DisclosureFiltered = c.DisclosureFiltered
+	res.DeclaredBlames = c.DeclaredBlames
+	return res
+}
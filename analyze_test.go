@@ -0,0 +1,34 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+func TestAnalyze(t *testing.T) {
+	KnownCVEs = NewMitreCves()
+	DisableFunctionAnalysis = true
+	defer func() { DisableFunctionAnalysis = false }()
+
+	var buf bytes.Buffer
+	err := Analyze("./testdata/testrepo", "7471039d7ed95c5a80338694a9a5c9a03a382232", &buf)
+	handleErr(t, err)
+
+	scanner := bufio.NewScanner(&buf)
+	lines := 0
+	for scanner.Scan() {
+		var res AnalyzedCommit
+		if err := json.Unmarshal(scanner.Bytes(), &res); err != nil {
+			t.Fatalf("line %d: %v", lines, err)
+		}
+		if res.Sha == "" || res.Repository != "testdata/testrepo" {
+			t.Errorf("unexpected record %+v", res)
+		}
+		lines++
+	}
+	if lines == 0 {
+		t.Error("expected at least one analyzed commit")
+	}
+}
@@ -3,20 +3,30 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"fmt"
-	"os/exec"
+	"io"
 	"regexp"
 	"strconv"
+	"strings"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
 
+	lru "github.com/hashicorp/golang-lru"
 	"github.com/libgit2/git2go"
+
+	"tools.net.cs.uni-bonn.de/social-aspects-of-vulnerabilities/github-data/proc"
 )
 
+// blameTimeout is how long a single git blame may take
+var blameTimeout = 10 * time.Minute
+
+// Blame is the parsed output of git blame --line-porcelain, by final line
 type Blame struct {
-	raw string
-	dir BlameDirection
+	lines    []BlameLine
+	dir      BlameDirection
+	strategy string // BlameStrategy that produced it
 }
 
 type ShortBlame struct {
@@ -24,16 +34,21 @@ type ShortBlame struct {
 }
 
 type BlameLine struct {
-	Sha             string
-	Author          string
-	AuthorMail      string
-	AuthorTimestamp time.Time
-	Committer       string
-	CommitterMail   string
-	PreviousCommit  string
-	PreviousPath    string
-	OriginalLineNum int
-	FinalLineNum    int
+	Sha                string
+	Author             string
+	AuthorMail         string
+	AuthorTimestamp    time.Time
+	Committer          string
+	CommitterMail      string
+	CommitterTimestamp time.Time
+	Summary            string
+	PreviousCommit     string
+	PreviousPath       string
+	Boundary           bool   // Sha is a root commit or the end of the range
+	Filename           string // in Sha
+	Content            string
+	OriginalLineNum    int
+	FinalLineNum       int
 }
 
 type BlameLineType uint
@@ -50,8 +65,8 @@ const (
 	BlameForward  BlameDirection = iota
 )
 
-func NewShortBlame(repo *git.Repository, filepath string) (*ShortBlame, error) {
-	blameCmd := exec.Command(
+func NewShortBlame(ctx context.Context, repo *git.Repository, filepath string) (*ShortBlame, error) {
+	blameCmd := proc.Command(ctx, blameTimeout,
 		"git",
 		"blame",
 		"-let",
@@ -63,6 +78,9 @@ func NewShortBlame(repo *git.Repository, filepath string) (*ShortBlame, error) {
 	blameCmd.Stderr = errBuf
 	blameCmd.Dir = repo.Workdir()
 	if err := blameCmd.Run(); err != nil {
+		if proc.IsTimeout(err) {
+			return nil, err
+		}
 		log.Print("stderr: ", errBuf)
 		return nil, fmt.Errorf("%v failed: %v", blameCmd, err)
 	}
@@ -74,84 +92,184 @@ func NewShortBlame(repo *git.Repository, filepath string) (*ShortBlame, error) {
 	return blame, nil
 }
 
-func NewBlame(repo *git.Repository, startSha string, filepath string, dir BlameDirection) (*Blame, error) {
-	var blameCmd *exec.Cmd
+// blames are shared by the commits of a repository, by repository, sha, path
+// and direction
+var blames *lru.Cache
+
+func init() {
+	blames, _ = lru.New(100)
+}
+
+// NewBlame returns the blame of a file at startSha, or from startSha to HEAD
+// for BlameForward, using blameStrategy. Cosmetic commits are only skipped
+// backwards.
+func NewBlame(ctx context.Context, repo *git.Repository, startSha string, filepath string, dir BlameDirection) (b *Blame, err error) {
+	strategy := blameStrategy
+	key := fmt.Sprintf("%s|%s|%s|%d|%v", repo.Path(), startSha, filepath, dir, strategy)
+	if b, ok := blames.Get(key); ok {
+		blameCacheHits.Inc()
+		return b.(*Blame), nil
+	}
+	defer observe("NewBlame", time.Now(), &err)
+	args := strategy.args(repo.Workdir())
+	if b, err = runBlame(ctx, repo.Workdir(), startSha, filepath, dir, args); err != nil {
+		return nil, err
+	}
+	if strategy.SkipCosmetic && dir == BlameBackward {
+		if err = skipCosmetic(ctx, repo.Workdir(), startSha, filepath, b, args); err != nil {
+			return nil, err
+		}
+	}
+	b.strategy = strategy.String()
+	blames.Add(key, b)
+	return b, nil
+}
+
+// runBlame runs git blame with extra options in the work tree workdir
+func runBlame(ctx context.Context, workdir, startSha, filepath string, dir BlameDirection, args []string) (*Blame, error) {
+	blameArgs := []string{"blame", "--line-porcelain"}
+	blameArgs = append(blameArgs, args...)
 	if dir == BlameForward {
-		blameCmd = exec.Command(
-			"git",
-			"blame",
-			//fmt.Sprintf("-L %d,%d", minLine, maxLine),
-			"--line-porcelain",
-			"--reverse",
-			startSha+"..HEAD",
-			"--",
-			filepath,
-		)
+		blameArgs = append(blameArgs, "--reverse", startSha+"..HEAD")
 	} else {
-		blameCmd = exec.Command(
-			"git",
-			"blame",
-			//fmt.Sprintf("-L %d,%d", minLine, maxLine),
-			"--line-porcelain",
-			startSha,
-			"--",
-			filepath,
-		)
+		blameArgs = append(blameArgs, startSha)
 	}
+	blameCmd := proc.Command(ctx, blameTimeout, "git", append(blameArgs, "--", filepath)...)
 	buf := new(bytes.Buffer)
 	errBuf := new(bytes.Buffer)
 	blameCmd.Stdout = buf
 	blameCmd.Stderr = errBuf
-	blameCmd.Dir = repo.Workdir()
+	blameCmd.Dir = workdir
 	if err := blameCmd.Run(); err != nil {
+		if proc.IsTimeout(err) {
+			return nil, err
+		}
 		log.Print("stderr: ", errBuf)
 		return nil, fmt.Errorf("%v failed: %v", blameCmd, err)
 	}
-	return &Blame{raw: buf.String()}, nil
+	b, err := ParseBlame(buf)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", blameCmd, err)
+	}
+	b.dir = dir
+	return b, nil
 }
 
-func (blame *Blame) ForLine(lineNum int) (bl *BlameLine, err error) {
+// ParseBlame reads the output of git blame --line-porcelain
+func ParseBlame(r io.Reader) (*Blame, error) {
 	var (
-		matches []string
+		b       = new(Blame)
+		bl      *BlameLine
+		scanner = bufio.NewScanner(r)
 	)
-	re := regexp.MustCompile(fmt.Sprintf(`([[:xdigit:]]{40}) (\d+) %d ?\d*
-author ([^\n]*)
-author-mail ([^\n]*)
-author-time ([[:print:]]*)
-author-tz [[:print:]]*
-committer ([^\n]*)
-committer-mail ([^\n]*)
-committer-time [[:print:]]*
-committer-tz [[:print:]]*
-summary [[:print:]]*
-(?:previous ([[:xdigit:]]{40}) ([^\n]*))?(?:[^\t]*?)
-\t[[:print:]]*`, lineNum))
-	if matches = re.FindStringSubmatch(blame.raw); matches == nil {
-		err = fmt.Errorf("line %v not found in blame", lineNum)
-	} else {
-		origLN, err := strconv.Atoi(matches[2])
-		if err != nil {
-			return nil, err
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if bl == nil {
+			// <sha> <original line> <final line> [<lines in group>]
+			fields := strings.Fields(line)
+			if len(fields) < 3 || len(fields[0]) != 40 {
+				return nil, fmt.Errorf("invalid blame header %q", line)
+			}
+			bl = &BlameLine{Sha: fields[0]}
+			var err error
+			if bl.OriginalLineNum, err = strconv.Atoi(fields[1]); err != nil {
+				return nil, err
+			}
+			if bl.FinalLineNum, err = strconv.Atoi(fields[2]); err != nil {
+				return nil, err
+			}
+			continue
 		}
-		unixTS, err := strconv.ParseInt(matches[5], 0, 64)
-		if err != nil {
-			return nil, err
+		if strings.HasPrefix(line, "\t") {
+			bl.Content = line[1:]
+			if bl.FinalLineNum != len(b.lines)+1 {
+				return nil, fmt.Errorf("blame of line %d follows line %d", bl.FinalLineNum, len(b.lines))
+			}
+			b.lines = append(b.lines, *bl)
+			bl = nil
+			continue
 		}
-
-		bl = &BlameLine{
-			Sha:             matches[1],
-			Author:          matches[3],
-			AuthorMail:      matches[4],
-			AuthorTimestamp: time.Unix(unixTS, 0),
-			Committer:       matches[6],
-			CommitterMail:   matches[7],
-			PreviousCommit:  matches[8],
-			PreviousPath:    matches[9],
-			FinalLineNum:    lineNum,
-			OriginalLineNum: origLN,
+		key, value := line, ""
+		if i := strings.IndexByte(line, ' '); i >= 0 {
+			key, value = line[:i], line[i+1:]
+		}
+		switch key {
+		case "author":
+			bl.Author = value
+		case "author-mail":
+			bl.AuthorMail = value
+		case "author-time":
+			bl.AuthorTimestamp = unixTime(value)
+		case "author-tz":
+			bl.AuthorTimestamp = bl.AuthorTimestamp.In(blameZone(value))
+		case "committer":
+			bl.Committer = value
+		case "committer-mail":
+			bl.CommitterMail = value
+		case "committer-time":
+			bl.CommitterTimestamp = unixTime(value)
+		case "committer-tz":
+			bl.CommitterTimestamp = bl.CommitterTimestamp.In(blameZone(value))
+		case "summary":
+			bl.Summary = value
+		case "previous":
+			if i := strings.IndexByte(value, ' '); i >= 0 {
+				bl.PreviousCommit, bl.PreviousPath = value[:i], value[i+1:]
+			}
+		case "boundary":
+			bl.Boundary = true
+		case "filename":
+			bl.Filename = value
 		}
 	}
-	return
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if bl != nil {
+		return nil, fmt.Errorf("blame of line %d is incomplete", bl.FinalLineNum)
+	}
+	return b, nil
+}
+
+func unixTime(ts string) time.Time {
+	sec, _ := strconv.ParseInt(ts, 10, 64)
+	return time.Unix(sec, 0)
+}
+
+// blameZone parses a time zone like +0200
+func blameZone(tz string) *time.Location {
+	if len(tz) != 5 {
+		return time.UTC
+	}
+	hours, err1 := strconv.Atoi(tz[1:3])
+	minutes, err2 := strconv.Atoi(tz[3:])
+	if err1 != nil || err2 != nil {
+		return time.UTC
+	}
+	offset := (hours*60 + minutes) * 60
+	if tz[0] == '-' {
+		offset = -offset
+	}
+	return time.FixedZone(tz, offset)
+}
+
+// ForLine returns the blame of a line of the final file, counting from 1
+func (blame *Blame) ForLine(lineNum int) (*BlameLine, error) {
+	if lineNum < 1 || lineNum > len(blame.lines) {
+		return nil, fmt.Errorf("line %v not found in blame", lineNum)
+	}
+	return &blame.lines[lineNum-1], nil
+}
+
+// Strategy returns the written form of the BlameStrategy of the blame
+func (blame *Blame) Strategy() string {
+	return blame.strategy
+}
+
+// Len returns the number of lines of the blamed file
+func (blame *Blame) Len() int {
+	return len(blame.lines)
 }
 
 func (blame *ShortBlame) newestLine(startLine, endLine uint) (bl *BlameLine, err error) {
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Blame policies choose the blamed commits of a fixing commit among its
+// candidates: the one with the most blamed lines, every candidate, or the most
+// recent one. Ties go to the more recent commit.
+const (
+	BlamePolicyMax    = "max"
+	BlamePolicyAll    = "all"
+	BlamePolicyRecent = "recent"
+)
+
+var (
+	blamePolicy   = BlamePolicyMax
+	blamePolicies = []string{BlamePolicyMax, BlamePolicyAll, BlamePolicyRecent}
+	// filterDisclosed discards blame candidates committed after the CVE of
+	// the fixing commit was published, they cannot have introduced it
+	filterDisclosed = true
+)
+
+// BlameCandidate is a commit that last touched lines changed by a fixing
+// commit. Lines are those of the parent of the fixing commit.
+type BlameCandidate struct {
+	Id          int64     `json:"-" db:"id"`
+	CommitId    int64     `json:"-" db:"commit_id"`
+	Sha         string    `json:"sha" db:"sha"`
+	When        time.Time `json:"when" db:"committer_when"`
+	BlamedLines int       `json:"blamed_lines" db:"blamed_lines"`
+	Files       string    `json:"files" db:"files"` // comma separated
+	Lines       string    `json:"lines" db:"lines"` // file:line, comma separated
+	Selected    bool      `json:"selected" db:"selected"`
+	Strategy    string    `json:"strategy" db:"strategy"` // BlameStrategy of the blame
+
+	AfterDisclosure bool `json:"after_disclosure" db:"after_disclosure"` // discarded by filterDisclosed
+}
+
+// blameCandidates collects the candidates of a fixing commit
+type blameCandidates struct {
+	bySha map[string]*BlameCandidate
+	files map[string]map[string]bool // by sha
+	lines map[string][]string        // by sha
+}
+
+func newBlameCandidates() *blameCandidates {
+	return &blameCandidates{
+		bySha: make(map[string]*BlameCandidate),
+		files: make(map[string]map[string]bool),
+		lines: make(map[string][]string),
+	}
+}
+
+// Add records that bl, found with strategy, blames a line of a file
+func (bc *blameCandidates) Add(path string, bl *BlameLine, strategy string) {
+	cand, ok := bc.bySha[bl.Sha]
+	if !ok {
+		cand = &BlameCandidate{Sha: bl.Sha, When: bl.CommitterTimestamp, Strategy: strategy}
+		bc.bySha[bl.Sha] = cand
+		bc.files[bl.Sha] = make(map[string]bool)
+	}
+	cand.BlamedLines++
+	bc.files[bl.Sha][path] = true
+	bc.lines[bl.Sha] = append(bc.lines[bl.Sha], path+":"+strconv.Itoa(bl.FinalLineNum))
+}
+
+// Candidates returns the candidates, most blamed lines first
+func (bc *blameCandidates) Candidates() []*BlameCandidate {
+	cands := make([]*BlameCandidate, 0, len(bc.bySha))
+	for sha, cand := range bc.bySha {
+		files := make([]string, 0, len(bc.files[sha]))
+		for f := range bc.files[sha] {
+			files = append(files, f)
+		}
+		sort.Strings(files)
+		cand.Files = strings.Join(files, ",")
+		cand.Lines = strings.Join(bc.lines[sha], ",")
+		cands = append(cands, cand)
+	}
+	sort.Slice(cands, func(i, j int) bool {
+		a, b := cands[i], cands[j]
+		if a.BlamedLines != b.BlamedLines {
+			return a.BlamedLines > b.BlamedLines
+		}
+		if !a.When.Equal(b.When) {
+			return a.When.After(b.When)
+		}
+		return a.Sha < b.Sha
+	})
+	return cands
+}
+
+// SelectBlamed marks the candidates chosen by policy as selected and returns
+// them, the first one is the blamed commit of the fixing commit
+func SelectBlamed(cands []*BlameCandidate, policy string) ([]*BlameCandidate, error) {
+	selected, err := chooseBlamed(cands, policy)
+	for _, cand := range selected {
+		cand.Selected = true
+	}
+	return selected, err
+}
+
+// SelectBlamedBefore is SelectBlamed for the candidates committed up to the
+// end of the day published, in UTC. The others are marked AfterDisclosure.
+// changed reports whether this changed the selected candidates.
+func SelectBlamedBefore(cands []*BlameCandidate, policy string, published time.Time) (selected []*BlameCandidate, changed bool, err error) {
+	end := published.UTC().Truncate(24 * time.Hour).Add(24 * time.Hour)
+	var before []*BlameCandidate
+	for _, cand := range cands {
+		if cand.When.Before(end) {
+			before = append(before, cand)
+		} else {
+			cand.AfterDisclosure = true
+		}
+	}
+	if len(before) == len(cands) {
+		selected, err = SelectBlamed(cands, policy)
+		return
+	}
+	unfiltered, err := chooseBlamed(cands, policy)
+	if err != nil {
+		return
+	}
+	if selected, err = SelectBlamed(before, policy); err != nil {
+		return
+	}
+	changed = len(selected) != len(unfiltered)
+	for i := 0; !changed && i < len(selected); i++ {
+		changed = selected[i] != unfiltered[i]
+	}
+	return
+}
+
+func chooseBlamed(cands []*BlameCandidate, policy string) ([]*BlameCandidate, error) {
+	if len(cands) == 0 {
+		return nil, nil
+	}
+	var selected []*BlameCandidate
+	switch policy {
+	case BlamePolicyMax:
+		selected = cands[:1]
+	case BlamePolicyAll:
+		selected = cands
+	case BlamePolicyRecent:
+		recent := cands[0]
+		for _, cand := range cands[1:] {
+			if cand.When.After(recent.When) {
+				recent = cand
+			}
+		}
+		selected = []*BlameCandidate{recent}
+	default:
+		return nil, fmt.Errorf("unknown blame policy %s, use one of %v", policy, blamePolicies)
+	}
+	return selected, nil
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBlameCandidates(t *testing.T) {
+	old, recent := time.Unix(1400000000, 0), time.Unix(1500000000, 0)
+	bc := newBlameCandidates()
+	for _, b := range []struct {
+		path string
+		bl   BlameLine
+	}{
+		{"a.c", BlameLine{Sha: "aaaa", CommitterTimestamp: old, FinalLineNum: 3}},
+		{"a.c", BlameLine{Sha: "bbbb", CommitterTimestamp: old, FinalLineNum: 4}},
+		{"b.c", BlameLine{Sha: "aaaa", CommitterTimestamp: old, FinalLineNum: 10}},
+		{"b.c", BlameLine{Sha: "cccc", CommitterTimestamp: recent, FinalLineNum: 11}},
+		{"a.c", BlameLine{Sha: "dddd", CommitterTimestamp: old, FinalLineNum: 5}},
+		{"a.c", BlameLine{Sha: "dddd", CommitterTimestamp: old, FinalLineNum: 6}},
+	} {
+		bl := b.bl
+		bc.Add(b.path, &bl, "plain")
+	}
+
+	cands := bc.Candidates()
+	if len(cands) != 4 {
+		t.Fatalf("expected 4 candidates, got %d", len(cands))
+	}
+	// ties go to the more recent commit, then by sha
+	for i, sha := range []string{"aaaa", "dddd", "cccc", "bbbb"} {
+		if cands[i].Sha != sha {
+			t.Errorf("candidate %d: expected %s, got %+v", i, sha, cands[i])
+		}
+	}
+	if a := cands[0]; a.BlamedLines != 2 || a.Files != "a.c,b.c" || a.Lines != "a.c:3,b.c:10" {
+		t.Errorf("unexpected candidate %+v", a)
+	}
+
+	for policy, expected := range map[string][]string{
+		BlamePolicyMax:    {"aaaa"},
+		BlamePolicyAll:    {"aaaa", "dddd", "cccc", "bbbb"},
+		BlamePolicyRecent: {"cccc"},
+	} {
+		cands := newBlameCandidatesFrom(bc)
+		selected, err := SelectBlamed(cands, policy)
+		handleErr(t, err)
+		if len(selected) != len(expected) {
+			t.Fatalf("%s: expected %v, got %d candidates", policy, expected, len(selected))
+		}
+		n := 0
+		for i, cand := range selected {
+			if cand.Sha != expected[i] {
+				t.Errorf("%s: expected %v, got %s at %d", policy, expected, cand.Sha, i)
+			}
+		}
+		for _, cand := range cands {
+			if cand.Selected {
+				n++
+			}
+		}
+		if n != len(expected) {
+			t.Errorf("%s: expected %d selected candidates, got %d", policy, len(expected), n)
+		}
+	}
+	if _, err := SelectBlamed(cands, "oldest"); err == nil {
+		t.Error("expected an error for an unknown policy")
+	}
+}
+
+// newBlameCandidatesFrom returns fresh copies of the candidates of bc
+func newBlameCandidatesFrom(bc *blameCandidates) []*BlameCandidate {
+	var cands []*BlameCandidate
+	for _, cand := range bc.Candidates() {
+		c := *cand
+		cands = append(cands, &c)
+	}
+	return cands
+}
+
+func TestSelectBlamedBefore(t *testing.T) {
+	published := time.Date(2014, 4, 7, 0, 0, 0, 0, time.UTC)
+	candidates := func() []*BlameCandidate {
+		return []*BlameCandidate{
+			{Sha: "late", BlamedLines: 3, When: time.Date(2014, 4, 8, 1, 0, 0, 0, time.UTC)},
+			{Sha: "sameday", BlamedLines: 2, When: time.Date(2014, 4, 7, 23, 0, 0, 0, time.UTC)},
+			{Sha: "early", BlamedLines: 1, When: time.Date(2012, 1, 1, 0, 0, 0, 0, time.UTC)},
+		}
+	}
+
+	cands := candidates()
+	selected, changed, err := SelectBlamedBefore(cands, BlamePolicyMax, published)
+	handleErr(t, err)
+	if len(selected) != 1 || selected[0].Sha != "sameday" || !changed {
+		t.Errorf("expected the next best candidate and a changed outcome, got %v %v", selected, changed)
+	}
+	if !cands[0].AfterDisclosure || cands[0].Selected || cands[1].AfterDisclosure || !cands[1].Selected {
+		t.Errorf("unexpected marks %+v %+v", cands[0], cands[1])
+	}
+
+	// the oldest candidate wins either way
+	cands = candidates()
+	cands[2].BlamedLines = 5
+	cands = append(cands[2:], cands[:2]...)
+	selected, changed, err = SelectBlamedBefore(cands, BlamePolicyMax, published)
+	handleErr(t, err)
+	if len(selected) != 1 || selected[0].Sha != "early" || changed {
+		t.Errorf("expected an unchanged outcome, got %v %v", selected, changed)
+	}
+
+	selected, changed, err = SelectBlamedBefore(candidates(), BlamePolicyAll, published)
+	handleErr(t, err)
+	if len(selected) != 2 || !changed {
+		t.Errorf("expected 2 candidates and a changed outcome, got %d %v", len(selected), changed)
+	}
+
+	selected, changed, err = SelectBlamedBefore(candidates(), BlamePolicyMax, published.AddDate(-5, 0, 0))
+	handleErr(t, err)
+	if len(selected) != 0 || !changed {
+		t.Errorf("expected no candidate to remain, got %v %v", selected, changed)
+	}
+}
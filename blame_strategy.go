@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/juju/utils/set"
+
+	"tools.net.cs.uni-bonn.de/social-aspects-of-vulnerabilities/github-data/proc"
+)
+
+var (
+	// blameStrategy is how fixing commits are blamed, see BlameStrategy
+	blameStrategy BlameStrategy
+	// blameIgnoreRevs is the file of commits skipped by the ignore-revs
+	// strategy, relative to the work tree of each repository
+	blameIgnoreRevs = ".git-blame-ignore-revs"
+	// maxCosmeticRounds limits how often a file is blamed again to skip
+	// cosmetic commits
+	maxCosmeticRounds = 5
+)
+
+// BlameStrategy selects the SZZ variant used to find the commits blamed by a
+// fixing commit. It is written as a comma separated list of
+//
+//	w            ignore whitespace (git blame -w)
+//	M            follow lines moved within a file (-M)
+//	C            also follow lines moved or copied from other files (-C)
+//	ignore-revs  skip the commits listed in blameIgnoreRevs
+//	cosmetic     skip commits that only changed whitespace or comments of a line
+//
+// or "plain" for none of them.
+type BlameStrategy struct {
+	IgnoreWhitespace bool
+	Moves            string // "", "M" or "C"
+	IgnoreRevs       bool
+	SkipCosmetic     bool
+}
+
+// ParseBlameStrategy parses the written form of a strategy
+func ParseBlameStrategy(s string) (bs BlameStrategy, err error) {
+	if s == "" || s == "plain" {
+		return
+	}
+	for _, opt := range strings.Split(s, ",") {
+		switch opt = strings.TrimSpace(opt); opt {
+		case "w":
+			bs.IgnoreWhitespace = true
+		case "M", "C":
+			if bs.Moves != "" && bs.Moves != opt {
+				return bs, fmt.Errorf("M and C exclude each other")
+			}
+			bs.Moves = opt
+		case "ignore-revs":
+			bs.IgnoreRevs = true
+		case "cosmetic":
+			bs.SkipCosmetic = true
+		default:
+			return bs, fmt.Errorf("unknown blame option %q, use w, M, C, ignore-revs or cosmetic", opt)
+		}
+	}
+	return
+}
+
+// String returns the written form of the strategy, options in a fixed order
+func (bs BlameStrategy) String() string {
+	var opts []string
+	if bs.IgnoreWhitespace {
+		opts = append(opts, "w")
+	}
+	if bs.Moves != "" {
+		opts = append(opts, bs.Moves)
+	}
+	if bs.IgnoreRevs {
+		opts = append(opts, "ignore-revs")
+	}
+	if bs.SkipCosmetic {
+		opts = append(opts, "cosmetic")
+	}
+	if len(opts) == 0 {
+		return "plain"
+	}
+	return strings.Join(opts, ",")
+}
+
+// Set implements flag.Value
+func (bs *BlameStrategy) Set(s string) (err error) {
+	*bs, err = ParseBlameStrategy(s)
+	return
+}
+
+// args returns the git blame options of the strategy in the work tree dir.
+// A missing ignore-revs file is skipped, since git blame fails on it.
+func (bs BlameStrategy) args(dir string) []string {
+	var args []string
+	if bs.IgnoreWhitespace {
+		args = append(args, "-w")
+	}
+	if bs.Moves != "" {
+		args = append(args, "-"+bs.Moves)
+	}
+	if bs.IgnoreRevs && blameIgnoreRevs != "" {
+		path := blameIgnoreRevs
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(dir, path)
+		}
+		if _, err := os.Stat(path); err == nil {
+			args = append(args, "--ignore-revs-file", path)
+		}
+	}
+	return args
+}
+
+// skipCosmetic blames the lines of b again whose blamed commit only changed
+// whitespace or comments of them, ignoring those commits, until each line is
+// blamed on a commit that changed its code. Lines that git still attributes
+// to an ignored commit keep it.
+func skipCosmetic(ctx context.Context, dir, rev, path string, b *Blame, args []string) error {
+	ignored := set.NewStrings()
+	hunks := make(map[string][]diffHunk) // by sha and file
+	for round := 0; round < maxCosmeticRounds; round++ {
+		var redo []int
+		for i := range b.lines {
+			bl := &b.lines[i]
+			if bl.Boundary || bl.PreviousCommit == "" || ignored.Contains(bl.Sha) {
+				continue
+			}
+			key := bl.Sha + ":" + bl.Filename
+			hs, ok := hunks[key]
+			if !ok {
+				var err error
+				if hs, err = commitHunks(ctx, dir, bl); err != nil {
+					return err
+				}
+				hunks[key] = hs
+			}
+			if h := hunkAt(hs, bl.OriginalLineNum); h != nil && h.Cosmetic() {
+				redo = append(redo, i)
+			}
+		}
+		if len(redo) == 0 {
+			return nil
+		}
+		for _, i := range redo {
+			ignored.Add(b.lines[i].Sha)
+		}
+		ignoreArgs := append([]string(nil), args...)
+		for _, sha := range ignored.SortedValues() {
+			ignoreArgs = append(ignoreArgs, "--ignore-rev", sha)
+		}
+		again, err := runBlame(ctx, dir, rev, path, BlameBackward, ignoreArgs)
+		if err != nil {
+			return err
+		}
+		if again.Len() != b.Len() {
+			return fmt.Errorf("blame of %s ignoring %v has %d lines instead of %d", path, ignored.SortedValues(), again.Len(), b.Len())
+		}
+		for _, i := range redo {
+			b.lines[i] = again.lines[i]
+		}
+	}
+	return nil
+}
+
+// commitHunks returns the hunks of the change of the commit of bl to its file
+func commitHunks(ctx context.Context, dir string, bl *BlameLine) ([]diffHunk, error) {
+	diffCmd := proc.Command(ctx, blameTimeout,
+		"git",
+		"diff",
+		"--no-color",
+		"--no-ext-diff",
+		"-U0",
+		bl.PreviousCommit+":"+bl.PreviousPath,
+		bl.Sha+":"+bl.Filename,
+	)
+	out, errBuf := new(bytes.Buffer), new(bytes.Buffer)
+	diffCmd.Stdout, diffCmd.Stderr = out, errBuf
+	diffCmd.Dir = dir
+	if err := diffCmd.Run(); err != nil {
+		if proc.IsTimeout(err) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("%v failed: %v: %s", diffCmd, err, bytes.TrimSpace(errBuf.Bytes()))
+	}
+	return parseHunks(out)
+}
+
+// diffHunk is a hunk of a diff without context lines
+type diffHunk struct {
+	NewStart, NewLines int
+	Old, New           []string
+}
+
+// parseHunks reads the hunks of a diff of one file made with -U0
+func parseHunks(r io.Reader) ([]diffHunk, error) {
+	var (
+		hunks   []diffHunk
+		scanner = bufio.NewScanner(r)
+	)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "@@ "):
+			// @@ -<start>[,<lines>] +<start>[,<lines>] @@
+			fields := strings.Fields(line)
+			if len(fields) < 4 || !strings.HasPrefix(fields[2], "+") {
+				return nil, fmt.Errorf("invalid hunk header %q", line)
+			}
+			h := diffHunk{NewLines: 1}
+			start, count := fields[2][1:], ""
+			if i := strings.IndexByte(start, ','); i >= 0 {
+				start, count = start[:i], start[i+1:]
+			}
+			var err error
+			if h.NewStart, err = strconv.Atoi(start); err != nil {
+				return nil, fmt.Errorf("invalid hunk header %q", line)
+			}
+			if count != "" {
+				if h.NewLines, err = strconv.Atoi(count); err != nil {
+					return nil, fmt.Errorf("invalid hunk header %q", line)
+				}
+			}
+			hunks = append(hunks, h)
+		case len(hunks) == 0: // file header
+		case strings.HasPrefix(line, "-"):
+			h := &hunks[len(hunks)-1]
+			h.Old = append(h.Old, line[1:])
+		case strings.HasPrefix(line, "+"):
+			h := &hunks[len(hunks)-1]
+			h.New = append(h.New, line[1:])
+		}
+	}
+	return hunks, scanner.Err()
+}
+
+// hunkAt returns the hunk that added line of the new file, nil if the line
+// is unchanged
+func hunkAt(hunks []diffHunk, line int) *diffHunk {
+	for i := range hunks {
+		h := &hunks[i]
+		if line >= h.NewStart && line < h.NewStart+h.NewLines {
+			return h
+		}
+	}
+	return nil
+}
+
+// Cosmetic reports whether the hunk only changes whitespace or comments
+func (h *diffHunk) Cosmetic() bool {
+	return stripCode(strings.Join(h.Old, "\n")) == stripCode(strings.Join(h.New, "\n"))
+}
+
+// stripCode removes C comments and whitespace outside of string and
+// character literals
+func stripCode(src string) string {
+	var out strings.Builder
+	for i := 0; i < len(src); i++ {
+		c := src[i]
+		switch {
+		case c == '/' && strings.HasPrefix(src[i:], "//"):
+			for i < len(src) && src[i] != '\n' {
+				i++
+			}
+		case c == '/' && strings.HasPrefix(src[i:], "/*"):
+			end := strings.Index(src[i+2:], "*/")
+			if end < 0 {
+				return out.String()
+			}
+			i += end + 3
+		case c == '"' || c == '\'':
+			out.WriteByte(c)
+			for i++; i < len(src) && src[i] != c && src[i] != '\n'; i++ {
+				if src[i] == '\\' && i+1 < len(src) {
+					out.WriteByte(src[i])
+					i++
+				}
+				out.WriteByte(src[i])
+			}
+			if i < len(src) && src[i] == c {
+				out.WriteByte(c)
+			}
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f' || c == '\v':
+		default:
+			out.WriteByte(c)
+		}
+	}
+	return out.String()
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseBlameStrategy(t *testing.T) {
+	for s, expected := range map[string]string{
+		"":                         "plain",
+		"plain":                    "plain",
+		"cosmetic, w":              "w,cosmetic",
+		"C,ignore-revs,w,cosmetic": "w,C,ignore-revs,cosmetic",
+		"M,M":                      "M",
+	} {
+		bs, err := ParseBlameStrategy(s)
+		handleErr(t, err)
+		if bs.String() != expected {
+			t.Errorf("%q: expected %s, got %s", s, expected, bs)
+		}
+	}
+	for _, s := range []string{"M,C", "x", "w,"} {
+		if _, err := ParseBlameStrategy(s); err == nil {
+			t.Errorf("%q: expected an error", s)
+		}
+	}
+	bs, _ := ParseBlameStrategy("w,C,ignore-revs")
+	blameIgnoreRevs = "missing-ignore-revs"
+	defer func() { blameIgnoreRevs = ".git-blame-ignore-revs" }()
+	if args := bs.args(os.TempDir()); !reflect.DeepEqual(args, []string{"-w", "-C"}) {
+		t.Errorf("expected the ignore-revs file to be skipped, got %q", args)
+	}
+}
+
+func TestParseHunks(t *testing.T) {
+	diff := `diff --git a/f.c b/f.c
+index 1111111..2222222 100644
+--- a/f.c
++++ b/f.c
+@@ -3 +3 @@ int f(int x)
+-	return x+1;
++	return x + 1; /* one more */
+@@ -5,0 +6,2 @@ int g;
++// h is new
++int h;
+@@ -9,2 +10 @@
+--x;
+-y;
++x-- + y;
+`
+	hunks, err := parseHunks(strings.NewReader(diff))
+	handleErr(t, err)
+	if len(hunks) != 3 {
+		t.Fatalf("expected 3 hunks, got %+v", hunks)
+	}
+	for line, cosmetic := range map[int]bool{3: true, 6: false, 7: false, 10: false} {
+		h := hunkAt(hunks, line)
+		if h == nil {
+			t.Errorf("line %d: no hunk", line)
+		} else if h.Cosmetic() != cosmetic {
+			t.Errorf("line %d: expected cosmetic %v for %+v", line, cosmetic, h)
+		}
+	}
+	for _, line := range []int{1, 4, 5, 8, 11} {
+		if h := hunkAt(hunks, line); h != nil {
+			t.Errorf("line %d: expected no hunk, got %+v", line, h)
+		}
+	}
+	if _, err = parseHunks(strings.NewReader("@@ -1 +x @@\n")); err == nil {
+		t.Error("expected an error for an invalid hunk header")
+	}
+}
+
+func TestStripCode(t *testing.T) {
+	for src, expected := range map[string]string{
+		"int a = 1; // one":          "inta=1;",
+		"int /* a\n b */ c;":         "intc;",
+		`puts("a  // b /* c");`:      `puts("a  // b /* c");`,
+		`c = '"'; d = "\" /* x */";`: `c='"';d="\" /* x */";`,
+		"return x + 1;\t/* cut off":  "returnx+1;",
+	} {
+		if s := stripCode(src); s != expected {
+			t.Errorf("%q: expected %q, got %q", src, expected, s)
+		}
+	}
+}
+
+func TestSkipCosmetic(t *testing.T) {
+	dir, _, commit := tempGitRepo(t, "skip-cosmetic")
+	defer os.RemoveAll(dir)
+	a := commit("a", "int f(int x)\n{\n\treturn x+1;\n}\nint g;\n")
+	b := commit("b", "int f(int x)\n{\n\treturn x + 1; /* one more */\n}\nint g = 1;\n")
+	c := commit("c", "int f(int x)\n{\n\treturn x + 1; /* one more */\n}\nint g = 2;\n")
+
+	ctx := context.Background()
+	blame, err := runBlame(ctx, dir, c, "f.c", BlameBackward, nil)
+	handleErr(t, err)
+	if bl, _ := blame.ForLine(3); bl.Sha != b {
+		t.Fatalf("expected line 3 to be blamed on %s without skipping, got %s", b, bl.Sha)
+	}
+	handleErr(t, skipCosmetic(ctx, dir, c, "f.c", blame, nil))
+	for line, sha := range map[int]string{1: a, 3: a, 5: c} {
+		if bl, _ := blame.ForLine(line); bl.Sha != sha {
+			t.Errorf("line %d: expected %s, got %s", line, sha, bl.Sha)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+const porcelain = `1111111111111111111111111111111111111111 1 1 2
+author Alice
+author-mail <alice@example.com>
+author-time 1400000000
+author-tz +0200
+committer Carol
+committer-mail <carol@example.com>
+committer-time 1400000100
+committer-tz -0130
+summary add a and b
+boundary
+filename old.c
+	int a;
+1111111111111111111111111111111111111111 2 2
+author Alice
+author-mail <alice@example.com>
+author-time 1400000000
+author-tz +0200
+committer Carol
+committer-mail <carol@example.com>
+committer-time 1400000100
+committer-tz -0130
+summary add a and b
+boundary
+filename old.c
+	int b;
+2222222222222222222222222222222222222222 2 3 1
+author Bob
+author-mail <bob@example.com>
+author-time 1500000000
+author-tz +0000
+committer Bob
+committer-mail <bob@example.com>
+committer-time 1500000000
+committer-tz +0000
+summary rename and add c
+previous 1111111111111111111111111111111111111111 old.c
+filename new.c
+	int c;	/* tab */
+`
+
+func TestParseBlame(t *testing.T) {
+	b, err := ParseBlame(strings.NewReader(porcelain))
+	handleErr(t, err)
+	if b.Len() != 3 {
+		t.Fatalf("expected 3 lines, got %d", b.Len())
+	}
+
+	bl, err := b.ForLine(2)
+	handleErr(t, err)
+	if bl.Sha != "1111111111111111111111111111111111111111" || bl.Author != "Alice" || bl.AuthorMail != "<alice@example.com>" ||
+		bl.Committer != "Carol" || bl.Summary != "add a and b" || !bl.Boundary || bl.Filename != "old.c" ||
+		bl.Content != "int b;" || bl.OriginalLineNum != 2 || bl.FinalLineNum != 2 || bl.PreviousCommit != "" {
+		t.Errorf("unexpected blame of line 2: %+v", bl)
+	}
+	if _, offset := bl.AuthorTimestamp.Zone(); bl.AuthorTimestamp.Unix() != 1400000000 || offset != 2*3600 {
+		t.Errorf("unexpected author time %v", bl.AuthorTimestamp)
+	}
+	if _, offset := bl.CommitterTimestamp.Zone(); bl.CommitterTimestamp.Unix() != 1400000100 || offset != -90*60 {
+		t.Errorf("unexpected committer time %v", bl.CommitterTimestamp)
+	}
+
+	bl, err = b.ForLine(3)
+	handleErr(t, err)
+	if bl.Sha != "2222222222222222222222222222222222222222" || bl.Boundary || bl.Filename != "new.c" ||
+		bl.PreviousCommit != "1111111111111111111111111111111111111111" || bl.PreviousPath != "old.c" ||
+		bl.Content != "int c;\t/* tab */" || bl.OriginalLineNum != 2 {
+		t.Errorf("unexpected blame of line 3: %+v", bl)
+	}
+
+	for _, line := range []int{0, 4} {
+		if _, err := b.ForLine(line); err == nil {
+			t.Errorf("expected an error for line %d", line)
+		}
+	}
+	if _, err := ParseBlame(strings.NewReader(porcelain[:200])); err == nil {
+		t.Error("expected an error for truncated output")
+	}
+}
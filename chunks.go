@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/garyburd/redigo/redis"
+)
+
+// Repositories with more selected commits than chunkSize are split into jobs
+// of chunkSize commits ("owner/repo#n"), which any worker can claim. 0
+// disables splitting.
+var chunkSize = 0
+
+// ChunkJob returns the job name of the n-th chunk of a repository
+func ChunkJob(reponame string, n int) string {
+	return fmt.Sprintf("%s#%d", reponame, n)
+}
+
+// ParseJob returns the repository of a job and whether it is a chunk
+func ParseJob(job string) (reponame string, isChunk bool) {
+	if i := strings.LastIndex(job, "#"); i >= 0 {
+		return job[:i], true
+	}
+	return job, false
+}
+
+// KEYS: working, chunks left, chunks, init; ARGV: repo, worker, number of
+// chunks, then job and commit ids of each chunk. A repository is only split
+// once, a job that claims it again after a lost lease leaves the chunks as
+// they are.
+var splitScript = redis.NewScript(4, `
+	if redis.call('HGET', KEYS[1], ARGV[1]) ~= ARGV[2] then
+		return -1
+	end
+	if redis.call('HSETNX', KEYS[2], ARGV[1], tonumber(ARGV[3]) + 1) == 0 then
+		return 0
+	end
+	for i = 4, #ARGV, 2 do
+		redis.call('HSET', KEYS[3], ARGV[i], ARGV[i+1])
+		redis.call('RPUSH', KEYS[4], ARGV[i])
+	end
+	return 1`)
+
+// EnqueueChunks splits commit ids into chunks of chunkSize and puts them into
+// the init list. With a coordinator, its chunkSize is used. It is called by the
+// job of the repository, which counts as one more chunk until it is done, and
+// returns ErrLeaseLost if worker no longer holds that job.
+func EnqueueChunks(reponame, worker string, ids []int64) (n int, err error) {
+	if chunkSize <= 0 {
+		return 0, fmt.Errorf("splitting %s: chunk-size is not set", reponame)
+	}
+	conn := pool.Get()
+	defer conn.Close()
+
+	var chunks []interface{}
+	for start := 0; start < len(ids); start += chunkSize {
+		end := start + chunkSize
+		if end > len(ids) {
+			end = len(ids)
+		}
+		strs := make([]string, 0, end-start)
+		for _, id := range ids[start:end] {
+			strs = append(strs, strconv.FormatInt(id, 10))
+		}
+		chunks = append(chunks, ChunkJob(reponame, n), strings.Join(strs, ","))
+		n++
+	}
+	args := append([]interface{}{RedisWorkingKey, RedisChunksLeftKey, RedisChunksKey, RedisInitKey, reponame, worker, n}, chunks...)
+	split, err := redis.Int(splitScript.Do(conn, args...))
+	if err = leaseResult(split, err); err != nil {
+		return 0, err
+	}
+	if split == 0 {
+		log.Infof("%s: already split", reponame)
+		return n, nil
+	}
+	log.Infof("%s: split %d commits into %d chunks", reponame, len(ids), n)
+	return n, nil
+}
+
+// ChunkCommits returns the commit ids of a chunk job of a worker
+func ChunkCommits(job, worker string) (ids []int64, err error) {
+	conn := pool.Get()
+	defer conn.Close()
+
+	owner, err := redis.String(conn.Do("HGET", RedisWorkingKey, job))
+	if err != nil && err != ErrNil {
+		return nil, err
+	}
+	if owner != worker {
+		return nil, ErrLeaseLost
+	}
+	s, err := redis.String(conn.Do("HGET", RedisChunksKey, job))
+	if err != nil {
+		return nil, fmt.Errorf("chunk %s: %v", job, err)
+	}
+	for _, str := range strings.Split(s, ",") {
+		id, err := strconv.ParseInt(str, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("chunk %s: %v", job, err)
+		}
+		ids = append(ids, id)
+	}
+	return
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+func TestParseJob(t *testing.T) {
+	if repo, isChunk := ParseJob("torvalds/linux"); repo != "torvalds/linux" || isChunk {
+		t.Errorf("unexpected %s %v", repo, isChunk)
+	}
+	if repo, isChunk := ParseJob(ChunkJob("torvalds/linux", 3)); repo != "torvalds/linux" || !isChunk {
+		t.Errorf("unexpected %s %v", repo, isChunk)
+	}
+}
+
+func TestChunks(t *testing.T) {
+	defer newTestRedis(t)()
+	chunkSize = 2
+	defer func() { chunkSize = 0 }()
+
+	if _, err := EnqueueChunks("foo/bar", "worker", []int64{1, 2, 3}); err != ErrLeaseLost {
+		t.Fatalf("only the worker of foo/bar may split it, got %v", err)
+	}
+	MarkAsWorking("foo/bar", "worker")
+	n, err := EnqueueChunks("foo/bar", "worker", []int64{1, 2, 3, 4, 5})
+	handleErr(t, err)
+	if n != 3 {
+		t.Fatalf("expected 3 chunks, got %d", n)
+	}
+	last := ChunkJob("foo/bar", 2)
+	if _, err := ChunkCommits(last, "worker"); err != ErrLeaseLost {
+		t.Errorf("%s is not claimed yet, got %v", last, err)
+	}
+
+	// the job that split the repository finishes first
+	handleErr(t, MarkAsDone("foo/bar", "worker"))
+	for i := 0; i < n; i++ {
+		job, err := GetNextRepo("worker")
+		handleErr(t, err)
+		if job == last {
+			ids, err := ChunkCommits(job, "worker")
+			handleErr(t, err)
+			if !reflect.DeepEqual(ids, []int64{5}) {
+				t.Errorf("unexpected ids of the last chunk %v", ids)
+			}
+		}
+		if done, _ := QueueEntries("done"); len(done) != 0 {
+			t.Fatalf("foo/bar should not be done before all chunks are, done: %v", done)
+		}
+		handleErr(t, MarkAsDone(job, "worker"))
+	}
+	done, err := QueueEntries("done")
+	handleErr(t, err)
+	if !reflect.DeepEqual(done, []string{"foo/bar"}) {
+		t.Errorf("expected foo/bar to be done, got %v", done)
+	}
+}
+
+func TestChunksFinishFirst(t *testing.T) {
+	defer newTestRedis(t)()
+	chunkSize = 2
+	defer func() { chunkSize = 0 }()
+
+	MarkAsWorking("foo/bar", "parent")
+	n, err := EnqueueChunks("foo/bar", "parent", []int64{1, 2, 3})
+	handleErr(t, err)
+	for i := 0; i < n; i++ {
+		job, err := GetNextRepo("worker")
+		handleErr(t, err)
+		handleErr(t, MarkAsDone(job, "worker"))
+		if done, _ := QueueEntries("done"); len(done) != 0 {
+			t.Fatalf("foo/bar should not be done before its own job is, done: %v", done)
+		}
+	}
+	handleErr(t, MarkAsDone("foo/bar", "parent"))
+	done, err := QueueEntries("done")
+	handleErr(t, err)
+	if !reflect.DeepEqual(done, []string{"foo/bar"}) {
+		t.Errorf("expected foo/bar to be done once, got %v", done)
+	}
+}
+
+func TestSplitOnce(t *testing.T) {
+	defer newTestRedis(t)()
+	chunkSize = 2
+	defer func() { chunkSize = 0 }()
+
+	// the job of the repository splits it again after losing its lease
+	MarkAsWorking("foo/bar", "worker")
+	_, err := EnqueueChunks("foo/bar", "worker", []int64{1, 2, 3})
+	handleErr(t, err)
+	_, err = EnqueueChunks("foo/bar", "worker", []int64{1, 2, 3, 4})
+	handleErr(t, err)
+	if init, _ := QueueEntries("init"); len(init) != 2 {
+		t.Fatalf("expected the chunks of the first split only, got %v", init)
+	}
+	handleErr(t, MarkAsDone("foo/bar", "worker"))
+	for i := 0; i < 2; i++ {
+		job, err := GetNextRepo("worker")
+		handleErr(t, err)
+		handleErr(t, MarkAsDone(job, "worker"))
+	}
+	if done, _ := QueueEntries("done"); !reflect.DeepEqual(done, []string{"foo/bar"}) {
+		t.Errorf("expected foo/bar to be done, got %v", done)
+	}
+}
+
+func TestDeadChunk(t *testing.T) {
+	defer newTestRedis(t)()
+	chunkSize = 2
+	defer func() { chunkSize = 0 }()
+	MaxAttempts = 1
+	defer func() { MaxAttempts = 3 }()
+
+	MarkAsWorking("foo/bar", "worker")
+	_, err := EnqueueChunks("foo/bar", "worker", []int64{1, 2, 3})
+	handleErr(t, err)
+	handleErr(t, MarkAsDone("foo/bar", "worker"))
+	deadJob, err := GetNextRepo("worker")
+	handleErr(t, err)
+	dead, err := ReturnRepo(deadJob, "worker", errors.New("parse failed"))
+	handleErr(t, err)
+	if !dead {
+		t.Fatalf("expected %s to be dead", deadJob)
+	}
+	job, err := GetNextRepo("worker")
+	handleErr(t, err)
+	handleErr(t, MarkAsDone(job, "worker"))
+	if done, _ := QueueEntries("done"); !reflect.DeepEqual(done, []string{"foo/bar"}) {
+		t.Fatalf("expected foo/bar to be done without its dead chunk, got %v", done)
+	}
+
+	// a requeued dead chunk is waited for again
+	handleErr(t, RequeueRepo(deadJob))
+	if done, _ := QueueEntries("done"); len(done) != 0 {
+		t.Fatalf("foo/bar should wait for its requeued chunk, done: %v", done)
+	}
+	job, err = GetNextRepo("worker")
+	handleErr(t, err)
+	handleErr(t, MarkAsDone(job, "worker"))
+	if done, _ := QueueEntries("done"); !reflect.DeepEqual(done, []string{"foo/bar"}) {
+		t.Errorf("expected foo/bar to be done once, got %v", done)
+	}
+}
+
+func TestRemoveChunks(t *testing.T) {
+	defer newTestRedis(t)()
+	chunkSize = 2
+	defer func() { chunkSize = 0 }()
+
+	conn := pool.Get()
+	defer conn.Close()
+
+	MarkAsWorking("foo/bar", "worker")
+	_, err := EnqueueChunks("foo/bar", "worker", []int64{1, 2, 3})
+	handleErr(t, err)
+	handleErr(t, RequeueRepo("foo/bar"))
+	if init, _ := QueueEntries("init"); !reflect.DeepEqual(init, []string{"foo/bar"}) {
+		t.Errorf("expected only foo/bar in init, got %v", init)
+	}
+	if n, _ := redis.Int(conn.Do("HLEN", RedisChunksKey)); n != 0 {
+		t.Error("expected the chunks to be removed")
+	}
+	// split again by the requeued job
+	MarkAsWorking("foo/bar", "worker")
+	n, err := EnqueueChunks("foo/bar", "worker", []int64{1, 2, 3})
+	handleErr(t, err)
+	if init, _ := QueueEntries("init"); len(init) != n+1 {
+		t.Errorf("expected foo/bar to be split again, init: %v", init)
+	}
+	handleErr(t, PurgeRepo("foo/bar"))
+	for _, key := range []string{RedisInitKey, RedisChunksKey, RedisChunksLeftKey} {
+		if n, _ := redis.Int(conn.Do("EXISTS", key)); n != 0 {
+			t.Errorf("expected %s to be empty after purge", key)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"regexp"
@@ -14,16 +15,18 @@ import (
 
 	"time"
 
-	"tools.net.cs.uni-bonn.de/social-aspects-of-vulnerabilities/github-data/ds"
 	"tools.net.cs.uni-bonn.de/social-aspects-of-vulnerabilities/github-data/tools"
 )
 
 var (
-	StandardColumns = []string{"Type", "CVE", "BlamedCommitId", "PastChanges", "FutureChanges", "PastDifferentAuthors", "FutureDifferentAuthors", "HunkCount", "Additions", "Deletions"}
+	StandardColumns = []string{"Type", "CVE", "BlamedCommitId", "PastChanges", "FutureChanges", "PastDifferentAuthors", "FutureDifferentAuthors", "HunkCount", "Additions", "Deletions", "DisclosureFiltered"}
 	PatchColumns    = []string{"Patch", "PatchKeywords"}
 	MessageColumns  = []string{"Message"}
 )
 
+// MaxCommitChanges is the number of changed lines above which a commit is skipped
+const MaxCommitChanges = 2000
+
 // Commit type represents commits from git with additional meta information
 type Commit struct {
 	githubCommit   *github.Commit `db:"-"`
@@ -59,6 +62,13 @@ type Commit struct {
 	Functions                  []*Function    `db:"-"` // Function information
 	ToolResults                []tools.Result `db:"-"` // Tool Results information
 	PatchKeywords              hstore.Hstore  `db:"patch_keywords"`
+	DisclosureFiltered         bool           `db:"disclosure_filtered"` // filterDisclosed changed the blamed commit
+
+	Failures        []CommitFailure   `db:"-"` // errors while updating
+	ParsedFiles     []ParsedFile      `db:"-"` // files whose functions were extracted
+	BlameCandidates []*BlameCandidate `db:"-"` // commits blamed by a fixing commit
+	DeclaredBlames  []*DeclaredBlame  `db:"-"` // Fixes: trailers of the message
+	stage           string            `db:"-"` // current stage of Update
 }
 
 var (
@@ -71,28 +81,54 @@ func (c *Commit) GetId() int64 {
 	return c.Id
 }
 
-// Update gathers and updates meta information for each commit
-func (c *Commit) Update() (err error) {
+// Update gathers and updates meta information for each commit, running the
+// stages of the pipeline one after the other
+func (c *Commit) Update(ctx context.Context) (err error) {
+	skip, err := c.updateMetadata(ctx)
+	if err != nil || skip {
+		return
+	}
+	if err = c.updateBlame(ctx); err != nil {
+		return
+	}
+	return c.persist()
+}
 
+// updateMetadata reads the diff, functions and tool results. Large commits
+// are skipped.
+func (c *Commit) updateMetadata(ctx context.Context) (skip bool, err error) {
 	log.Debugf("%v get git metadata", c)
-	if err = c.GetGitMetadata(); err != nil {
+	c.stage = StageMetadata
+	if err = c.GetGitMetadata(ctx); err != nil {
 		return
 	}
 	// skip large commits
-	if c.Additions+c.Deletions > 2000 {
+	if c.IsLarge() {
 		log.Infof("%v: ignoring commit with %d changes\n", c, c.Additions+c.Deletions)
-		return
+		return true, nil
 	}
+	return
+}
 
+func (c *Commit) updateBlame(ctx context.Context) (err error) {
 	log.Debugf("%v fixCommit", c)
+	c.stage = StageBlame
 	err = c.fixCommit()
 
-	log.Debugf("%v blameCommit", c)
-	if err = c.blameCommit(); err != nil {
+	log.Debugf("%v declaredBlames", c)
+	if err = c.declaredBlames(); err != nil {
 		return
 	}
 
-	log.Debugf("%v DB.Update", c)
+	log.Debugf("%v blameCommit", c)
+	err = c.blameCommit(ctx)
+	MatchDeclaredBlames(c.DeclaredBlames, c.BlameCandidates)
+	return
+}
+
+func (c *Commit) persist() (err error) {
+	log.Debugf("%v DataStore.UpdateCommitColumns", c)
+	c.stage = StagePersist
 	// Only update columns that are different from db version
 	cols := StandardColumns
 	if c.MessageLengthFromDB == 0 {
@@ -104,16 +140,32 @@ func (c *Commit) Update() (err error) {
 		cols = append(cols, PatchColumns...)
 		log.Debugf("adding patch")
 	}
-	if err = PersistColumns(c, cols...); err != nil {
+	if err = DataStore.UpdateCommitColumns(c, cols...); err != nil {
+		return
+	}
+	if err = DataStore.SaveFunctions(c); err != nil {
 		return
 	}
-	err = PersistFunctions(c)
-	err = PersistToolResults(c)
+	if err = DataStore.SaveParsedFiles(c); err != nil {
+		return
+	}
+	if err = DataStore.SaveBlameCandidates(c); err != nil {
+		return
+	}
+	if err = DataStore.SaveDeclaredBlames(c); err != nil {
+		return
+	}
+	err = DataStore.SaveToolResults(c)
 
 	log.Debugf("%v Done", c)
 	return
 }
 
+// IsLarge reports whether the commit has too many changes to be analyzed
+func (c *Commit) IsLarge() bool {
+	return c.Additions+c.Deletions > MaxCommitChanges
+}
+
 func (c *Commit) Clear() {
 	c.gitCommit = nil
 	c.githubCommit = nil
@@ -125,6 +177,12 @@ func (c *Commit) Clear() {
 	c.BlamedCommitId.Valid = false
 	c.Type = "other_commit"
 	c.CVE = ""
+	c.Failures = nil
+	c.ParsedFiles = nil
+	c.BlameCandidates = nil
+	c.DeclaredBlames = nil
+	c.DisclosureFiltered = false
+	c.stage = ""
 }
 
 func (c *Commit) fixCommit() (err error) {
@@ -154,41 +212,66 @@ func (c *Commit) fixCommit() (err error) {
 	return
 }
 
-func (c *Commit) blameCommit() (err error) {
+func (c *Commit) blameCommit(ctx context.Context) (err error) {
 	// only blame for fixing commits
 	if c.Type != "fixing_commit" {
 		return
 	}
 
-	blamedSha, err := c.getBlameCommitSha()
+	blamed, err := c.blamedCommits(ctx)
 	if err != nil {
-		return
+		// the commits named by Fixes: trailers are enough
+		if len(c.declaredShas()) == 0 {
+			return
+		}
+		log.Infof("%v: blaming the commits of its Fixes: trailers: %v", c, err)
+		err = nil
+	}
+	for i, cand := range blamed {
+		id, err := c.markBlamed(ctx, cand.Sha)
+		if err != nil {
+			return err
+		}
+		if i == 0 {
+			c.BlamedCommitId = id
+		}
+	}
+	for _, sha := range c.declaredShas() {
+		id, err := c.markBlamed(ctx, sha)
+		if err != nil {
+			return err
+		}
+		if !c.BlamedCommitId.Valid {
+			c.BlamedCommitId = id
+		}
 	}
+	return
+}
+
+// markBlamed marks a commit as blamed and returns its id. Commits missing in
+// the database are added and updated first.
+func (c *Commit) markBlamed(ctx context.Context, blamedSha string) (id sql.NullInt64, err error) {
 	for {
-		row := DB.Db.QueryRow(
-			"UPDATE unstable.commits SET type = 'blamed_commit' WHERE sha = $1 RETURNING id",
-			blamedSha,
-		)
-		if err = row.Scan(&c.BlamedCommitId); err != nil {
+		if id, err = DataStore.MarkBlamedCommit(blamedSha); err != nil {
 			log.Warnf("%v: Updating blamed commit %s: %v", c, blamedSha, err)
 
 			oid, err := git.NewOid(blamedSha)
 			if err != nil {
-				return err
+				return id, err
 			}
 			blamed, err := c.Repository.gitRepository.LookupCommit(oid)
 			if err != nil {
-				return err
+				return id, err
 			}
 			_, blamedCommit, err := c.Repository.addCommit(blamed, nil)
 			if err != nil {
-				return err
+				return id, err
 			}
 			blamedCommit.gitCommit = blamed
 			blamedCommit.Repository = c.Repository
-			err = blamedCommit.Update()
+			err = blamedCommit.Update(ctx)
 			if err != nil {
-				return err
+				return id, err
 			}
 			// then retry
 		} else {
@@ -199,8 +282,28 @@ func (c *Commit) blameCommit() (err error) {
 	return
 }
 
-func (c *Commit) getBlameCommitSha() (blamedCommit string, err error) {
-	blamedCommits := ds.NewMaxMap()
+// published returns the day the CVE of the commit was published, if
+// -filter-disclosed is set and the CVE feed has it
+func (c *Commit) published() (time.Time, bool) {
+	if !filterDisclosed || KnownCVEs == nil {
+		return time.Time{}, false
+	}
+	return KnownCVEs.Published(c.CVE)
+}
+
+// getBlameCommitSha returns the first blamed commit chosen by -blame-policy
+func (c *Commit) getBlameCommitSha(ctx context.Context) (blamedCommit string, err error) {
+	blamed, err := c.blamedCommits(ctx)
+	if err != nil {
+		return
+	}
+	return blamed[0].Sha, nil
+}
+
+// blamedCommits blames the lines changed by the commit, records all blamed
+// commits in BlameCandidates and returns those chosen by -blame-policy
+func (c *Commit) blamedCommits(ctx context.Context) (blamed []*BlameCandidate, err error) {
+	candidates := newBlameCandidates()
 	repo, err := c.Repository.GitRepository()
 	if err != nil {
 		return
@@ -217,7 +320,7 @@ func (c *Commit) getBlameCommitSha() (blamedCommit string, err error) {
 
 		log.Debugf("%v: %s is code -> %v", c, delta.OldFile.Path, IsCodeFile(delta.OldFile.Path))
 		if delta.Status != git.DeltaAdded && IsCodeFile(delta.OldFile.Path) {
-			blame, err = NewBlame(repo, parent.Id().String(), delta.OldFile.Path, BlameBackward)
+			blame, err = NewBlame(ctx, repo, parent.Id().String(), delta.OldFile.Path, BlameBackward)
 		}
 
 		additionBlock := false
@@ -247,7 +350,7 @@ func (c *Commit) getBlameCommitSha() (blamedCommit string, err error) {
 						return nil
 					}
 					log.Debugf("%v: blame line %d -> %s", c, lineToBlame, bl.Sha)
-					blamedCommits.Add(bl.Sha)
+					candidates.Add(delta.OldFile.Path, bl, blame.Strategy())
 				}
 
 				return nil
@@ -255,16 +358,49 @@ func (c *Commit) getBlameCommitSha() (blamedCommit string, err error) {
 		}, err
 	}, git.DiffDetailLines)
 
-	blamedCommit, _ = blamedCommits.MaxString()
-	if blamedCommit == "" {
-		err = fmt.Errorf("no blamed commit found (%+v)", blamedCommits)
+	if err != nil {
+		return
+	}
+	c.BlameCandidates = candidates.Candidates()
+	if published, ok := c.published(); ok {
+		blamed, c.DisclosureFiltered, err = SelectBlamedBefore(c.BlameCandidates, blamePolicy, published)
+		if err == nil && len(blamed) == 0 && len(c.BlameCandidates) > 0 {
+			err = fmt.Errorf("all %d blamed commits are newer than the publication of %s on %s",
+				len(c.BlameCandidates), c.CVE, published.Format("2006-01-02"))
+		}
 	} else {
-		log.Infof("%s: blame %s", c.String(), blamedCommit)
+		blamed, err = SelectBlamed(c.BlameCandidates, blamePolicy)
 	}
-
+	if err != nil {
+		return
+	}
+	if len(blamed) == 0 {
+		return nil, fmt.Errorf("no blamed commit found")
+	}
+	if c.DisclosureFiltered {
+		log.Infof("%v: blamed commits after the publication of %s discarded", c, c.CVE)
+	}
+	log.Infof("%s: blame %s of %d candidates", c.String(), blamed[0].Sha, len(c.BlameCandidates))
 	return
 }
 
+// modifiedFunction marks a function of the new file that is neither added
+// nor deleted as modified when the first of its lines changes
+func (c *Commit) modifiedFunction(f *Function, oldFunctions *Functions) *Function {
+	if f.State != "" {
+		return f
+	}
+	f.State = "modified"
+	f.CommitId = c.Id
+	if old, ok := oldFunctions.Data()[f.Identity()]; ok {
+		m := old.Metrics
+		f.Previous = &m
+	}
+	c.Functions = append(c.Functions, f)
+	log.Debugf("%v: modified function %v", c, f)
+	return f
+}
+
 func (c *Commit) String() string {
 	if c.Url.Valid {
 		return c.Url.String
@@ -328,7 +464,8 @@ func (c *Commit) GitCommit() (commit *git.Commit, err error) {
 	return
 }
 
-func (c *Commit) GetGitMetadata() (err error) {
+func (c *Commit) GetGitMetadata(ctx context.Context) (err error) {
+	defer observe("GetGitMetadata", time.Now(), &err)
 	diff, _, err := c.diff()
 	if err != nil {
 		return fmt.Errorf("creating diff: %v", err)
@@ -407,11 +544,12 @@ func (c *Commit) GetGitMetadata() (err error) {
 			log.Debugf("%v: Skip Delta %+v with status %d\n", c, delta, int(delta.Status))
 			return emptyEachHunkCB, nil
 		}
-		cs, err := FileChanges(repo, gitCommit, path)
+		cs, err := FileChanges(ctx, repo, gitCommit, path)
 		if err != nil {
-			log.Warnf("%v FileChanges(): %v\n", c, err)
+			c.failf(StageMetadata, "FileChanges(%s): %v", path, err)
+		} else {
+			totalChanges.Add(cs)
 		}
-		totalChanges.Add(cs)
 
 		isCodeFile = IsCodeFile(path)
 		if !isCodeFile {
@@ -424,30 +562,31 @@ func (c *Commit) GetGitMetadata() (err error) {
 		if isCodeFile {
 			switch delta.Status {
 			case git.DeltaAdded:
-				functions, err := FunctionsForFile(repo, &delta.NewFile)
+				functions, err := c.functionsForFile(ctx, repo, &delta.NewFile)
 				if err != nil {
 					log.Warnf("%v FunctionsForFile(%v) (new): %v", c, &delta.NewFile, err)
 				} else {
 					for _, f := range functions.Functions() {
 						f.CommitId = c.Id
 						f.State = "added"
+						f.LinesAdded = int(f.EndLine-f.StartLine) + 1
 						c.Functions = append(c.Functions, f)
 					}
 				}
-				flawfinderResults, err := tools.Flawfinder.Analyze(repo, &delta.NewFile)
+				flawfinderResults, err := toolAnalyze(ctx, tools.Flawfinder, repo, &delta.NewFile)
 				if err != nil {
 					log.Warnf("%v FlawfinderResults(%v) (new): %v", c, &delta.NewFile, err)
 				} else {
 					c.ToolResults = append(c.ToolResults, flawfinderResults...)
 				}
-				ratsResults, err := tools.Rats.Analyze(repo, &delta.NewFile)
+				ratsResults, err := toolAnalyze(ctx, tools.Rats, repo, &delta.NewFile)
 				if err != nil {
 					log.Warnf("%v RatsResults(%v) (new): %v", c, &delta.NewFile, err)
 				} else {
 					c.ToolResults = append(c.ToolResults, ratsResults...)
 				}
 			case git.DeltaDeleted:
-				functions, err := FunctionsForFile(repo, &delta.OldFile)
+				functions, err := c.functionsForFile(ctx, repo, &delta.OldFile)
 				if err != nil {
 					log.Warnf("%v FunctionsForFile(%s) (old): %v", c, &delta.OldFile, err)
 					break
@@ -455,30 +594,31 @@ func (c *Commit) GetGitMetadata() (err error) {
 				for _, f := range functions.Functions() {
 					f.CommitId = c.Id
 					f.State = "deleted"
+					f.LinesDeleted = int(f.EndLine-f.StartLine) + 1
 					c.Functions = append(c.Functions, f)
 				}
 			case git.DeltaModified:
-				flawfinderResults, err := tools.Flawfinder.Analyze(repo, &delta.NewFile)
+				flawfinderResults, err := toolAnalyze(ctx, tools.Flawfinder, repo, &delta.NewFile)
 				if err != nil {
-					log.Warnf("%v FlawfinderResults(%v) (new): %v", c, &delta.NewFile, err)
+					log.Warnf("%v FlawfinderResults(%v) (mod new): %v", c, &delta.NewFile, err)
 				} else {
 					analyzeToolResultsInLineLoop = true
 				}
-				ratsResults, err := tools.Flawfinder.Analyze(repo, &delta.NewFile)
+				ratsResults, err := toolAnalyze(ctx, tools.Rats, repo, &delta.NewFile)
 				if err != nil {
-					log.Warnf("%v RatsResults(%v) (new): %v", c, &delta.NewFile, err)
+					log.Warnf("%v RatsResults(%v) (mod new): %v", c, &delta.NewFile, err)
 				} else {
 					analyzeToolResultsInLineLoop = true
 				}
 				toolResults = tools.Merge(flawfinderResults, ratsResults)
 
 				// need to handle this on hunk level
-				newFunctions, err = FunctionsForFile(repo, &delta.NewFile)
+				newFunctions, err = c.functionsForFile(ctx, repo, &delta.NewFile)
 				if err != nil {
 					log.Warnf("%v FunctionsForFile(%s) (mod new): %v", c, &delta.NewFile, err)
 					break
 				}
-				oldFunctions, err = FunctionsForFile(repo, &delta.OldFile)
+				oldFunctions, err = c.functionsForFile(ctx, repo, &delta.OldFile)
 				//log.Infof("old file %s %s", delta.OldFile.Path, delta.OldFile.Oid.String())
 				if err != nil {
 					log.Warnf("%v FunctionsForFile(%s) (mod old): %v", c, &delta.OldFile, err)
@@ -495,26 +635,23 @@ func (c *Commit) GetGitMetadata() (err error) {
 		return func(hunk git.DiffHunk) (git.DiffForEachLineCallback, error) {
 			c.HunkCount++
 
-			funIter := newFunctions.NewEmptyFunctionIterator()
 			// each line
 			return func(line git.DiffLine) error {
-				//log.Infof("\n%+v", line)
-				//log.Infof("analyze: %v", analyzeFunctionsInLineLoop)
+				// added lines belong to functions of the new file,
+				// deleted lines to functions of the old file
 				if isCodeFile && analyzeFunctionsInLineLoop {
-					var lineno int = -1
-					if line.Origin == git.DiffLineAddition {
-						lineno = line.NewLineno
-					}
-					if line.Origin == git.DiffLineDeletion {
-						lineno = line.OldLineno
-					}
-					if lineno != -1 {
-						//log.Infof("line %d", lineno)
-						f, analyzeFunctionsInLineLoop := funIter(lineno)
-						if analyzeFunctionsInLineLoop && f.ContainsLine(lineno) {
-							f.State = "modified"
-							c.Functions = append(c.Functions, f)
-							log.Infof("function %+v", f)
+					switch line.Origin {
+					case git.DiffLineAddition:
+						if f, ok := newFunctions.FunctionAt(line.NewLineno); ok {
+							c.modifiedFunction(f, oldFunctions).LinesAdded++
+						}
+					case git.DiffLineDeletion:
+						if old, ok := oldFunctions.FunctionAt(line.OldLineno); ok {
+							f := old // deleted in this commit
+							if cur, ok := newFunctions.Data()[old.Identity()]; ok {
+								f = cur
+							}
+							c.modifiedFunction(f, oldFunctions).LinesDeleted++
 						}
 					}
 				}
@@ -545,6 +682,10 @@ func (c *Commit) GetGitMetadata() (err error) {
 		c.Patch = fixInvalidUtf8(c.Patch)
 	}
 
+	if err := c.FunctionChanges(ctx, repo, gitCommit); err != nil {
+		c.failf(StageFunctions, "FunctionChanges: %v", err)
+	}
+
 	c.FutureChanges = totalChanges.FutureChanges
 	c.PastChanges = totalChanges.PastChanges
 	c.FutureDifferentAuthors = totalChanges.FutureAuthors
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"testing"
@@ -48,14 +49,14 @@ func TestGetGitMetadata(t *testing.T) {
 
 	for _, data := range testData {
 		r := &Repository{Name: data.repo}
-		if err := r.clone(); err != nil {
+		if err := r.clone(context.Background()); err != nil {
 			t.Errorf("cloning %s: %v", data.repo, err)
 		}
 		c := &Commit{
 			Repository: r,
 			Sha:        data.sha,
 		}
-		if err := c.GetGitMetadata(); err != nil {
+		if err := c.GetGitMetadata(context.Background()); err != nil {
 			t.Fatalf("GetGitMetadata(): %v", err)
 		}
 		if c.Additions != data.additions {
@@ -100,14 +101,14 @@ func TestFixCommit(t *testing.T) {
 
 	for _, data := range testData {
 		r := &Repository{Name: data.repo}
-		if err := r.clone(); err != nil {
+		if err := r.clone(context.Background()); err != nil {
 			t.Errorf("cloning %s: %v", data.repo, err)
 		}
 		c := &Commit{
 			Repository: r,
 			Sha:        data.sha,
 		}
-		if err := c.GetGitMetadata(); err != nil {
+		if err := c.GetGitMetadata(context.Background()); err != nil {
 			t.Error("GetGitMetadata(): %v", err)
 		}
 		if err := c.fixCommit(); err != nil {
@@ -133,14 +134,14 @@ func TestBlameCommit(t *testing.T) {
 
 	for _, data := range testData {
 		r := &Repository{Name: data.repo}
-		if err := r.clone(); err != nil {
+		if err := r.clone(context.Background()); err != nil {
 			t.Errorf("cloning %s: %v", data.repo, err)
 		}
 		c := &Commit{
 			Repository: r,
 			Sha:        data.sha,
 		}
-		blamedSha, err := c.getBlameCommitSha()
+		blamedSha, err := c.getBlameCommitSha(context.Background())
 		if err != nil {
 			t.Error("blameCommit(): %v", err)
 		}
@@ -161,7 +162,7 @@ func TestCommitGetFunctions(t *testing.T) {
 	r := &Repository{Name: "testrepo"}
 	for sha, funStates := range testData {
 		c := &Commit{Repository: r, Sha: sha}
-		if err := c.GetGitMetadata(); err != nil {
+		if err := c.GetGitMetadata(context.Background()); err != nil {
 			t.Error(err)
 		}
 		if len(c.Functions) != len(funStates) {
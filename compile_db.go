@@ -0,0 +1,253 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// libclang guesses macros, include paths and the language standard unless it
+// gets the compiler flags. They come from the compilation database
+// (-compile-db, relative to the repository) of a repository, if it has one,
+// and from -clang-flags, which are added to every parse. Relative include
+// paths in -clang-flags are relative to the repository, unless the file is in
+// the compilation database.
+var (
+	compileDBName = "compile_commands.json"
+	clangFlags    string
+	compileDBMu   sync.Mutex
+)
+
+// CompileDB maps the files of a repository to their compiler arguments
+type CompileDB struct {
+	files map[string][]string // by path relative to the repository
+	dirs  map[string][]string // arguments of some file in a directory, for headers
+}
+
+type compileCommand struct {
+	Directory string   `json:"directory"`
+	File      string   `json:"file"`
+	Command   string   `json:"command"`
+	Arguments []string `json:"arguments"`
+}
+
+// LoadCompileDB reads a compile_commands.json. Entries are matched to the
+// repository in root by the longest path suffix, since the database is often
+// generated on another machine. Their directories are moved into root the
+// same way, so that relative include paths still work.
+func LoadCompileDB(root, path string) (*CompileDB, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var commands []compileCommand
+	if err := json.NewDecoder(f).Decode(&commands); err != nil {
+		return nil, err
+	}
+
+	db := &CompileDB{files: make(map[string][]string), dirs: make(map[string][]string)}
+	for _, cmd := range commands {
+		file := cmd.File
+		if !filepath.IsAbs(file) {
+			file = filepath.Join(cmd.Directory, file)
+		}
+		rel, ok := repoPath(root, file)
+		if !ok {
+			continue
+		}
+		args := cmd.Arguments
+		if len(args) == 0 {
+			args = splitCommand(cmd.Command)
+		}
+		dir := root
+		if cmd.Directory != "" {
+			dir = remapDir(root, cmd.Directory, file, rel)
+		}
+		args = compilerArgs(args, root, dir)
+		if cmd.Directory != "" {
+			args = append([]string{"-working-directory=" + dir}, args...)
+		}
+		db.files[rel] = args
+		if _, ok := db.dirs[filepath.Dir(rel)]; !ok {
+			db.dirs[filepath.Dir(rel)] = args
+		}
+	}
+	return db, nil
+}
+
+// Args returns the compiler arguments of a file, or those of another file in
+// its directory for headers and files missing in the database
+func (db *CompileDB) Args(path string) []string {
+	if db == nil {
+		return nil
+	}
+	if args, ok := db.files[path]; ok {
+		return args
+	}
+	return db.dirs[filepath.Dir(path)]
+}
+
+// repoPath returns the path of file relative to root. If file is not inside
+// root, the longest suffix of file that exists in root is used.
+func repoPath(root, file string) (string, bool) {
+	file = filepath.Clean(file)
+	if rel, err := filepath.Rel(root, file); err == nil && !strings.HasPrefix(rel, "..") {
+		return rel, true
+	}
+	parts := strings.Split(file, string(filepath.Separator))
+	for i := 1; i < len(parts); i++ {
+		rel := filepath.Join(parts[i:]...)
+		if _, err := os.Stat(filepath.Join(root, rel)); err == nil {
+			return rel, true
+		}
+	}
+	return "", false
+}
+
+// remapDir returns the directory of a compile command in root, if it is
+// inside the checkout the database was generated in. file is the source file
+// of the command as written in the database and rel its path in root.
+func remapDir(root, dir, file, rel string) string {
+	checkout := strings.TrimSuffix(filepath.Clean(file), rel)
+	if r, err := filepath.Rel(checkout, dir); err == nil && !strings.HasPrefix(r, "..") {
+		return filepath.Join(root, r)
+	}
+	return dir
+}
+
+// compilerArgs keeps the options of a compile command that libclang needs to
+// find headers and macros: -I, -isystem, -D, -U, -std and -x. Everything else,
+// including the compiler and any wrapper like ccache, plugins and forced
+// includes, is dropped, as are include paths outside root. Relative include
+// paths are relative to dir.
+func compilerArgs(args []string, root, dir string) (res []string) {
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if separateArgOptions[arg] {
+			i++
+			continue
+		}
+		for _, opt := range []string{"-isystem", "-I", "-D", "-U", "-x"} {
+			if !strings.HasPrefix(arg, opt) {
+				continue
+			}
+			value, joined := arg[len(opt):], arg != opt
+			if !joined {
+				if i+1 == len(args) {
+					break
+				}
+				i++
+				value = args[i]
+			}
+			if (opt == "-I" || opt == "-isystem") && !inRoot(value, root, dir) {
+				break
+			}
+			if joined {
+				res = append(res, arg)
+			} else {
+				res = append(res, opt, value)
+			}
+			break
+		}
+		if strings.HasPrefix(arg, "-std=") {
+			res = append(res, arg)
+		}
+	}
+	return
+}
+
+// separateArgOptions take the next argument as their value, it is skipped
+// along with them
+var separateArgOptions = map[string]bool{
+	"-o": true, "-MF": true, "-MT": true, "-MQ": true,
+	"-include": true, "-imacros": true, "-iquote": true, "-idirafter": true,
+	"-isysroot": true, "--sysroot": true, "-target": true, "-arch": true,
+	"-Xclang": true, "-Xpreprocessor": true, "-Xassembler": true, "-Xlinker": true,
+}
+
+// inRoot reports whether path, relative to dir, is inside root
+func inRoot(path, root, dir string) bool {
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(dir, path)
+	}
+	rel, err := filepath.Rel(root, filepath.Clean(path))
+	return err == nil && !strings.HasPrefix(rel, "..")
+}
+
+// splitCommand splits a shell command line into words, handling quotes and
+// backslashes
+func splitCommand(cmd string) (words []string) {
+	var (
+		word    strings.Builder
+		inWord  bool
+		quote   rune
+		escaped bool
+	)
+	for _, r := range cmd {
+		switch {
+		case escaped:
+			word.WriteRune(r)
+			escaped = false
+		case r == '\\' && quote != '\'':
+			escaped, inWord = true, true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				word.WriteRune(r)
+			}
+		case r == '"' || r == '\'':
+			quote, inWord = r, true
+		case r == ' ' || r == '\t' || r == '\n':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(r)
+			inWord = true
+		}
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return
+}
+
+// ClangArgs returns the arguments for parsing a file of the repository. The
+// compilation database is loaded on first use.
+func (r *Repository) ClangArgs(path string) []string {
+	var args []string
+	repo, err := r.GitRepository()
+	if err != nil {
+		return strings.Fields(clangFlags)
+	}
+	root := filepath.Clean(repo.Workdir())
+
+	compileDBMu.Lock()
+	if !r.compileDBLoaded && compileDBName != "" {
+		db, err := LoadCompileDB(root, filepath.Join(root, compileDBName))
+		switch {
+		case err == nil:
+			r.compileDB = db
+		case !os.IsNotExist(err):
+			log.Warnf("%v: reading %s: %v", r, compileDBName, err)
+		}
+		r.compileDBLoaded = true
+	}
+	db := r.compileDB
+	compileDBMu.Unlock()
+
+	if fileArgs := db.Args(path); fileArgs != nil {
+		args = append(args, fileArgs...)
+	} else if clangFlags != "" {
+		args = append(args, "-working-directory="+root)
+	}
+	return append(args, strings.Fields(clangFlags)...)
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestSplitCommand(t *testing.T) {
+	for cmd, expected := range map[string][]string{
+		`cc -c foo.c`:                    {"cc", "-c", "foo.c"},
+		`cc  -DNAME="a b"	-I'x y' foo.c`: {"cc", "-DNAME=a b", "-Ix y", "foo.c"},
+		`cc -DQ=\"q\" -I/a\ b 'it''s'`:   {"cc", `-DQ="q"`, "-I/a b", "its"},
+		`cc -D'S=\x' ""`:                 {"cc", `-DS=\x`, ""},
+		``:                               nil,
+	} {
+		if words := splitCommand(cmd); !reflect.DeepEqual(words, expected) {
+			t.Errorf("%s: expected %q, got %q", cmd, expected, words)
+		}
+	}
+}
+
+func TestCompilerArgs(t *testing.T) {
+	args := compilerArgs([]string{"gcc", "-Iinc", "-c", "-o", "foo.o", "-MD", "-MF", "foo.d", "-ofoo.o", "-DX", "-std=c99", "foo.c"}, "/build", "/build")
+	if expected := []string{"-Iinc", "-DX", "-std=c99"}; !reflect.DeepEqual(args, expected) {
+		t.Errorf("expected %q, got %q", expected, args)
+	}
+	// the source is written differently than the file of the entry
+	for _, source := range []string{"../src/foo.c", "/build/src/foo.c", "./foo.c"} {
+		args = compilerArgs([]string{"cc", "-I", "../include", "-c", source}, "/build", "/build/src")
+		if expected := []string{"-I", "../include"}; !reflect.DeepEqual(args, expected) {
+			t.Errorf("%s: expected %q, got %q", source, expected, args)
+		}
+	}
+	// wrappers, plugins, forced includes and headers outside the repository
+	args = compilerArgs([]string{"ccache", "gcc", "-Xclang", "-load", "-Xclang", "/tmp/x.so", "-fplugin=/tmp/p.so",
+		"-include", "/etc/passwd", "-I/usr/include", "-I", "../..", "-isystem", "third_party", "-U", "NDEBUG", "-x", "c++", "-c", "foo.c"},
+		"/build", "/build/src")
+	if expected := []string{"-isystem", "third_party", "-U", "NDEBUG", "-x", "c++"}; !reflect.DeepEqual(args, expected) {
+		t.Errorf("expected %q, got %q", expected, args)
+	}
+}
+
+func TestLoadCompileDB(t *testing.T) {
+	root, err := ioutil.TempDir("", "compile-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	if err := os.MkdirAll(filepath.Join(root, "src", "lib"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []string{"src/main.c", "src/lib/util.c", "src/lib/other.c"} {
+		if err := ioutil.WriteFile(filepath.Join(root, f), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db := `[
+		{"directory": "` + root + `/src", "file": "main.c", "command": "cc -I../include -c main.c -o main.o"},
+		{"directory": "/build/elsewhere", "file": "/build/elsewhere/src/lib/util.c", "arguments": ["cc", "-DUTIL", "-c", "/build/elsewhere/src/lib/util.c"]},
+		{"directory": "/build/elsewhere/src/lib", "file": "/build/elsewhere/src/lib/other.c", "arguments": ["cc", "-I../../include", "-c", "other.c"]},
+		{"directory": "/build/elsewhere", "file": "/build/elsewhere/missing.c", "arguments": ["cc", "-c", "missing.c"]}
+	]`
+	path := filepath.Join(root, "compile_commands.json")
+	if err := ioutil.WriteFile(path, []byte(db), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cdb, err := LoadCompileDB(root, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for file, expected := range map[string][]string{
+		"src/main.c":      {"-working-directory=" + root + "/src", "-I../include"},
+		"src/main.h":      {"-working-directory=" + root + "/src", "-I../include"},
+		"src/lib/util.c":  {"-working-directory=" + root, "-DUTIL"},
+		"src/lib/other.c": {"-working-directory=" + root + "/src/lib", "-I../../include"},
+		"src/lib/util.h":  {"-working-directory=" + root, "-DUTIL"},
+		"missing.c":       nil,
+		"other/x.c":       nil,
+	} {
+		if args := cdb.Args(file); !reflect.DeepEqual(args, expected) {
+			t.Errorf("%s: expected %q, got %q", file, expected, args)
+		}
+	}
+	if args := (*CompileDB)(nil).Args("src/main.c"); args != nil {
+		t.Errorf("expected no arguments without a database, got %q", args)
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	log "github.com/Sirupsen/logrus"
+)
+
+// Every flag can also be set in the TOML config file (using the flag name as
+// key) or in the environment (GITHUB_DATA_ followed by the flag name in upper
+// case with dashes replaced by underscores). Flags given on the command line
+// win over the environment, which wins over the config file.
+const ConfigEnvPrefix = "GITHUB_DATA_"
+
+var (
+	configPath       string
+	logLevels        = []string{"debug", "info", "warn", "error"}
+	passwordInDSN    = regexp.MustCompile(`:[^:@/]*@`)
+	secretConfigKeys = map[string]bool{"postgres": true}
+)
+
+// LoadConfig applies the config file and the environment to all flags that
+// were not set on the command line and validates the result
+func LoadConfig(path string) error {
+	if err := loadConfig(flag.CommandLine, path, os.LookupEnv); err != nil {
+		return err
+	}
+	return ValidateConfig()
+}
+
+func loadConfig(fs *flag.FlagSet, path string, lookupEnv func(string) (string, bool)) error {
+	setOnCmdline := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { setOnCmdline[f.Name] = true })
+
+	if path != "" {
+		var values map[string]interface{}
+		if _, err := toml.DecodeFile(path, &values); err != nil {
+			return fmt.Errorf("reading config %s: %v", path, err)
+		}
+		for key, val := range values {
+			if fs.Lookup(key) == nil {
+				return fmt.Errorf("config %s: unknown setting %s", path, key)
+			}
+			switch val.(type) {
+			case string, bool, int64, float64:
+			default:
+				return fmt.Errorf("config %s: %s must be a string, number or boolean", path, key)
+			}
+			if setOnCmdline[key] {
+				continue
+			}
+			if err := fs.Set(key, fmt.Sprint(val)); err != nil {
+				return fmt.Errorf("config %s: %s: %v", path, key, err)
+			}
+		}
+	}
+
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if err != nil || setOnCmdline[f.Name] {
+			return
+		}
+		env := ConfigEnvName(f.Name)
+		if val, ok := lookupEnv(env); ok {
+			if e := fs.Set(f.Name, val); e != nil {
+				err = fmt.Errorf("%s: %v", env, e)
+			}
+		}
+	})
+	return err
+}
+
+// ConfigEnvName returns the environment variable overriding a flag
+func ConfigEnvName(flagName string) string {
+	return ConfigEnvPrefix + strings.ToUpper(strings.Replace(flagName, "-", "_", -1))
+}
+
+// ValidateConfig checks the settings for consistency. Missing tools only
+// produce warnings, since they are not needed by every mode.
+func ValidateConfig() error {
+	if commitProcs < 1 {
+		return fmt.Errorf("commit-threads must be at least 1, is %d", commitProcs)
+	}
+	for name, procs := range map[string]int{"metadata-threads": metadataProcs, "blame-threads": blameProcs, "persist-threads": persistProcs} {
+		if procs < 0 {
+			return fmt.Errorf("%s must not be negative, is %d", name, procs)
+		}
+	}
+	if parserProcs < 0 {
+		return fmt.Errorf("parser-procs must not be negative, is %d", parserProcs)
+	}
+	if repoProcs < 1 {
+		return fmt.Errorf("repo-threads must be at least 1, is %d", repoProcs)
+	}
+	if !contains(logLevels, logLevel) {
+		return fmt.Errorf("log-level %s is not in %v", logLevel, logLevels)
+	}
+	if !contains(commitSelections, commitsSelect) {
+		return fmt.Errorf("commits-select %s is not in %v", commitsSelect, commitSelections)
+	}
+	if !contains(storeBackends, storeBackend) {
+		return fmt.Errorf("store %s is not in %v", storeBackend, storeBackends)
+	}
+	if storeBackend == "sqlite" && sqlitePath == "" {
+		return fmt.Errorf("sqlite store needs a database file")
+	}
+	if !contains(blamePolicies, blamePolicy) {
+		return fmt.Errorf("blame-policy %s is not in %v", blamePolicy, blamePolicies)
+	}
+	if failedStage != "" && !contains(failureStages, failedStage) {
+		return fmt.Errorf("failed-stage %s is not in %v", failedStage, failureStages)
+	}
+	if MaxAttempts < 1 {
+		return fmt.Errorf("max-attempts must be at least 1, is %d", MaxAttempts)
+	}
+	if queueCommand != "" && !contains(queueCommands, queueCommand) {
+		return fmt.Errorf("queue %s is not in %v", queueCommand, queueCommands)
+	}
+	if coordinatorURL != "" && coordinatorListen != "" {
+		return fmt.Errorf("coordinator and coordinator-listen exclude each other")
+	}
+	if redisAddress == "" && !skipRedis && analyzePath == "" && coordinatorURL == "" {
+		return fmt.Errorf("redis address is empty, set -redis or use -skip-redis")
+	}
+
+	for _, bin := range []string{pythonPath, ratsPath} {
+		if _, err := exec.LookPath(bin); err != nil {
+			log.Warnf("%s not found, tool results will be missing: %v", bin, err)
+		}
+	}
+	if _, err := os.Stat(RamdiskPath); err != nil {
+		log.Warnf("ramdisk %s not found, repositories will not be copied: %v", RamdiskPath, err)
+	}
+	if readsCveFile() {
+		if _, err := ReadCveFile(cveFile); err != nil {
+			return fmt.Errorf("cve-file %s: %v", cveFile, err)
+		}
+	}
+	return nil
+}
+
+// readsCveFile reports whether the selected mode loads the known CVEs, that is
+// whether it analyzes a repository or updates commits (see main)
+func readsCveFile() bool {
+	if analyzePath != "" {
+		return true
+	}
+	return !doSelfTest && !doStableDbCheck && !doUnstableDbCheck && !reportProgress &&
+		queueCommand == "" && !initRedis && coordinatorListen == "" &&
+		addRepository == "" && exportFunctions == ""
+}
+
+// PrintConfig writes the effective settings, hiding passwords
+func PrintConfig(w io.Writer) {
+	flag.VisitAll(func(f *flag.Flag) {
+		val := f.Value.String()
+		if secretConfigKeys[f.Name] {
+			val = passwordInDSN.ReplaceAllString(val, ":***@")
+		}
+		fmt.Fprintf(w, "%-20s = %q\n", f.Name, val)
+	})
+}
+
+func contains(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestLoadConfig(t *testing.T) {
+	var (
+		threads   int
+		redisAddr string
+		name      string
+		skip      bool
+	)
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.IntVar(&threads, "commit-threads", 50, "")
+	fs.StringVar(&redisAddr, "redis", "localhost:6379", "")
+	fs.StringVar(&name, "name", "unnamed", "")
+	fs.BoolVar(&skip, "skip-redis", false, "")
+	handleErr(t, fs.Parse([]string{"-name=cmdline"}))
+
+	f, err := ioutil.TempFile("", "github-data-config")
+	handleErr(t, err)
+	defer os.Remove(f.Name())
+	_, err = f.WriteString(`
+commit-threads = 10
+redis = "file:6379"
+name = "file"
+skip-redis = true
+`)
+	handleErr(t, err)
+	f.Close()
+
+	env := map[string]string{"GITHUB_DATA_REDIS": "env:6379"}
+	lookupEnv := func(key string) (string, bool) {
+		val, ok := env[key]
+		return val, ok
+	}
+	handleErr(t, loadConfig(fs, f.Name(), lookupEnv))
+
+	if threads != 10 {
+		t.Errorf("commit-threads should come from the file, is %d", threads)
+	}
+	if redisAddr != "env:6379" {
+		t.Errorf("redis should come from the environment, is %s", redisAddr)
+	}
+	if name != "cmdline" {
+		t.Errorf("name should come from the command line, is %s", name)
+	}
+	if !skip {
+		t.Error("skip-redis should be set by the file")
+	}
+}
+
+func TestLoadConfigUnknownKey(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	f, err := ioutil.TempFile("", "github-data-config")
+	handleErr(t, err)
+	defer os.Remove(f.Name())
+	f.WriteString(`no-such-flag = 1`)
+	f.Close()
+
+	if err := loadConfig(fs, f.Name(), os.LookupEnv); err == nil {
+		t.Error("expected an error for an unknown setting")
+	}
+}
+
+func TestConfigEnvName(t *testing.T) {
+	if env := ConfigEnvName("commit-threads"); env != "GITHUB_DATA_COMMIT_THREADS" {
+		t.Errorf("unexpected env name %s", env)
+	}
+}
+
+func TestReadsCveFile(t *testing.T) {
+	defer func(q, c, a string) { queueCommand, coordinatorListen, analyzePath = q, c, a }(queueCommand, coordinatorListen, analyzePath)
+	queueCommand, coordinatorListen, analyzePath = "", "", ""
+	if !readsCveFile() {
+		t.Error("workers update commits and need the CVE file")
+	}
+	queueCommand = "list"
+	if readsCveFile() {
+		t.Error("queue commands do not need the CVE file")
+	}
+	queueCommand, coordinatorListen = "", ":8080"
+	if readsCveFile() {
+		t.Error("the coordinator does not need the CVE file")
+	}
+	analyzePath = "."
+	if !readsCveFile() {
+		t.Error("analyze needs the CVE file")
+	}
+}
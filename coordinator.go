@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// A coordinator (-coordinator-listen) is the only process talking to redis,
+// workers started with -coordinator get their jobs from it over HTTP:
+//
+//	POST /register   {worker}                  -> {lease_ttl_seconds}
+//	POST /next       {worker}                  -> {job}, 204 if there is none
+//	POST /heartbeat  {worker, job}             -> 409 if the lease is lost
+//	POST /done       {worker, job}
+//	POST /fail       {worker, job, error}      -> {dead}
+//	POST /release    {worker, job}
+//	POST /chunk      {worker, job}             -> {ids}
+//	POST /split      {worker, repository, ids} -> {chunks}
+//	GET  /workers                              -> worker -> last seen
+var (
+	coordinatorListen string
+	coordinatorURL    string
+)
+
+type jobRequest struct {
+	Worker     string  `json:"worker,omitempty"`
+	Job        string  `json:"job,omitempty"`
+	Error      string  `json:"error,omitempty"`
+	Repository string  `json:"repository,omitempty"`
+	Ids        []int64 `json:"ids,omitempty"`
+}
+
+type jobResponse struct {
+	Job             string  `json:"job,omitempty"`
+	Dead            bool    `json:"dead,omitempty"`
+	Ids             []int64 `json:"ids,omitempty"`
+	Chunks          int     `json:"chunks,omitempty"`
+	LeaseTTLSeconds float64 `json:"lease_ttl_seconds,omitempty"`
+	Error           string  `json:"error,omitempty"`
+}
+
+// Coordinator serves the jobs of a Queue over HTTP
+type Coordinator struct {
+	queue    Queue
+	leaseTTL time.Duration
+
+	sync.Mutex
+	workers map[string]time.Time
+}
+
+func NewCoordinator(q Queue) *Coordinator {
+	return &Coordinator{queue: q, leaseTTL: LeaseTTL, workers: make(map[string]time.Time)}
+}
+
+func (c *Coordinator) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/register", c.handle(func(req *jobRequest) (*jobResponse, error) {
+		log.Infof("Worker %s registered", req.Worker)
+		return &jobResponse{LeaseTTLSeconds: c.leaseTTL.Seconds()}, nil
+	}))
+	mux.Handle("/next", c.handle(func(req *jobRequest) (*jobResponse, error) {
+		job, err := c.queue.Next(req.Worker)
+		return &jobResponse{Job: job}, err
+	}))
+	mux.Handle("/heartbeat", c.handle(func(req *jobRequest) (*jobResponse, error) {
+		return nil, c.queue.Renew(req.Job, req.Worker)
+	}))
+	mux.Handle("/done", c.handle(func(req *jobRequest) (*jobResponse, error) {
+		return nil, c.queue.Done(req.Job, req.Worker)
+	}))
+	mux.Handle("/fail", c.handle(func(req *jobRequest) (*jobResponse, error) {
+		dead, err := c.queue.Fail(req.Job, req.Worker, errors.New(req.Error))
+		if dead {
+			log.Errorf("Gave up on %s after %d attempts, last error: %s", req.Job, MaxAttempts, req.Error)
+		}
+		return &jobResponse{Dead: dead}, err
+	}))
+	mux.Handle("/release", c.handle(func(req *jobRequest) (*jobResponse, error) {
+		return nil, c.queue.Release(req.Job, req.Worker)
+	}))
+	mux.Handle("/chunk", c.handle(func(req *jobRequest) (*jobResponse, error) {
+		ids, err := c.queue.ChunkCommits(req.Job, req.Worker)
+		return &jobResponse{Ids: ids}, err
+	}))
+	mux.Handle("/split", c.handle(func(req *jobRequest) (*jobResponse, error) {
+		n, err := c.queue.Split(req.Repository, req.Worker, req.Ids)
+		return &jobResponse{Chunks: n}, err
+	}))
+	mux.HandleFunc("/workers", func(w http.ResponseWriter, r *http.Request) {
+		c.Lock()
+		defer c.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(c.workers)
+	})
+	mux.Handle("/metrics", promhttp.Handler())
+	return mux
+}
+
+// handle decodes a jobRequest, calls fn and encodes its response. ErrNil
+// becomes 204 No Content and ErrLeaseLost 409 Conflict, e.g. when a worker
+// whose lease was reaped renews, finishes, fails or splits a job.
+func (c *Coordinator) handle(fn func(req *jobRequest) (*jobResponse, error)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "POST only", http.StatusMethodNotAllowed)
+			return
+		}
+		var req jobRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.Worker != "" {
+			c.Lock()
+			c.workers[req.Worker] = time.Now()
+			c.Unlock()
+		}
+
+		res, err := fn(&req)
+		status := http.StatusOK
+		switch err {
+		case nil:
+		case ErrNil:
+			w.WriteHeader(http.StatusNoContent)
+			return
+		case ErrLeaseLost:
+			status = http.StatusConflict
+		default:
+			log.Errorf("%s %+v: %v", r.URL.Path, req, err)
+			status = http.StatusInternalServerError
+		}
+		if res == nil {
+			res = new(jobResponse)
+		}
+		if err != nil {
+			res.Error = err.Error()
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(res)
+	})
+}
+
+// reap requeues the jobs of dead workers until stop is closed
+func (c *Coordinator) reap(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		requeued, dead, err := c.queue.Reap()
+		if err != nil {
+			log.Errorf("Reaping expired leases: %v", err)
+			continue
+		}
+		if len(requeued) > 0 {
+			log.Warnf("Returned %v to the queue, their workers stopped sending heartbeats", requeued)
+		}
+		if len(dead) > 0 {
+			log.Errorf("Gave up on %v after %d attempts", dead, MaxAttempts)
+		}
+	}
+}
+
+// RunCoordinator serves the redis queue on addr until the process shuts down
+func RunCoordinator(addr string) error {
+	c := NewCoordinator(redisQueue{})
+	srv := &http.Server{Addr: addr, Handler: c.Handler()}
+	go c.reap(c.leaseTTL/2, shutdown)
+	go func() {
+		<-shutdown
+		srv.Close()
+	}()
+	log.Warnf("Coordinating on %s", addr)
+	if err := srv.ListenAndServe(); err != nil && !ShuttingDown() {
+		return err
+	}
+	return nil
+}
+
+// httpQueue is the Queue of a worker started with -coordinator
+type httpQueue struct {
+	url    string
+	client *http.Client
+}
+
+// NewHTTPQueue registers the worker with the coordinator at url and takes
+// over its lease TTL
+func NewHTTPQueue(url, worker string) (*httpQueue, error) {
+	q := &httpQueue{url: strings.TrimSuffix(url, "/"), client: &http.Client{Timeout: time.Minute}}
+	res, err := q.call("/register", &jobRequest{Worker: worker})
+	if err != nil {
+		return nil, fmt.Errorf("registering with %s: %v", url, err)
+	}
+	if res.LeaseTTLSeconds > 0 {
+		LeaseTTL = time.Duration(res.LeaseTTLSeconds * float64(time.Second))
+	}
+	return q, nil
+}
+
+func (q *httpQueue) call(path string, req *jobRequest) (*jobResponse, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := q.client.Post(q.url+path, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusNoContent:
+		return nil, ErrNil
+	case http.StatusConflict:
+		return nil, ErrLeaseLost
+	}
+	var res jobResponse
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return nil, fmt.Errorf("%s: %s: %v", path, resp.Status, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s: %s", path, resp.Status, res.Error)
+	}
+	return &res, nil
+}
+
+func (q *httpQueue) Next(worker string) (string, error) {
+	res, err := q.call("/next", &jobRequest{Worker: worker})
+	if err != nil {
+		return "", err
+	}
+	return res.Job, nil
+}
+
+func (q *httpQueue) Renew(job, worker string) error {
+	_, err := q.call("/heartbeat", &jobRequest{Worker: worker, Job: job})
+	return err
+}
+
+func (q *httpQueue) Done(job, worker string) error {
+	_, err := q.call("/done", &jobRequest{Worker: worker, Job: job})
+	return err
+}
+
+func (q *httpQueue) Fail(job, worker string, cause error) (bool, error) {
+	res, err := q.call("/fail", &jobRequest{Worker: worker, Job: job, Error: cause.Error()})
+	if err != nil {
+		return false, err
+	}
+	return res.Dead, nil
+}
+
+func (q *httpQueue) Release(job, worker string) error {
+	_, err := q.call("/release", &jobRequest{Worker: worker, Job: job})
+	return err
+}
+
+// Reap does nothing, the coordinator reaps on its own
+func (q *httpQueue) Reap() ([]string, []string, error) {
+	return nil, nil, nil
+}
+
+func (q *httpQueue) ChunkCommits(job, worker string) ([]int64, error) {
+	res, err := q.call("/chunk", &jobRequest{Worker: worker, Job: job})
+	if err != nil {
+		return nil, err
+	}
+	return res.Ids, nil
+}
+
+func (q *httpQueue) Split(reponame, worker string, ids []int64) (int, error) {
+	res, err := q.call("/split", &jobRequest{Worker: worker, Repository: reponame, Ids: ids})
+	if err != nil {
+		return 0, err
+	}
+	return res.Chunks, nil
+}
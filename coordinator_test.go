@@ -0,0 +1,85 @@
+package main
+
+import (
+	"errors"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCoordinator(t *testing.T) {
+	defer newTestRedis(t)()
+	conn := pool.Get()
+	defer conn.Close()
+	_, err := conn.Do("RPUSH", RedisInitKey, "foo/bar", "foo/baz")
+	handleErr(t, err)
+
+	oldTTL := LeaseTTL
+	defer func() { LeaseTTL = oldTTL }()
+	LeaseTTL = 42 * time.Second
+	srv := httptest.NewServer(NewCoordinator(redisQueue{}).Handler())
+	defer srv.Close()
+
+	LeaseTTL = 0
+	w1, err := NewHTTPQueue(srv.URL, "worker1")
+	handleErr(t, err)
+	w2, err := NewHTTPQueue(srv.URL, "worker2")
+	handleErr(t, err)
+	if LeaseTTL != 42*time.Second {
+		t.Errorf("workers should use the lease TTL of the coordinator, got %v", LeaseTTL)
+	}
+
+	job1, err := w1.Next("worker1")
+	handleErr(t, err)
+	job2, err := w2.Next("worker2")
+	handleErr(t, err)
+	if _, err := w2.Next("worker2"); err != ErrNil {
+		t.Errorf("expected an empty queue, got %v", err)
+	}
+	handleErr(t, w1.Renew(job1, "worker1"))
+	if err := w2.Renew(job1, "worker2"); err != ErrLeaseLost {
+		t.Errorf("worker2 should not own %s, got %v", job1, err)
+	}
+
+	// a worker can only finish or fail its own jobs
+	if err := w2.Done(job1, "worker2"); err != ErrLeaseLost {
+		t.Errorf("worker2 should not finish %s, got %v", job1, err)
+	}
+	if _, err := w2.Fail(job1, "worker2", errors.New("not mine")); err != ErrLeaseLost {
+		t.Errorf("worker2 should not fail %s, got %v", job1, err)
+	}
+	handleErr(t, w1.Done(job1, "worker1"))
+	dead, err := w2.Fail(job2, "worker2", errors.New("clone failed"))
+	handleErr(t, err)
+	if dead {
+		t.Errorf("%s should be retried", job2)
+	}
+	e, err := InspectRepo(job2)
+	handleErr(t, err)
+	if e.Queue != "init" || e.LastError != "clone failed" {
+		t.Errorf("unexpected entry %+v", e)
+	}
+
+	chunkSize = 2
+	defer func() { chunkSize = 0 }()
+	MarkAsWorking("foo/qux", "worker1")
+	if _, err := w2.Split("foo/qux", "worker2", []int64{1, 2, 3}); err != ErrLeaseLost {
+		t.Errorf("worker2 should not split foo/qux, got %v", err)
+	}
+	n, err := w1.Split("foo/qux", "worker1", []int64{1, 2, 3})
+	handleErr(t, err)
+	if n != 2 {
+		t.Errorf("expected 2 chunks, got %d", n)
+	}
+	chunk, err := w2.Next("worker2")
+	handleErr(t, err)
+	if _, err := w1.ChunkCommits(chunk, "worker1"); err != ErrLeaseLost {
+		t.Errorf("worker1 should not read %s, got %v", chunk, err)
+	}
+	ids, err := w2.ChunkCommits(chunk, "worker2")
+	handleErr(t, err)
+	if !reflect.DeepEqual(ids, []int64{3}) {
+		t.Errorf("unexpected chunk %v", ids)
+	}
+}
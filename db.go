@@ -15,9 +15,11 @@ import (
 )
 
 var (
-	DB         *gorp.DbMap
-	ErrBadConn = driver.ErrBadConn
-	dbname     = "github"
+	DB                 *gorp.DbMap
+	ErrBadConn         = driver.ErrBadConn
+	postgresConnection = os.Getenv("POSTGRES_CONNECTION")
+	dbname             = "github"
+	dbSchema           = "unstable"
 )
 
 type DbObj interface {
@@ -30,15 +32,19 @@ func InitDb() (err error) {
 		return err
 	}
 	DB = &gorp.DbMap{Db: conn, Dialect: gorp.PostgresDialect{}}
-	DB.AddTableWithNameAndSchema(Commit{}, "unstable", "commits").SetKeys(true, "id")
+	DB.AddTableWithNameAndSchema(Commit{}, dbSchema, "commits").SetKeys(true, "id")
 	DB.AddTableWithName(Repository{}, "repositories").SetKeys(true, "id")
+	DB.AddTableWithNameAndSchema(CommitFailure{}, dbSchema, "commit_failures").SetKeys(true, "id")
+	DB.AddTableWithNameAndSchema(ParsedFile{}, dbSchema, "parsed_files").SetKeys(true, "id")
+	DB.AddTableWithNameAndSchema(BlameCandidate{}, dbSchema, "blame_candidates").SetKeys(true, "id")
+	DB.AddTableWithNameAndSchema(DeclaredBlame{}, dbSchema, "declared_blames").SetKeys(true, "id")
 	return nil
 }
 
 func newDBConnection() (conn *sql.DB, err error) {
 	conn, err = sql.Open(
 		"postgres",
-		"postgres://"+os.Getenv("POSTGRES_CONNECTION")+"/"+dbname,
+		"postgres://"+postgresConnection+"/"+dbname,
 	)
 	if err != nil {
 		return nil, err
@@ -67,11 +73,6 @@ func sqlColumns(t reflect.Type) (cols []string) {
 	return
 }
 
-func PersistColumn(obj DbObj, col string, val interface{}) error {
-	q := PersistColumnSql(obj, col, val)
-	_, err := DB.Db.Exec(q, val)
-	return err
-}
 func PersistColumnSql(obj DbObj, col string, val interface{}) string {
 	tableName, err := tableName(obj)
 	if err != nil {
@@ -80,28 +81,21 @@ func PersistColumnSql(obj DbObj, col string, val interface{}) string {
 	return fmt.Sprintf("UPDATE %s SET %s = $1 WHERE id = %d", tableName, col, obj.GetId())
 }
 
-func PersistColumns(obj DbObj, cols ...string) (err error) {
-	q, vals, err := PersistColumnsSql(obj, cols...)
+func PersistColumnsSql(obj DbObj, cols ...string) (q string, vals []interface{}, err error) {
+	tableName, err := tableName(obj)
 	if err != nil {
 		return
 	}
-	_, err = DB.Db.Exec(q, vals...)
-
-	return
+	return persistColumnsSql(tableName, gorp.PostgresDialect{}, obj, cols...)
 }
 
-func PersistColumnsSql(obj DbObj, cols ...string) (q string, vals []interface{}, err error) {
+func persistColumnsSql(tableName string, dialect gorp.Dialect, obj DbObj, cols ...string) (q string, vals []interface{}, err error) {
 	var (
 		qs []string
 		t  = reflect.TypeOf(obj).Elem()
 		v  = reflect.ValueOf(obj).Elem()
 	)
 
-	tableName, err := tableName(obj)
-	if err != nil {
-		return
-	}
-
 	q = fmt.Sprintf("UPDATE %s SET ", tableName)
 
 	for qField, col := range cols {
@@ -114,7 +108,7 @@ func PersistColumnsSql(obj DbObj, cols ...string) (q string, vals []interface{},
 		if sqlField == "-" || sqlField == "" {
 			return "", nil, fmt.Errorf("field %s does not have db tag", col)
 		}
-		qs = append(qs, fmt.Sprintf("%s = $%d", sqlField, qField+1))
+		qs = append(qs, fmt.Sprintf("%s = %s", sqlField, dialect.BindVar(qField)))
 
 		// build values
 		vals = append(vals, v.FieldByName(col).Interface())
@@ -127,19 +121,111 @@ func PersistColumnsSql(obj DbObj, cols ...string) (q string, vals []interface{},
 	return
 }
 
-func PersistToolResults(c *Commit) (err error) {
-	txn, err := DB.Db.Begin()
+// postgresStore is the Store used in production, it uses COPY for bulk inserts
+type postgresStore struct {
+	*sqlStore
+}
+
+func NewPostgresStore() *postgresStore {
+	return &postgresStore{&sqlStore{
+		dbmap:        DB,
+		repositories: "repositories",
+		commits:      dbSchema + ".commits",
+		functions:    dbSchema + ".functions",
+		toolResults:  dbSchema + ".tool_results",
+		failures:     dbSchema + ".commit_failures",
+		parsedFiles:  dbSchema + ".parsed_files",
+		candidates:   dbSchema + ".blame_candidates",
+		declared:     dbSchema + ".declared_blames",
+	}}
+}
+
+// postgresSchema adds what gorp does not create, the tables written with COPY
+// and the columns added to tables of older databases. %[1]s is dbSchema.
+var postgresSchema = []string{
+	`CREATE TABLE IF NOT EXISTS %[1]s.functions (
+		id         SERIAL PRIMARY KEY,
+		commit_id  INTEGER NOT NULL REFERENCES %[1]s.commits(id),
+		name       TEXT,
+		file_name  TEXT,
+		start_line INTEGER,
+		end_line   INTEGER,
+		state      TEXT
+	)`,
+	`CREATE INDEX IF NOT EXISTS functions_commit_id ON %[1]s.functions (commit_id)`,
+	`CREATE TABLE IF NOT EXISTS %[1]s.tool_results (
+		id        SERIAL PRIMARY KEY,
+		commit_id INTEGER NOT NULL REFERENCES %[1]s.commits(id),
+		file_name TEXT,
+		line      INTEGER,
+		reason    TEXT,
+		found_by  TEXT
+	)`,
+	`ALTER TABLE %[1]s.functions
+		ADD COLUMN IF NOT EXISTS qualified_name TEXT,
+		ADD COLUMN IF NOT EXISTS signature      TEXT`,
+	`ALTER TABLE %[1]s.parsed_files
+		ADD COLUMN IF NOT EXISTS diagnostics INTEGER DEFAULT 0,
+		ADD COLUMN IF NOT EXISTS errors      INTEGER DEFAULT 0`,
+	`ALTER TABLE %[1]s.functions
+		ADD COLUMN IF NOT EXISTS complexity         INTEGER,
+		ADD COLUMN IF NOT EXISTS max_nesting        INTEGER,
+		ADD COLUMN IF NOT EXISTS params             INTEGER,
+		ADD COLUMN IF NOT EXISTS statements         INTEGER,
+		ADD COLUMN IF NOT EXISTS derefs             INTEGER,
+		ADD COLUMN IF NOT EXISTS memory_calls       INTEGER,
+		ADD COLUMN IF NOT EXISTS delta_complexity   INTEGER DEFAULT 0,
+		ADD COLUMN IF NOT EXISTS delta_max_nesting  INTEGER DEFAULT 0,
+		ADD COLUMN IF NOT EXISTS delta_params       INTEGER DEFAULT 0,
+		ADD COLUMN IF NOT EXISTS delta_statements   INTEGER DEFAULT 0,
+		ADD COLUMN IF NOT EXISTS delta_derefs       INTEGER DEFAULT 0,
+		ADD COLUMN IF NOT EXISTS delta_memory_calls INTEGER DEFAULT 0`,
+	`ALTER TABLE %[1]s.functions
+		ADD COLUMN IF NOT EXISTS lines_added   INTEGER DEFAULT 0,
+		ADD COLUMN IF NOT EXISTS lines_deleted INTEGER DEFAULT 0`,
+	`ALTER TABLE %[1]s.functions
+		ADD COLUMN IF NOT EXISTS past_changes             INTEGER DEFAULT 0,
+		ADD COLUMN IF NOT EXISTS future_changes           INTEGER DEFAULT 0,
+		ADD COLUMN IF NOT EXISTS past_different_authors   INTEGER DEFAULT 0,
+		ADD COLUMN IF NOT EXISTS future_different_authors INTEGER DEFAULT 0`,
+	`CREATE INDEX IF NOT EXISTS blame_candidates_commit_id ON %[1]s.blame_candidates (commit_id)`,
+	`ALTER TABLE %[1]s.blame_candidates ADD COLUMN IF NOT EXISTS strategy TEXT`,
+	`ALTER TABLE %[1]s.commits ADD COLUMN IF NOT EXISTS disclosure_filtered BOOLEAN NOT NULL DEFAULT false`,
+	`ALTER TABLE %[1]s.blame_candidates ADD COLUMN IF NOT EXISTS after_disclosure BOOLEAN NOT NULL DEFAULT false`,
+	`CREATE INDEX IF NOT EXISTS declared_blames_commit_id ON %[1]s.declared_blames (commit_id)`,
+}
+
+func (s *postgresStore) CreateTables() error {
+	if err := s.dbmap.CreateTablesIfNotExists(); err != nil {
+		return err
+	}
+	for _, q := range postgresSchema {
+		if _, err := s.dbmap.Exec(fmt.Sprintf(q, dbSchema)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *postgresStore) Reopen() (err error) {
+	err = ReopenDB()
+	s.dbmap = DB
+	return
+}
+
+func (s *postgresStore) SaveToolResults(c *Commit) (err error) {
+	txn, err := s.dbmap.Db.Begin()
 	if err != nil {
 		return
 	}
 	// clear old results
-	_, err = txn.Exec("DELETE FROM unstable.tool_results WHERE commit_id = $1", c.Id)
+	_, err = txn.Exec("DELETE FROM "+s.toolResults+" WHERE commit_id = $1", c.Id)
 	if err != nil {
 		return fmt.Errorf("%v: deleting old tool results falied: %v", c, err)
 	}
 
 	// prepare insert
-	stmt, err := txn.Prepare(pq.CopyInSchema("unstable", "tool_results", "commit_id", "file_name", "line", "reason", "found_by"))
+	stmt, err := txn.Prepare(pq.CopyInSchema(dbSchema, "tool_results", "commit_id", "file_name", "line", "reason", "found_by"))
 	if err != nil {
 		return
 	}
@@ -169,31 +255,42 @@ func PersistToolResults(c *Commit) (err error) {
 	return
 }
 
-func PersistFunctions(c *Commit) (err error) {
-	txn, err := DB.Db.Begin()
+func (s *postgresStore) SaveFunctions(c *Commit) (err error) {
+	txn, err := s.dbmap.Db.Begin()
 	if err != nil {
 		return
 	}
 	// clear old functions
-	_, err = txn.Exec("DELETE FROM unstable.functions WHERE commit_id = $1", c.Id)
+	_, err = txn.Exec("DELETE FROM "+s.functions+" WHERE commit_id = $1", c.Id)
 	if err != nil {
 		return fmt.Errorf("%v: deleting old functions falied: %v", c, err)
 	}
 
 	// prepare insert
-	stmt, err := txn.Prepare(pq.CopyInSchema("unstable", "functions", "commit_id", "name", "file_name", "start_line", "end_line", "state"))
+	stmt, err := txn.Prepare(pq.CopyInSchema(dbSchema, "functions", "commit_id", "name", "qualified_name", "signature", "file_name", "start_line", "end_line", "state", "lines_added", "lines_deleted",
+		"past_changes", "future_changes", "past_different_authors", "future_different_authors",
+		"complexity", "max_nesting", "params", "statements", "derefs", "memory_calls",
+		"delta_complexity", "delta_max_nesting", "delta_params", "delta_statements", "delta_derefs", "delta_memory_calls"))
 	if err != nil {
 		return
 	}
 
 	for _, f := range c.Functions {
+		m, d := f.Metrics, f.Delta()
 		_, err = stmt.Exec(
 			c.Id,
 			f.Name,
+			f.QualifiedName,
+			f.Signature,
 			f.FileName,
 			f.StartLine,
 			f.EndLine,
 			f.State,
+			f.LinesAdded,
+			f.LinesDeleted,
+			f.PastChanges, f.FutureChanges, f.PastDifferentAuthors, f.FutureDifferentAuthors,
+			m.Complexity, m.MaxNesting, m.Params, m.Statements, m.Derefs, m.MemoryCalls,
+			d.Complexity, d.MaxNesting, d.Params, d.Statements, d.Derefs, d.MemoryCalls,
 		)
 		if err != nil {
 			log.Errorf("Error saving %v: %v", f, err)
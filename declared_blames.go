@@ -0,0 +1,85 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// FixesPattern matches trailers like the kernel's
+//
+//	Fixes: 54a4f0239f2e ("KVM: MMU: make kvm_mmu_zap_page() return the number of pages it actually freed")
+var FixesPattern = regexp.MustCompile(`(?mi)^[ \t]*Fixes:[ \t]*(?:commit[ \t]+)?([[:xdigit:]]{7,40})\b[ \t]*(?:\(["“](.*)["”]\))?`)
+
+// DeclaredBlame is a commit that a Fixes: trailer of a commit message names
+// as the one that introduced the bug. Sha is empty if the trailer could not be
+// resolved in the repository.
+type DeclaredBlame struct {
+	Id          int64  `json:"-" db:"id"`
+	CommitId    int64  `json:"-" db:"commit_id"`
+	DeclaredSha string `json:"declared_sha" db:"declared_sha"` // as written
+	Sha         string `json:"sha" db:"sha"`
+	Subject     string `json:"subject" db:"subject"`
+	Heuristic   bool   `json:"heuristic" db:"heuristic"` // also a blame candidate
+}
+
+// ParseFixes returns the Fixes: trailers of a commit message, each declared
+// sha once
+func ParseFixes(message string) (declared []*DeclaredBlame) {
+	seen := make(map[string]bool)
+	for _, m := range FixesPattern.FindAllStringSubmatch(message, -1) {
+		sha := strings.ToLower(m[1])
+		if seen[sha] {
+			continue
+		}
+		seen[sha] = true
+		declared = append(declared, &DeclaredBlame{DeclaredSha: sha, Subject: m[2]})
+	}
+	return
+}
+
+// declaredBlames sets the DeclaredBlames of the commit from the Fixes:
+// trailers of its message, resolving abbreviated shas
+func (c *Commit) declaredBlames() error {
+	c.DeclaredBlames = ParseFixes(c.Message)
+	if len(c.DeclaredBlames) == 0 {
+		return nil
+	}
+	repo, err := c.Repository.GitRepository()
+	if err != nil {
+		return err
+	}
+	for _, d := range c.DeclaredBlames {
+		obj, err := repo.RevparseSingle(d.DeclaredSha + "^{commit}")
+		if err != nil {
+			// ambiguous, or from a tree that was never merged
+			log.Infof("%v: resolving Fixes: %s: %v", c, d.DeclaredSha, err)
+			continue
+		}
+		d.Sha = obj.Id().String()
+		obj.Free()
+	}
+	return nil
+}
+
+// declaredShas returns the resolved shas of the Fixes: trailers
+func (c *Commit) declaredShas() (shas []string) {
+	for _, d := range c.DeclaredBlames {
+		if d.Sha != "" {
+			shas = append(shas, d.Sha)
+		}
+	}
+	return
+}
+
+// MatchDeclaredBlames marks the declared blames that are also blame candidates
+func MatchDeclaredBlames(declared []*DeclaredBlame, cands []*BlameCandidate) {
+	for _, d := range declared {
+		for _, cand := range cands {
+			if d.Sha != "" && d.Sha == cand.Sha {
+				d.Heuristic = true
+			}
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import "testing"
+
+func TestParseFixes(t *testing.T) {
+	msg := `net: fix use after free in foo_rcv()
+
+Reported-by: Someone <someone@example.com>
+Fixes: 54A4F0239F2E ("KVM: MMU: make kvm_mmu_zap_page() return the number of pages")
+  fixes: commit 1234567 ("second (nested) subject")
+Fixes: 54a4f0239f2e ("the same one again")
+Fixes: deadbeefcafe
+The bug fixes: 89abcdef0 is not a trailer
+Fixes: xyz1234567
+Signed-off-by: Someone <someone@example.com>
+`
+	declared := ParseFixes(msg)
+	expected := []DeclaredBlame{
+		{DeclaredSha: "54a4f0239f2e", Subject: "KVM: MMU: make kvm_mmu_zap_page() return the number of pages"},
+		{DeclaredSha: "1234567", Subject: "second (nested) subject"},
+		{DeclaredSha: "deadbeefcafe"},
+	}
+	if len(declared) != len(expected) {
+		t.Fatalf("expected %d trailers, got %d", len(expected), len(declared))
+	}
+	for i, d := range declared {
+		if *d != expected[i] {
+			t.Errorf("expected %+v, got %+v", expected[i], *d)
+		}
+	}
+	if declared := ParseFixes("fix CVE-2014-0160"); declared != nil {
+		t.Errorf("expected no trailers, got %v", declared)
+	}
+
+	MatchDeclaredBlames(declared, []*BlameCandidate{{Sha: "1234567890123456789012345678901234567890"}})
+	declared[1].Sha = "1234567890123456789012345678901234567890"
+	MatchDeclaredBlames(declared, []*BlameCandidate{{Sha: "1234567890123456789012345678901234567890"}})
+	if declared[0].Heuristic || !declared[1].Heuristic || declared[2].Heuristic {
+		t.Errorf("expected only the second trailer to match a blame candidate, got %+v %+v %+v", declared[0], declared[1], declared[2])
+	}
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/libgit2/git2go"
+)
+
+// exportFunctions is the JSONL file -export-functions writes to ("-" for
+// stdout)
+var exportFunctions string
+
+// FixedFunction is a function changed by a fixing commit, with the commit it
+// was blamed on
+type FixedFunction struct {
+	Function
+	Sha       string
+	CVE       string
+	BlamedSha string
+}
+
+// ExportedFunction is the record written for each function of a fixing
+// commit. Before is nil for added functions, After for deleted ones and
+// Blamed if the blamed commit has no function with the same Identity in the
+// file.
+type ExportedFunction struct {
+	Repository    string           `json:"repository"`
+	FixingSha     string           `json:"fixing_sha"`
+	BlamedSha     string           `json:"blamed_sha"`
+	CVE           string           `json:"cve,omitempty"`
+	FileName      string           `json:"file_name"`
+	Name          string           `json:"name"`
+	QualifiedName string           `json:"qualified_name"`
+	Signature     string           `json:"signature"`
+	State         string           `json:"state"`
+	Before        *FunctionVersion `json:"before"` // in the parent of the fixing commit
+	After         *FunctionVersion `json:"after"`
+	Blamed        *FunctionVersion `json:"blamed"`
+}
+
+// FunctionVersion is the source of a function at a commit
+type FunctionVersion struct {
+	Sha       string `json:"sha"`
+	StartLine uint   `json:"start_line"`
+	EndLine   uint   `json:"end_line"`
+	Body      string `json:"body"`
+}
+
+// ExportFunctions writes the functions of the fixing commits of the
+// repositories to out, one JSON object per line
+func ExportFunctions(ctx context.Context, names []string, out io.Writer) error {
+	enc := json.NewEncoder(out)
+	for _, name := range names {
+		r, err := DataStore.Repository(name)
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		fs, err := DataStore.FixedFunctions(r)
+		if err != nil {
+			return fmt.Errorf("%v: %v", r, err)
+		}
+		log.Infof("%v: exporting %d functions", r, len(fs))
+
+		var (
+			e    *functionExporter
+			skip string // fixing commit missing in the repository
+		)
+		for i := range fs {
+			f := &fs[i]
+			if f.Sha == skip {
+				continue
+			}
+			if e == nil || e.sha != f.Sha {
+				if e, err = newFunctionExporter(r, f.Sha); err != nil {
+					log.Warnf("%v: skipping the functions of %s: %v", r, f.Sha, err)
+					skip = f.Sha
+					continue
+				}
+			}
+			res, err := e.export(ctx, f)
+			if err != nil {
+				log.Warnf("%v: exporting %v of %s: %v", r, &f.Function, f.Sha, err)
+				continue
+			}
+			if err := enc.Encode(res); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// functionExporter looks up the versions of the functions of one fixing
+// commit. Files are read and parsed once per commit.
+type functionExporter struct {
+	r      *Repository
+	repo   *git.Repository
+	sha    string
+	parent string
+	files  map[string]*exportedFile // by sha and path
+}
+
+type exportedFile struct {
+	oid       *git.Oid
+	contents  []byte
+	functions *Functions // parsed on first use
+}
+
+func newFunctionExporter(r *Repository, sha string) (*functionExporter, error) {
+	repo, err := r.GitRepository()
+	if err != nil {
+		return nil, err
+	}
+	oid, err := git.NewOid(sha)
+	if err != nil {
+		return nil, err
+	}
+	commit, err := repo.LookupCommit(oid)
+	if err != nil {
+		return nil, err
+	}
+	e := &functionExporter{r: r, repo: repo, sha: sha, files: make(map[string]*exportedFile)}
+	if parent := commit.Parent(0); parent != nil {
+		e.parent = parent.Id().String()
+	}
+	return e, nil
+}
+
+func (e *functionExporter) export(ctx context.Context, f *FixedFunction) (res *ExportedFunction, err error) {
+	res = &ExportedFunction{
+		Repository:    e.r.Name,
+		FixingSha:     f.Sha,
+		BlamedSha:     f.BlamedSha,
+		CVE:           f.CVE,
+		FileName:      f.FileName,
+		Name:          f.Name,
+		QualifiedName: f.QualifiedName,
+		Signature:     f.Signature,
+		State:         f.State,
+	}
+	// the stored lines are those of the fixing commit, or of its parent
+	// for deleted functions
+	switch f.State {
+	case "deleted":
+		res.Before, err = e.lines(e.parent, f.FileName, f.StartLine, f.EndLine)
+	case "added":
+		res.After, err = e.lines(f.Sha, f.FileName, f.StartLine, f.EndLine)
+	default:
+		if res.After, err = e.lines(f.Sha, f.FileName, f.StartLine, f.EndLine); err == nil {
+			res.Before, err = e.function(ctx, e.parent, &f.Function)
+		}
+	}
+	if err == nil {
+		res.Blamed, err = e.function(ctx, f.BlamedSha, &f.Function)
+	}
+	return
+}
+
+// lines returns lines start to end of a file version, nil if the file does
+// not exist in the commit
+func (e *functionExporter) lines(sha, path string, start, end uint) (*FunctionVersion, error) {
+	file, err := e.file(sha, path)
+	if file == nil || err != nil {
+		return nil, err
+	}
+	return &FunctionVersion{Sha: sha, StartLine: start, EndLine: end, Body: functionBody(file.contents, start, end)}, nil
+}
+
+// function returns the version of f in a commit, by Identity in the same file
+func (e *functionExporter) function(ctx context.Context, sha string, f *Function) (*FunctionVersion, error) {
+	file, err := e.file(sha, f.FileName)
+	if file == nil || err != nil {
+		return nil, err
+	}
+	if file.functions == nil {
+		fs, err := FunctionsForFile(ctx, e.repo, &git.DiffFile{Path: f.FileName, Oid: file.oid}, e.r.ClangArgs(f.FileName)...)
+		if err != nil {
+			return nil, err
+		}
+		file.functions = fs
+	}
+	cur, ok := file.functions.Data()[f.Identity()]
+	if !ok {
+		return nil, nil
+	}
+	return &FunctionVersion{Sha: sha, StartLine: cur.StartLine, EndLine: cur.EndLine, Body: functionBody(file.contents, cur.StartLine, cur.EndLine)}, nil
+}
+
+func (e *functionExporter) file(sha, path string) (*exportedFile, error) {
+	if sha == "" {
+		return nil, nil
+	}
+	key := sha + ":" + path
+	if file, ok := e.files[key]; ok {
+		return file, nil
+	}
+	oid, err := git.NewOid(sha)
+	if err != nil {
+		return nil, err
+	}
+	commit, err := e.repo.LookupCommit(oid)
+	if err != nil {
+		return nil, err
+	}
+	tree, err := commit.Tree()
+	if err != nil {
+		return nil, err
+	}
+	defer tree.Free()
+	var file *exportedFile
+	if entry, err := tree.EntryByPath(path); err == nil {
+		blob, err := e.repo.LookupBlob(entry.Id)
+		if err != nil {
+			return nil, err
+		}
+		file = &exportedFile{oid: entry.Id, contents: blob.Contents()}
+	}
+	e.files[key] = file
+	return file, nil
+}
+
+// functionBody returns lines start to end (counting from 1) of contents
+func functionBody(contents []byte, start, end uint) string {
+	lines := bytes.SplitAfter(contents, []byte("\n"))
+	if start < 1 {
+		start = 1
+	}
+	if end > uint(len(lines)) {
+		end = uint(len(lines))
+	}
+	if start > end {
+		return ""
+	}
+	return fixInvalidUtf8(string(bytes.Join(lines[start-1:end], nil)))
+}
+
+func runExportFunctions() (err error) {
+	out := os.Stdout
+	if exportFunctions != "-" {
+		f, e := os.Create(exportFunctions)
+		if e != nil {
+			return e
+		}
+		defer func() {
+			if e := f.Close(); err == nil {
+				err = e
+			}
+		}()
+		out = f
+	}
+	names := []string{onlyOneRepo}
+	if onlyOneRepo == "" {
+		if names, err = DataStore.RepositoryNames(); err != nil {
+			return err
+		}
+	}
+	return ExportFunctions(context.Background(), names, out)
+}
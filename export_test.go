@@ -0,0 +1,21 @@
+package main
+
+import "testing"
+
+func TestFunctionBody(t *testing.T) {
+	contents := []byte("int a;\n\nint foo(void)\n{\n\treturn a;\n}\n")
+	for _, test := range []struct {
+		start, end uint
+		expected   string
+	}{
+		{3, 6, "int foo(void)\n{\n\treturn a;\n}\n"},
+		{1, 1, "int a;\n"},
+		{5, 100, "\treturn a;\n}\n"},
+		{0, 1, "int a;\n"},
+		{9, 10, ""},
+	} {
+		if body := functionBody(contents, test.start, test.end); body != test.expected {
+			t.Errorf("lines %d to %d: expected %q, got %q", test.start, test.end, test.expected, body)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Stages of Commit.Update, a failure records the stage it happened in
+const (
+	StageMetadata  = "metadata"
+	StageBlame     = "blame"
+	StageFunctions = "functions"
+	StagePersist   = "persist"
+)
+
+var (
+	failureStages = []string{StageMetadata, StageBlame, StageFunctions, StagePersist}
+	retryFailed   bool
+	failedStage   string
+	failedMatch   string
+)
+
+// CommitFailure is an error or a panic that happened while updating a commit.
+// Stack is only set for panics.
+type CommitFailure struct {
+	Id           int64     `json:"-" db:"id"`
+	CommitId     int64     `json:"-" db:"commit_id"`
+	RepositoryId int64     `json:"-" db:"repository_id"`
+	Sha          string    `json:"-" db:"sha"`
+	Stage        string    `json:"stage" db:"stage"`
+	Message      string    `json:"message" db:"message"`
+	Stack        string    `json:"stack,omitempty" db:"stack"`
+	CreatedAt    time.Time `json:"created_at" db:"created_at"`
+}
+
+// Fail records a failure of the commit in a stage
+func (c *Commit) Fail(stage string, err error, stack []byte) {
+	c.Failures = append(c.Failures, CommitFailure{
+		CommitId:     c.Id,
+		RepositoryId: c.RepositoryId,
+		Sha:          c.Sha,
+		Stage:        stage,
+		Message:      err.Error(),
+		Stack:        string(stack),
+		CreatedAt:    time.Now(),
+	})
+}
+
+// failf logs and records a failure that does not stop the update
+func (c *Commit) failf(stage, format string, args ...interface{}) {
+	err := fmt.Errorf(format, args...)
+	log.Warnf("%v %v", c, err)
+	c.Fail(stage, err, nil)
+}
+
+// failuresWhere returns the sql where clause and its arguments selecting the
+// failures in -failed-stage with an error message LIKE -failed-match
+func failuresWhere() (string, []interface{}) {
+	var (
+		where = " where 1 = 1"
+		args  []interface{}
+	)
+	if failedStage != "" {
+		where += " and stage = ?"
+		args = append(args, failedStage)
+	}
+	if failedMatch != "" {
+		where += " and message like ?"
+		args = append(args, failedMatch)
+	}
+	return where, args
+}
+
+// RetryFailed updates the failed commits again, of the -repo repository or
+// of every repository with failures. Redis is not used.
+func RetryFailed() error {
+	repos := []string{onlyOneRepo}
+	if onlyOneRepo == "" {
+		var err error
+		if repos, err = DataStore.FailedRepositories(); err != nil {
+			return fmt.Errorf("retrieving repositories with failures: %v", err)
+		}
+	}
+	log.Infof("Retrying failed commits of %d repositories", len(repos))
+	for _, reponame := range repos {
+		if ShuttingDown() {
+			return ErrShutdown
+		}
+		if err := handleRepo(reponame); err != nil {
+			log.Error(err)
+		}
+	}
+	return nil
+}
@@ -3,14 +3,17 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"fmt"
 	"log"
-	"os/exec"
 	"strings"
+	"time"
 
 	lru "github.com/hashicorp/golang-lru"
 	"github.com/juju/utils/set"
 	"github.com/libgit2/git2go"
+
+	"tools.net.cs.uni-bonn.de/social-aspects-of-vulnerabilities/github-data/proc"
 )
 
 type ChangeStatistic struct {
@@ -29,6 +32,9 @@ func (cs *ChangeStatistic) Add(other *ChangeStatistic) {
 
 var cache *lru.Cache
 
+// logTimeout is how long git log --follow may take for a file
+var logTimeout = 5 * time.Minute
+
 func init() {
 	cache, _ = lru.New(2000)
 }
@@ -38,7 +44,8 @@ func init() {
 //m map[string]bytes.Buffer
 //}{m: make(map[string]bytes.Buffer)}
 
-func FileChanges(repo *git.Repository, commit *git.Commit, filepath string) (cs *ChangeStatistic, err error) {
+func FileChanges(ctx context.Context, repo *git.Repository, commit *git.Commit, filepath string) (cs *ChangeStatistic, err error) {
+	defer observe("FileChanges", time.Now(), &err)
 	var buf bytes.Buffer
 	PastAuthors := new(set.Strings)
 	FutureAuthors := new(set.Strings)
@@ -50,7 +57,7 @@ func FileChanges(repo *git.Repository, commit *git.Commit, filepath string) (cs
 	if ok {
 		buf = val.(bytes.Buffer)
 	} else {
-		logCmd := exec.Command(
+		logCmd := proc.Command(ctx, logTimeout,
 			"git",
 			"log",
 			"--follow",
@@ -64,6 +71,9 @@ func FileChanges(repo *git.Repository, commit *git.Commit, filepath string) (cs
 		logCmd.Stderr = errBuf
 		logCmd.Dir = repo.Workdir()
 		if err := logCmd.Run(); err != nil {
+			if proc.IsTimeout(err) {
+				return nil, err
+			}
 			log.Print("stderr: ", errBuf)
 			return nil, fmt.Errorf("%v failed: %v", logCmd, err)
 		}
@@ -1,5 +1,6 @@
 package main
 
+import "context"
 import "testing"
 import "github.com/libgit2/git2go"
 
@@ -10,12 +11,12 @@ func TestFileChanges(t *testing.T) {
 	handleErr(t, err)
 	commit, err := repo.LookupCommit(oid)
 	handleErr(t, err)
-	cs1, err := FileChanges(repo, commit, "main.c")
+	cs1, err := FileChanges(context.Background(), repo, commit, "main.c")
 	handleErr(t, err)
 
 	t.Log(cs1)
 
-	cs2, err := FileChanges(repo, commit, "main.c")
+	cs2, err := FileChanges(context.Background(), repo, commit, "main.c")
 	handleErr(t, err)
 
 	t.Log(cs2)
@@ -1,3 +1,5 @@
+#define _POSIX_C_SOURCE 200809L /* strdup */
+
 #include <stdio.h>
 #include <stdlib.h>
 #include <errno.h>
@@ -15,7 +17,10 @@ enum CXChildVisitResult cursorVisitor(CXCursor cursor, CXCursor parent, CXClient
 
 typedef struct CData {
 	functions_array* fa;
+	CXTranslationUnit tu;
 	const char* fname;
+	const char* enclosing; /* qualified name of the enclosing function or variable */
+	int lambdas;           /* lambdas seen in the enclosing function or variable */
 } CData;
 
 functions_array* fa_new(size_t cap)
@@ -23,6 +28,8 @@ functions_array* fa_new(size_t cap)
 	functions_array* fa = malloc(sizeof(functions_array));
 	fa->len = 0;
 	fa->cap = cap;
+	fa->diagnostics = 0;
+	fa->errors = 0;
 	fa->data = malloc(fa->cap * sizeof(void*));
 
 	return fa;
@@ -41,6 +48,9 @@ void fa_add(functions_array* fa, function* f)
 void fa_free(functions_array* fa) {
 	size_t i;
 	for (i = 0; i < fa->len; i++) {
+		free(fa->data[i]->name);
+		free(fa->data[i]->qualified_name);
+		free(fa->data[i]->signature);
 		free(fa->data[i]);
 	}
 	free(fa->data);
@@ -53,7 +63,7 @@ function* fa_at(functions_array* fa, size_t i) {
 
 
 functions_array* get_functions(const char* fname, const char* contents,
-		unsigned long contents_len)
+		unsigned long contents_len, const char* const* args, int nargs)
 {
 	/*printf("DEBUG:\nfname: %s\ncontents: %s\nlen: %lu\n", fname, contents, contents_len);*/
 
@@ -77,7 +87,7 @@ functions_array* get_functions(const char* fname, const char* contents,
 	}
 
 	CXTranslationUnit translationUnit = clang_parseTranslationUnit(index,
-			fname, 0, 0, unsaved, unsaved_cnt,
+			fname, args, nargs, unsaved, unsaved_cnt,
 			CXTranslationUnit_Incomplete | CXTranslationUnit_DetailedPreprocessingRecord);
 
 	if (translationUnit == 0) {
@@ -103,8 +113,22 @@ functions_array* get_functions(const char* fname, const char* contents,
 
 
 	fa = fa_new(10);
+	for (unsigned i = 0; i < clang_getNumDiagnostics(translationUnit); i++) {
+		CXDiagnostic d = clang_getDiagnostic(translationUnit, i);
+		enum CXDiagnosticSeverity severity = clang_getDiagnosticSeverity(d);
+		if (severity >= CXDiagnostic_Warning) {
+			fa->diagnostics++;
+		}
+		if (severity >= CXDiagnostic_Error) {
+			fa->errors++;
+		}
+		clang_disposeDiagnostic(d);
+	}
 	cdata.fa = fa;
+	cdata.tu = translationUnit;
 	cdata.fname = fname;
+	cdata.enclosing = NULL;
+	cdata.lambdas = 0;
 	clang_visitChildren(rootCursor, *cursorVisitor, (CXClientData)&cdata);
 
 	clang_disposeTranslationUnit(translationUnit);
@@ -116,34 +140,348 @@ functions_array* get_functions(const char* fname, const char* contents,
 }
 
 
+static int is_function_kind(enum CXCursorKind kind)
+{
+	switch (kind) {
+	case CXCursor_FunctionDecl:
+	case CXCursor_CXXMethod:
+	case CXCursor_Constructor:
+	case CXCursor_Destructor:
+	case CXCursor_ConversionFunction:
+	case CXCursor_FunctionTemplate:
+	case CXCursor_ObjCInstanceMethodDecl:
+	case CXCursor_ObjCClassMethodDecl:
+	case CXCursor_LambdaExpr:
+		return 1;
+	default:
+		return 0;
+	}
+}
+
+static int is_scope_kind(enum CXCursorKind kind)
+{
+	switch (kind) {
+	case CXCursor_Namespace:
+	case CXCursor_ClassDecl:
+	case CXCursor_StructDecl:
+	case CXCursor_UnionDecl:
+	case CXCursor_ClassTemplate:
+	case CXCursor_ClassTemplatePartialSpecialization:
+		return 1;
+	default:
+		return 0;
+	}
+}
+
+/* append_scope appends the namespaces and classes around cursor to buf, each
+ * followed by :: */
+static void append_scope(CXCursor cursor, char* buf, size_t size)
+{
+	CXCursor parent = clang_getCursorSemanticParent(cursor);
+	if (clang_Cursor_isNull(parent) || !is_scope_kind(clang_getCursorKind(parent))) {
+		return;
+	}
+	append_scope(parent, buf, size);
+
+	CXString spelling = clang_getCursorSpelling(parent);
+	const char* str = clang_getCString(spelling);
+	strncat(buf, *str ? str : "(anonymous)", size - strlen(buf) - 1);
+	strncat(buf, "::", size - strlen(buf) - 1);
+	clang_disposeString(spelling);
+}
+
+static enum CXChildVisitResult find_class_ref(CXCursor cursor, CXCursor parent, CXClientData data)
+{
+	if (clang_getCursorKind(cursor) == CXCursor_ObjCClassRef) {
+		*(CXCursor*)data = cursor;
+		return CXChildVisit_Break;
+	}
+	return CXChildVisit_Continue;
+}
+
+/* objc_class returns the class of an @interface or @implementation, the
+ * extended class for categories */
+static CXCursor objc_class(CXCursor container)
+{
+	enum CXCursorKind kind = clang_getCursorKind(container);
+	if (kind == CXCursor_ObjCCategoryDecl || kind == CXCursor_ObjCCategoryImplDecl) {
+		clang_visitChildren(container, find_class_ref, &container);
+	}
+	return container;
+}
+
+/* new_function fills in the names of a function cursor, the lines are set by
+ * the caller */
+static function* new_function(CXCursor cursor, CData* cdata)
+{
+	enum CXCursorKind kind = clang_getCursorKind(cursor);
+	function* f = malloc(sizeof(function));
+	char buf[4096] = "";
+
+	if (kind == CXCursor_LambdaExpr) {
+		snprintf(buf, sizeof(buf), "(lambda #%d)", ++cdata->lambdas);
+		f->name = strdup(buf);
+		if (cdata->enclosing) {
+			snprintf(buf, sizeof(buf), "%s::%s", cdata->enclosing, f->name);
+		}
+		f->qualified_name = strdup(cdata->enclosing ? buf : f->name);
+		f->signature = strdup("");
+		return f;
+	}
+
+	CXString spelling = clang_getCursorSpelling(cursor);
+	CXString display = clang_getCursorDisplayName(cursor);
+	const char* name = clang_getCString(spelling);
+	const char* disp = clang_getCString(display);
+	f->name = strdup(name);
+
+	if (kind == CXCursor_ObjCInstanceMethodDecl || kind == CXCursor_ObjCClassMethodDecl) {
+		CXString class = clang_getCursorSpelling(objc_class(clang_getCursorSemanticParent(cursor)));
+		snprintf(buf, sizeof(buf), "%c[%s %s]",
+				kind == CXCursor_ObjCClassMethodDecl ? '+' : '-', clang_getCString(class), name);
+		clang_disposeString(class);
+		f->qualified_name = strdup(buf);
+		f->signature = strdup("");
+	} else {
+		append_scope(cursor, buf, sizeof(buf));
+		strncat(buf, name, sizeof(buf) - strlen(buf) - 1);
+		f->qualified_name = strdup(buf);
+
+		/* the display name is the name followed by template and parameter
+		 * types. C has no overloads, a function whose parameters change is
+		 * still the same function. */
+		size_t len = strlen(name);
+		buf[0] = '\0';
+		if (clang_getCursorLanguage(cursor) != CXLanguage_C) {
+			snprintf(buf, sizeof(buf), "%s%s", strncmp(disp, name, len) == 0 ? disp + len : disp,
+					clang_CXXMethod_isConst(cursor) ? " const" : "");
+		}
+		f->signature = strdup(buf);
+	}
+	clang_disposeString(spelling);
+	clang_disposeString(display);
+	return f;
+}
+
+/* functions whose calls are counted in memory_calls */
+static const char* const memory_functions[] = {
+	"malloc", "calloc", "realloc", "reallocarray", "free", "alloca",
+	"memcpy", "memmove", "memset", "memcmp", "memchr",
+	"strcpy", "strncpy", "strcat", "strncat", "strdup", "strndup",
+	"sprintf", "snprintf", "vsprintf", "vsnprintf", "gets",
+	NULL
+};
+
+typedef struct MData {
+	function_metrics* m;
+	CXTranslationUnit tu;
+	CXCursor function;
+	unsigned depth; /* nesting of the current cursor */
+} MData;
+
+static int is_member(const char* s, const char* const* list)
+{
+	for (; *list != NULL; list++) {
+		if (strcmp(s, *list) == 0) {
+			return 1;
+		}
+	}
+	return 0;
+}
+
+typedef struct Operands {
+	CXCursor cursors[2];
+	int n;
+} Operands;
+
+static enum CXChildVisitResult first_operands(CXCursor cursor, CXCursor parent, CXClientData client_data)
+{
+	Operands* ops = (Operands*)client_data;
+	ops->cursors[ops->n++] = cursor;
+	return ops->n < 2 ? CXChildVisit_Continue : CXChildVisit_Break;
+}
+
+/* operator_of writes the operator of an expression to op, "" if there is
+ * none. libclang has no accessor for operators, so it is the first token
+ * before the operand of unary operators, or after the first operand of binary
+ * operators and member references. Only the tokens between the operands are
+ * looked at, nested expressions would make tokenizing all of them quadratic. */
+static void operator_of(CXTranslationUnit tu, CXCursor cursor, int after_operand, char* op, size_t size)
+{
+	CXSourceRange extent = clang_getCursorExtent(cursor);
+	CXSourceLocation start = clang_getRangeStart(extent), end = clang_getRangeEnd(extent);
+	Operands ops = { .n = 0 };
+	CXToken* tokens;
+	unsigned n, i, offset, from = 0;
+
+	op[0] = '\0';
+	clang_visitChildren(cursor, first_operands, &ops);
+	if (after_operand) {
+		if (ops.n == 0) {
+			return; /* implicit this-> */
+		}
+		start = clang_getRangeEnd(clang_getCursorExtent(ops.cursors[0]));
+		clang_getExpansionLocation(start, NULL, NULL, NULL, &from);
+		if (ops.n == 2) {
+			end = clang_getRangeStart(clang_getCursorExtent(ops.cursors[1]));
+		}
+	} else if (ops.n > 0) {
+		end = clang_getRangeStart(clang_getCursorExtent(ops.cursors[0]));
+	}
+	clang_tokenize(tu, clang_getRange(start, end), &tokens, &n);
+	for (i = 0; i < n; i++) {
+		clang_getExpansionLocation(clang_getTokenLocation(tu, tokens[i]), NULL, NULL, NULL, &offset);
+		if (offset < from) {
+			continue;
+		}
+		CXString spelling = clang_getTokenSpelling(tu, tokens[i]);
+		snprintf(op, size, "%s", clang_getCString(spelling));
+		clang_disposeString(spelling);
+		break;
+	}
+	clang_disposeTokens(tu, tokens, n);
+}
+
+static enum CXChildVisitResult metricsVisitor(CXCursor cursor, CXCursor parent, CXClientData client_data)
+{
+	MData* md = (MData*)client_data;
+	function_metrics* m = md->m;
+	enum CXCursorKind kind = clang_getCursorKind(cursor);
+	char op[4];
+
+	if (is_function_kind(kind)) {
+		return CXChildVisit_Continue; /* lambdas and local classes have their own metrics */
+	}
+	if (kind >= CXCursor_FirstStmt && kind <= CXCursor_LastStmt &&
+			kind != CXCursor_CompoundStmt && kind != CXCursor_NullStmt) {
+		m->statements++;
+	}
+
+	switch (kind) {
+	case CXCursor_ParmDecl:
+		if (clang_equalCursors(parent, md->function)) {
+			m->params++;
+		}
+		return CXChildVisit_Continue;
+	case CXCursor_CaseStmt:
+	case CXCursor_ConditionalOperator:
+	case CXCursor_CXXCatchStmt:
+		m->complexity++;
+		break;
+	case CXCursor_BinaryOperator:
+		operator_of(md->tu, cursor, 1, op, sizeof(op));
+		if (strcmp(op, "&&") == 0 || strcmp(op, "||") == 0) {
+			m->complexity++;
+		}
+		break;
+	case CXCursor_UnaryOperator:
+		operator_of(md->tu, cursor, 0, op, sizeof(op));
+		if (strcmp(op, "*") == 0) {
+			m->derefs++;
+		}
+		break;
+	case CXCursor_MemberRefExpr:
+		operator_of(md->tu, cursor, 1, op, sizeof(op));
+		if (strcmp(op, "->") == 0) {
+			m->derefs++;
+		}
+		break;
+	case CXCursor_ArraySubscriptExpr:
+		m->derefs++;
+		break;
+	case CXCursor_CallExpr: {
+		CXString name = clang_getCursorSpelling(cursor);
+		if (is_member(clang_getCString(name), memory_functions)) {
+			m->memory_calls++;
+		}
+		clang_disposeString(name);
+		break;
+	}
+	case CXCursor_IfStmt:
+	case CXCursor_ForStmt:
+	case CXCursor_CXXForRangeStmt:
+	case CXCursor_ObjCForCollectionStmt:
+	case CXCursor_WhileStmt:
+	case CXCursor_DoStmt:
+	case CXCursor_SwitchStmt: {
+		/* an else if counts as nested in its if */
+		MData inner = *md;
+		if (kind != CXCursor_SwitchStmt) {
+			m->complexity++;
+		}
+		inner.depth++;
+		if (inner.depth > m->max_nesting) {
+			m->max_nesting = inner.depth;
+		}
+		clang_visitChildren(cursor, metricsVisitor, &inner);
+		return CXChildVisit_Continue;
+	}
+	default:
+		break;
+	}
+	return CXChildVisit_Recurse;
+}
+
+/* compute_metrics fills in the metrics of a function cursor */
+static void compute_metrics(CXCursor cursor, CData* cdata, function_metrics* m)
+{
+	MData md;
+	memset(m, 0, sizeof(*m));
+	m->complexity = 1;
+	md.m = m;
+	md.tu = cdata->tu;
+	md.function = cursor;
+	md.depth = 0;
+	clang_visitChildren(cursor, metricsVisitor, &md);
+}
+
 enum CXChildVisitResult cursorVisitor(CXCursor cursor, CXCursor parent, CXClientData client_data)
 {
 	enum CXCursorKind kind = clang_getCursorKind(cursor);
-	CXString name = clang_getCursorSpelling(cursor);
+	CData* cdata = (CData*)client_data;
 
-	if (kind == CXCursor_FunctionDecl || kind == CXCursor_ObjCInstanceMethodDecl) {
+	if (is_function_kind(kind)) {
 		CXSourceRange extent = clang_getCursorExtent(cursor);
 		CXSourceLocation start = clang_getRangeStart(extent);
 		CXSourceLocation end = clang_getRangeEnd(extent);
 
 		CXFile loc_file;
-		CData* cdata = (CData*)client_data;
 		clang_getExpansionLocation(start, &loc_file, NULL, NULL, NULL);
 		CXString cx_loc_fname = clang_getFileName(loc_file);
 
 		/*printf("file %s\nfunc %s\n", cdata->fname, clang_getCString(cx_loc_fname));*/
 		if (strcmp(cdata->fname, clang_getCString(cx_loc_fname)) == 0) { // not a local function
-			function* f = malloc(sizeof(function));
-			f->name = clang_getCString(name);
+			function* f = new_function(cursor, cdata);
 			clang_getExpansionLocation(start, NULL, &(f->start_line), NULL, NULL);
 			clang_getExpansionLocation(end, NULL, &(f->end_line), NULL, NULL);
+			compute_metrics(cursor, cdata, &f->metrics);
 
 			fa_add(cdata->fa, f);
+
+			/* look for lambdas and local classes in the body */
+			CData inner = *cdata;
+			inner.enclosing = f->qualified_name;
+			inner.lambdas = 0;
+			clang_visitChildren(cursor, *cursorVisitor, (CXClientData)&inner);
 		}
 		clang_disposeString(cx_loc_fname);
 
 		return CXChildVisit_Continue;
 	}
+	if ((kind == CXCursor_VarDecl || kind == CXCursor_FieldDecl) && cdata->enclosing == NULL) {
+		/* lambdas outside of functions are counted per variable, so that
+		 * adding one does not rename those of other variables */
+		char buf[4096] = "";
+		CXString spelling = clang_getCursorSpelling(cursor);
+		append_scope(cursor, buf, sizeof(buf));
+		strncat(buf, clang_getCString(spelling), sizeof(buf) - strlen(buf) - 1);
+		clang_disposeString(spelling);
+
+		CData inner = *cdata;
+		inner.enclosing = buf;
+		inner.lambdas = 0;
+		clang_visitChildren(cursor, *cursorVisitor, (CXClientData)&inner);
+		return CXChildVisit_Continue;
+	}
 	return CXChildVisit_Recurse;
 }
-
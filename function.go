@@ -8,9 +8,11 @@ package main
 import "C"
 
 import (
+	"context"
 	"fmt"
 	"path"
 	"strings"
+	"time"
 	"unsafe"
 
 	"github.com/libgit2/git2go"
@@ -20,21 +22,59 @@ import (
 var DisableFunctionAnalysis = false
 
 type Function struct {
-	Id        int64  `db:"id" table:"functions"`
-	CommitId  int64  `db:"commit_id"`
-	Name      string `db:"name"`
-	FileName  string `db:"file_name"`
-	StartLine uint   `db:"start_line"`
-	EndLine   uint   `db:"end_line"`
-	State     string `db:"state"` // can be "added", "modified", "deleted"
+	Id            int64  `json:"-" db:"id" table:"functions"`
+	CommitId      int64  `json:"-" db:"commit_id"`
+	Name          string `json:"name" db:"name"`
+	QualifiedName string `json:"qualified_name" db:"qualified_name"` // e.g. ns::Class::method, -[Class sel:] in ObjC
+	Signature     string `json:"signature" db:"signature"`           // e.g. (int, const char *) const, empty in C
+	FileName      string `json:"file_name" db:"file_name"`
+	StartLine     uint   `json:"start_line" db:"start_line"`
+	EndLine       uint   `json:"end_line" db:"end_line"`
+	State         string `json:"state" db:"state"`                 // can be "added", "modified", "deleted"
+	LinesAdded    int    `json:"lines_added" db:"lines_added"`     // by the commit, inside the function
+	LinesDeleted  int    `json:"lines_deleted" db:"lines_deleted"` // from the old version of the function
+
+	// changes of the function before and after the commit, see FunctionChanges
+	PastChanges            int64 `json:"past_changes" db:"past_changes"`
+	FutureChanges          int64 `json:"future_changes" db:"future_changes"`
+	PastDifferentAuthors   int64 `json:"past_different_authors" db:"past_different_authors"`
+	FutureDifferentAuthors int64 `json:"future_different_authors" db:"future_different_authors"`
+
+	// Metrics of the new version, of the old one for deleted functions
+	Metrics FunctionMetrics `json:"metrics"`
+	// Previous are the metrics of the old version of a modified function
+	Previous *FunctionMetrics `json:"previous,omitempty"`
+}
+
+// FunctionMetrics are computed from the AST of a function by libclang
+type FunctionMetrics struct {
+	Complexity  int `json:"complexity" db:"complexity"`   // cyclomatic
+	MaxNesting  int `json:"max_nesting" db:"max_nesting"` // of if, switch and loops
+	Params      int `json:"params" db:"params"`
+	Statements  int `json:"statements" db:"statements"`
+	Derefs      int `json:"derefs" db:"derefs"`             // unary *, -> and subscripts
+	MemoryCalls int `json:"memory_calls" db:"memory_calls"` // malloc, memcpy, strcpy, ...
+}
+
+// Sub returns the change from old to m
+func (m FunctionMetrics) Sub(old FunctionMetrics) FunctionMetrics {
+	return FunctionMetrics{
+		Complexity:  m.Complexity - old.Complexity,
+		MaxNesting:  m.MaxNesting - old.MaxNesting,
+		Params:      m.Params - old.Params,
+		Statements:  m.Statements - old.Statements,
+		Derefs:      m.Derefs - old.Derefs,
+		MemoryCalls: m.MemoryCalls - old.MemoryCalls,
+	}
 }
 
 type Functions struct {
 	data      map[string](*Function)
 	functions [](*Function)
-}
 
-type EmtyFunctionIterator func(line int) (f *Function, ok bool)
+	Diagnostics int // warnings and errors of the parse
+	Errors      int // errors and fatal errors of the parse
+}
 
 func NewFunctions() *Functions {
 	fs := &Functions{
@@ -53,53 +93,71 @@ func NewFunctionsFromC(fa *C.functions_array) *Functions {
 			continue
 		}
 		fs.Add(&Function{
-			Name:      C.GoString(f.name),
-			StartLine: uint(f.start_line),
-			EndLine:   uint(f.end_line),
+			Name:          C.GoString(f.name),
+			QualifiedName: C.GoString(f.qualified_name),
+			Signature:     C.GoString(f.signature),
+			StartLine:     uint(f.start_line),
+			EndLine:       uint(f.end_line),
+			Metrics: FunctionMetrics{
+				Complexity:  int(f.metrics.complexity),
+				MaxNesting:  int(f.metrics.max_nesting),
+				Params:      int(f.metrics.params),
+				Statements:  int(f.metrics.statements),
+				Derefs:      int(f.metrics.derefs),
+				MemoryCalls: int(f.metrics.memory_calls),
+			},
 		})
 	}
 
 	return fs
 }
 
-func (fs *Functions) NewEmptyFunctionIterator() EmtyFunctionIterator {
-	var (
-		i = 0
-	)
-	return func(line int) (f *Function, ok bool) {
-		for ; i < len(fs.functions); i++ {
-			f := fs.functions[i]
-			if f.State == "" && line <= int(f.EndLine) {
-				return f, true
-			}
-		}
-		return nil, false
-	}
-}
-
 func (fs *Functions) Functions() (fa []*Function) {
 	return fs.functions
 }
 
 func (fs *Functions) Add(f *Function) {
-	fs.data[f.Name] = f
+	fs.data[f.Identity()] = f
 	fs.functions = append(fs.functions, f)
 }
 
+// FunctionAt returns the innermost function containing a line, e.g. the
+// lambda rather than the function around it
+func (fs *Functions) FunctionAt(line int) (*Function, bool) {
+	var found *Function
+	for _, f := range fs.functions {
+		if f.ContainsLine(line) && (found == nil || f.EndLine-f.StartLine < found.EndLine-found.StartLine) {
+			found = f
+		}
+	}
+	return found, found != nil
+}
+
+// Data returns the functions by Identity
 func (fs *Functions) Data() map[string]*Function {
 	return fs.data
 }
 
+// Named returns the first function with an unqualified name
+func (fs *Functions) Named(name string) (*Function, bool) {
+	for _, f := range fs.functions {
+		if f.Name == name {
+			return f, true
+		}
+	}
+	return nil, false
+}
+
 func AddedAndDeletedFunctions(newFs, oldFs *Functions) []*Function {
 	fs := make([]*Function, 0, len(newFs.functions))
-	for name, f := range newFs.data {
-		if _, found := oldFs.data[name]; !found {
+	for id, f := range newFs.data {
+		if _, found := oldFs.data[id]; !found {
 			f.State = "added"
 			fs = append(fs, f)
 		}
 	}
-	for name, f := range oldFs.data {
-		if _, found := newFs.data[name]; !found {
+	for id, f := range oldFs.data {
+		if _, found := newFs.data[id]; !found {
 			f.State = "deleted"
 			fs = append(fs, f)
 		}
@@ -120,32 +178,69 @@ func (f *Function) GetId() int64 {
 	return f.Id
 }
 
+// Identity tells overloads apart, it is the qualified name followed by the
+// signature. C functions have no signature, they keep their identity when
+// their parameters change.
+func (f *Function) Identity() string {
+	name := f.QualifiedName
+	if name == "" {
+		name = f.Name
+	}
+	return name + f.Signature
+}
+
 func (f *Function) String() string {
-	return fmt.Sprintf("%s (%s): %s:%d:%d", f.Name, f.State, f.FileName, f.StartLine, f.EndLine)
+	return fmt.Sprintf("%s (%s): %s:%d:%d", f.Identity(), f.State, f.FileName, f.StartLine, f.EndLine)
+}
+
+// Delta returns the change of the metrics of a modified function, it is zero
+// for other functions
+func (f *Function) Delta() FunctionMetrics {
+	if f.Previous == nil {
+		return FunctionMetrics{}
+	}
+	return f.Metrics.Sub(*f.Previous)
 }
 
 func (f *Function) ContainsLine(line int) bool {
 	return int(f.StartLine) <= line && line <= int(f.EndLine)
 }
 
-func functionsForFilename(fname string, unsaved clang.UnsavedFiles) (functions *Functions, err error) {
+// functionsForFilename parses a file with libclang, args are passed on like
+// command line arguments of clang
+func functionsForFilename(fname string, unsaved clang.UnsavedFiles, args ...string) (functions *Functions, err error) {
 	cfname := C.CString(fname)
 	defer C.free(unsafe.Pointer(cfname))
 
 	contents := C.CString(unsaved[fname])
 	defer C.free(unsafe.Pointer(contents))
 
-	fa, err := C.get_functions(cfname, contents, C.ulong(len(unsaved[fname])))
+	var cargs **C.char
+	if len(args) > 0 {
+		cargs = (**C.char)(C.malloc(C.size_t(len(args)) * C.size_t(unsafe.Sizeof(uintptr(0)))))
+		defer C.free(unsafe.Pointer(cargs))
+		arr := (*[1 << 20]*C.char)(unsafe.Pointer(cargs))[:len(args):len(args)]
+		for i, arg := range args {
+			arr[i] = C.CString(arg)
+			defer C.free(unsafe.Pointer(arr[i]))
+		}
+	}
+
+	fa, err := C.get_functions(cfname, contents, C.ulong(len(unsaved[fname])), cargs, C.int(len(args)))
 	if err != nil {
 		return nil, err
 	}
 	defer C.fa_free(fa)
 
 	functions = NewFunctionsFromC(fa)
+	functions.Diagnostics, functions.Errors = int(fa.diagnostics), int(fa.errors)
 	return
 }
 
-func FunctionsForFile(repo *git.Repository, file *git.DiffFile) (functions *Functions, err error) {
+// FunctionsForFile extracts the functions of a file version, in a helper
+// process if there is a parser pool. args are passed to clang.
+func FunctionsForFile(ctx context.Context, repo *git.Repository, file *git.DiffFile, args ...string) (functions *Functions, err error) {
+	defer observe("FunctionsForFile", time.Now(), &err)
 	if DisableFunctionAnalysis {
 		return NewFunctions(), nil
 	}
@@ -155,10 +250,15 @@ func FunctionsForFile(repo *git.Repository, file *git.DiffFile) (functions *Func
 		return
 	}
 	fname := path.Join(repo.Workdir(), file.Path)
-	functions, err = functionsForFilename(
-		fname,
-		map[string]string{fname: string(blob.Contents())},
-	)
+	if parsers != nil {
+		functions, err = parsers.Parse(ctx, fname, blob.Contents(), args)
+	} else {
+		functions, err = functionsForFilename(
+			fname,
+			map[string]string{fname: string(blob.Contents())},
+			args...,
+		)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -3,22 +3,37 @@
 
 #include <stdio.h>
 
+typedef struct function_metrics {
+  unsigned complexity;   /* cyclomatic: 1 + branches, case labels, && and || */
+  unsigned max_nesting;  /* deepest nesting of if, switch and loops */
+  unsigned params;
+  unsigned statements;
+  unsigned derefs;       /* unary *, -> and subscripts */
+  unsigned memory_calls; /* calls to allocation, copy and string functions */
+} function_metrics;
+
 typedef struct function {
-  const char *name;
+  char *name;
+  char *qualified_name; /* with namespaces and classes, -[Class sel] for ObjC */
+  char *signature;      /* template and parameter types, const qualifier, empty in C */
   unsigned start_line;
   unsigned end_line;
+  function_metrics metrics;
 } function;
 
 typedef struct functions_array {
   function** data;
   size_t len;
   size_t cap;
+  unsigned diagnostics; /* warnings and errors of the parse */
+  unsigned errors;      /* errors and fatal errors of the parse */
 } functions_array;
 
 
 function* fa_at(functions_array* fa, size_t i);
 
-functions_array* get_functions(const char* fname, const char* contents, unsigned long contents_len);
+functions_array* get_functions(const char* fname, const char* contents, unsigned long contents_len,
+		const char* const* args, int nargs);
 
 functions_array* fa_new(size_t cap);
 
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/juju/utils/set"
+	"github.com/libgit2/git2go"
+
+	"tools.net.cs.uni-bonn.de/social-aspects-of-vulnerabilities/github-data/proc"
+)
+
+// functionHistory enables the change statistics of the functions of a commit.
+// They need up to two git log -L per function, which is slow on long
+// histories, so they are off by default.
+var functionHistory = false
+
+// FunctionChanges fills in the past and future changes of the functions of
+// the commit, like FileChanges for files. Past changes are the commits up to
+// and including this one that touched the lines of the function, future
+// changes those after it that touched the function as it is at HEAD.
+func (c *Commit) FunctionChanges(ctx context.Context, repo *git.Repository, gitCommit *git.Commit) (err error) {
+	defer observe("FunctionChanges", time.Now(), &err)
+	if !functionHistory || len(c.Functions) == 0 {
+		return nil
+	}
+	head, err := headFunctions(repo, gitCommit)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range c.Functions {
+		past, future := set.NewStrings(), set.NewStrings()
+		switch f.State {
+		case "added":
+			f.PastChanges = 1
+			past.Add(gitCommit.Author().Name)
+		case "deleted":
+			// the lines are those of the parent, the commit adds one change
+			f.PastChanges, past, err = lineRangeLog(ctx, repo.Workdir(), c.Sha+"^", f.FileName, f.StartLine, f.EndLine)
+			f.PastChanges++
+			past.Add(gitCommit.Author().Name)
+		default:
+			f.PastChanges, past, err = lineRangeLog(ctx, repo.Workdir(), c.Sha, f.FileName, f.StartLine, f.EndLine)
+		}
+		if err != nil {
+			c.failf(StageFunctions, "history of %v: %v", f, err)
+			if proc.IsTimeout(err) {
+				return nil
+			}
+			continue
+		}
+		f.PastDifferentAuthors = int64(past.Size())
+
+		if f.State == "deleted" {
+			continue
+		}
+		cur, ok, err := head.function(ctx, c.Repository, f)
+		if err != nil {
+			c.failf(StageFunctions, "%v at HEAD: %v", f, err)
+			continue
+		}
+		if !ok { // renamed, moved or deleted later
+			continue
+		}
+		f.FutureChanges, future, err = lineRangeLog(ctx, repo.Workdir(), c.Sha+"..HEAD", cur.FileName, cur.StartLine, cur.EndLine)
+		if err != nil {
+			c.failf(StageFunctions, "future of %v: %v", f, err)
+			if proc.IsTimeout(err) {
+				return nil
+			}
+			continue
+		}
+		f.FutureDifferentAuthors = int64(future.Size())
+	}
+	return nil
+}
+
+// lineRangeLog returns the number of commits in rev that changed lines start
+// to end of a file, as of the last commit of rev, and their authors. dir is
+// the work tree of the repository.
+func lineRangeLog(ctx context.Context, dir, rev, path string, start, end uint) (changes int64, authors set.Strings, err error) {
+	authors = set.NewStrings()
+	logCmd := proc.Command(ctx, logTimeout,
+		"git",
+		"log",
+		fmt.Sprintf("-L%d,%d:%s", start, end, path),
+		"--no-patch",
+		"--format=%an",
+		rev,
+	)
+	out, errBuf := new(bytes.Buffer), new(bytes.Buffer)
+	logCmd.Stdout, logCmd.Stderr = out, errBuf
+	logCmd.Dir = dir
+	if err = logCmd.Run(); err != nil {
+		if proc.IsTimeout(err) {
+			return 0, authors, err
+		}
+		return 0, authors, fmt.Errorf("%v failed: %v: %s", logCmd, err, bytes.TrimSpace(errBuf.Bytes()))
+	}
+	scanner := bufio.NewScanner(out)
+	for scanner.Scan() {
+		if author := scanner.Text(); author != "" {
+			changes++
+			authors.Add(author)
+		}
+	}
+	return changes, authors, scanner.Err()
+}
+
+// headVersion has the functions of files at HEAD, parsed on first use
+type headVersion struct {
+	tree  *git.Tree // nil if the commit is HEAD
+	files map[string]*Functions
+}
+
+func headFunctions(repo *git.Repository, gitCommit *git.Commit) (*headVersion, error) {
+	h := &headVersion{files: make(map[string]*Functions)}
+	ref, err := repo.Head()
+	if err != nil {
+		return nil, fmt.Errorf("resolving HEAD: %v", err)
+	}
+	if ref.Target().Equal(gitCommit.Id()) {
+		return h, nil
+	}
+	commit, err := repo.LookupCommit(ref.Target())
+	if err != nil {
+		return nil, err
+	}
+	h.tree, err = commit.Tree()
+	return h, err
+}
+
+// function returns the version of f at HEAD, by Identity in the same file
+func (h *headVersion) function(ctx context.Context, r *Repository, f *Function) (*Function, bool, error) {
+	if h.tree == nil {
+		return nil, false, nil
+	}
+	fs, ok := h.files[f.FileName]
+	if !ok {
+		entry, err := h.tree.EntryByPath(f.FileName)
+		if err != nil { // not at HEAD
+			h.files[f.FileName] = nil
+			return nil, false, nil
+		}
+		repo, err := r.GitRepository()
+		if err != nil {
+			return nil, false, err
+		}
+		fs, err = FunctionsForFile(ctx, repo, &git.DiffFile{Path: f.FileName, Oid: entry.Id}, r.ClangArgs(f.FileName)...)
+		if err != nil {
+			return nil, false, err
+		}
+		h.files[f.FileName] = fs
+	}
+	if fs == nil {
+		return nil, false, nil
+	}
+	cur, ok := fs.Data()[f.Identity()]
+	return cur, ok, nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// tempGitRepo creates a git repository in a temporary directory. git runs a
+// git command in it, commit commits contents as f.c and returns the sha.
+func tempGitRepo(t *testing.T, prefix string) (dir string, git func(args ...string) string, commit func(author, contents string) string) {
+	dir, err := ioutil.TempDir("", prefix)
+	handleErr(t, err)
+	git = func(args ...string) string {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = dir
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("git %v: %v: %s", args, err, out)
+		}
+		return strings.TrimSpace(string(out))
+	}
+	commit = func(author, contents string) string {
+		handleErr(t, ioutil.WriteFile(filepath.Join(dir, "f.c"), []byte(contents), 0644))
+		git("add", "f.c")
+		git("-c", "user.name="+author, "-c", "user.email="+author+"@example.com", "commit", "-q", "-m", author)
+		return git("rev-parse", "HEAD")
+	}
+	git("init", "-q")
+	return
+}
+
+func TestLineRangeLog(t *testing.T) {
+	dir, _, commit := tempGitRepo(t, "line-range-log")
+	defer os.RemoveAll(dir)
+	commit("a", "int foo(int a)\n{\n\treturn a;\n}\n\nint bar(void)\n{\n\treturn 1;\n}\n")
+	sha := commit("b", "int foo(int a)\n{\n\treturn a + 1;\n}\n\nint bar(void)\n{\n\treturn 1;\n}\n")
+	commit("c", "int foo(int a)\n{\n\treturn a + 1;\n}\n\nint bar(void)\n{\n\treturn 2;\n}\n")
+	commit("d", "/* header */\nint foo(int a)\n{\n\treturn a + 2;\n}\n\nint bar(void)\n{\n\treturn 2;\n}\n")
+
+	ctx := context.Background()
+	changes, authors, err := lineRangeLog(ctx, dir, sha, "f.c", 1, 4)
+	handleErr(t, err)
+	if changes != 2 || authors.Size() != 2 {
+		t.Errorf("foo before %s: expected 2 changes by 2 authors, got %d by %d", sha, changes, authors.Size())
+	}
+	// foo has moved down by one line at HEAD
+	changes, authors, err = lineRangeLog(ctx, dir, sha+"..HEAD", "f.c", 2, 5)
+	handleErr(t, err)
+	if changes != 1 || authors.Size() != 1 {
+		t.Errorf("foo after %s: expected 1 change by 1 author, got %d by %d", sha, changes, authors.Size())
+	}
+	if _, _, err = lineRangeLog(ctx, dir, "HEAD", "missing.c", 1, 2); err == nil {
+		t.Error("expected an error for a missing file")
+	}
+}
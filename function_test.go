@@ -1,5 +1,7 @@
 package main
 
+import "context"
+import "strings"
 import "testing"
 import "github.com/libgit2/git2go"
 
@@ -66,26 +68,6 @@ func TestFunctionsForFileOpensslSServer(t *testing.T) {
 	t.Log(fs.String())
 }
 
-func TestEmptyFunctionIterator(t *testing.T) {
-	fs := NewFunctions()
-	fs.Add(&Function{
-		Name:      "foo",
-		StartLine: 10,
-		EndLine:   20,
-		State:     "",
-	})
-	iter := fs.NewEmptyFunctionIterator()
-	f, ok := iter(10)
-	if !ok {
-		t.Error("iter failed")
-	}
-	f.State = "modified"
-	funs := fs.Data()
-	if funs["foo"].State != "modified" {
-		t.Error("not the same function")
-	}
-}
-
 func TestNewFunctions(t *testing.T) {
 	fs := NewFunctions()
 	fs.Add(&Function{})
@@ -94,6 +76,155 @@ func TestNewFunctions(t *testing.T) {
 	t.Logf("%+v", fs.functions)
 }
 
+func TestFunctionIdentity(t *testing.T) {
+	oldFs := NewFunctions()
+	oldFs.Add(&Function{Name: "put", QualifiedName: "ns::Map::put", Signature: "(int)"})
+	oldFs.Add(&Function{Name: "put", QualifiedName: "ns::Map::put", Signature: "(const char *)"})
+	if len(oldFs.Data()) != 2 {
+		t.Fatalf("overloads should not overwrite each other: %v", oldFs)
+	}
+
+	newFs := NewFunctions()
+	newFs.Add(&Function{Name: "put", QualifiedName: "ns::Map::put", Signature: "(int)"})
+	newFs.Add(&Function{Name: "put", QualifiedName: "ns::Map::put", Signature: "(const std::string &)"})
+	changed := AddedAndDeletedFunctions(newFs, oldFs)
+	if len(changed) != 2 {
+		t.Fatalf("expected one added and one deleted overload, got %v", changed)
+	}
+	for _, f := range changed {
+		if f.State == "added" && f.Signature != "(const std::string &)" ||
+			f.State == "deleted" && f.Signature != "(const char *)" {
+			t.Errorf("unexpected %v", f)
+		}
+	}
+}
+
+func TestFunctionAt(t *testing.T) {
+	fs := NewFunctions()
+	fs.Add(&Function{Name: "outer", StartLine: 10, EndLine: 30})
+	fs.Add(&Function{Name: "(lambda #1)", QualifiedName: "outer::(lambda #1)", StartLine: 15, EndLine: 18})
+	fs.Add(&Function{Name: "next", StartLine: 32, EndLine: 40})
+
+	for line, expected := range map[int]string{5: "", 10: "outer", 16: "(lambda #1)", 19: "outer", 31: "", 40: "next"} {
+		f, ok := fs.FunctionAt(line)
+		if ok != (expected != "") || ok && f.Name != expected {
+			t.Errorf("line %d: expected %q, got %v", line, expected, f)
+		}
+	}
+}
+
+func TestFunctionMetrics(t *testing.T) {
+	fn := "testdata/copy.c"
+	content := `
+void *malloc(unsigned long);
+void free(void *);
+void *memcpy(void *, const void *, unsigned long);
+
+int copy(char *dst, const char *src, int n) {
+	char *buf = malloc(n);
+	if (buf == 0 || n <= 0)
+		return -1;
+	for (int i = 0; i < n; i++) {
+		if (src[i] == 0)
+			break;
+		buf[i] = src[i];
+	}
+	memcpy(dst, buf, n);
+	free(buf);
+	return *dst;
+}
+`
+	fs, err := functionsForFilename(fn, map[string]string{fn: content})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, ok := fs.Named("copy")
+	if !ok {
+		t.Fatalf("copy not found in %v", fs)
+	}
+	m := f.Metrics
+	if m.Complexity != 5 || m.MaxNesting != 2 || m.Params != 3 || m.Derefs != 4 || m.MemoryCalls != 3 {
+		t.Errorf("unexpected metrics %+v", m)
+	}
+
+	f.Previous = &FunctionMetrics{Complexity: 3, MaxNesting: 1, Params: 3, Derefs: 5, MemoryCalls: 3}
+	if d := f.Delta(); d != (FunctionMetrics{Complexity: 2, MaxNesting: 1, Statements: m.Statements, Derefs: -1}) {
+		t.Errorf("unexpected delta %+v", d)
+	}
+}
+
+func TestFunctionNames(t *testing.T) {
+	for fn, content := range map[string]string{
+		"testdata/names.c": `
+static int twice(int x) { return 2 * x; }
+`,
+		"testdata/names.cpp": `
+namespace ns {
+class Map {
+public:
+	void put(int k) {}
+	void put(const char *k) {}
+	int size() const { return 0; }
+};
+}
+
+static auto square = [](int x) { return x * x; };
+
+int apply(int x) {
+	auto inc = [](int y) { return y + 1; };
+	return inc(x);
+}
+`,
+		"testdata/names.m": `
+@interface Foo
+- (int)bar;
+@end
+
+@interface Foo (Cat)
+- (void)baz;
+@end
+
+@implementation Foo
+- (int)bar { return 1; }
++ (Foo *)make { return 0; }
+@end
+
+@implementation Foo (Cat)
+- (void)baz {}
+@end
+`,
+	} {
+		fs, err := functionsForFilename(fn, map[string]string{fn: content})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids := make(map[string]bool)
+		for _, f := range fs.Functions() {
+			ids[f.Identity()] = true
+		}
+		var expected []string
+		switch {
+		case strings.HasSuffix(fn, ".c"):
+			expected = []string{"twice"}
+		case strings.HasSuffix(fn, ".cpp"):
+			expected = []string{"ns::Map::put(int)", "ns::Map::put(const char *)", "ns::Map::size() const",
+				"square::(lambda #1)", "apply(int)", "apply::(lambda #1)"}
+		case strings.HasSuffix(fn, ".m"):
+			expected = []string{"-[Foo bar]", "+[Foo make]", "-[Foo baz]"}
+		}
+		for _, id := range expected {
+			if !ids[id] {
+				t.Errorf("%s: %s not found in %v", fn, id, fs)
+			}
+		}
+		for _, id := range []string{"twice(int)", "(lambda #1)", "::(lambda #1)", "-[Cat baz]"} {
+			if ids[id] {
+				t.Errorf("%s: unexpected %s", fn, id)
+			}
+		}
+	}
+}
+
 func TestGetFunctionsForBlobOid(t *testing.T) {
 	RepoBasePath = "./testdata/"
 
@@ -110,11 +241,11 @@ func TestGetFunctionsForBlobOid(t *testing.T) {
 		Path: "main.c",
 		Oid:  oid,
 	}
-	funs, err := FunctionsForFile(repo, file)
+	funs, err := FunctionsForFile(context.Background(), repo, file)
 	if err != nil {
 		t.Error(err)
 	}
-	if _, found := funs.Data()["main"]; !found {
+	if _, found := funs.Named("main"); !found {
 		t.Fatalf("Expected 'main' to be found in %v", funs)
 	}
 }
@@ -161,7 +292,7 @@ clang ignores stuff at the end
 		t.Error("Should have length 2, had length", len(fs.Functions()))
 	}
 	for _, name := range []string{"funktion", "func_with_invalid_syntax"} {
-		if _, ok := fs.Data()[name]; !ok {
+		if _, ok := fs.Named(name); !ok {
 			t.Errorf("Should have found `%s'.", name)
 		}
 	}
@@ -1,23 +1,29 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"flag"
+	"fmt"
 	"os"
-	"strings"
 	"sync"
+	"sync/atomic"
 
 	"runtime"
 	"runtime/pprof"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 
 	_ "github.com/lib/pq"
+
+	"tools.net.cs.uni-bonn.de/social-aspects-of-vulnerabilities/github-data/tools"
 )
 
 var (
-	commitProcs int
-	//repoProcs      int
+	commitProcs       int
+	repoProcs         int
+	repoCommitProcs   int
 	logLevel          string
 	logPath           string
 	createTables      bool
@@ -33,18 +39,31 @@ var (
 	onlyOneCommit     string
 	addRepository     string
 	commitsSelect     string
+	analyzePath       string
+	analyzeRange      string
+	analyzeOutput     string
+	pythonPath        string
+	ratsPath          string
+	cveFile           string
 	KnownCVEs         *MitreCves
+
+	commitPool = &sync.Pool{New: func() interface{} { return new(Commit) }}
 )
 
 func init() {
-	//flag.IntVar(&repoProcs, "repo-threads", 3, "number of repo threads")
-	flag.IntVar(&commitProcs, "commit-threads", 50, "number of commit threads")
+	flag.IntVar(&repoProcs, "repo-threads", 1, "number of repositories handled concurrently")
+	flag.IntVar(&commitProcs, "commit-threads", 50, "number of threads of each commit stage, shared by all repositories")
+	flag.IntVar(&repoCommitProcs, "repo-commit-threads", 0, "number of commit threads per repository (0: only limited by the stages)")
+	flag.IntVar(&metadataProcs, "metadata-threads", 0, "number of threads reading diffs, functions and tool results (0: -commit-threads)")
+	flag.IntVar(&blameProcs, "blame-threads", 0, "number of threads blaming fixing commits (0: -commit-threads)")
+	flag.IntVar(&persistProcs, "persist-threads", 0, "number of threads writing commits to the db (0: -commit-threads)")
 	flag.StringVar(&logLevel, "log-level", "warn", "Logging level")
 	flag.StringVar(&RepoBasePath, "repo-path", "repos/", "path to repositories")
 	flag.StringVar(&logPath, "log", "", "file to log to")
 	flag.BoolVar(&createTables, "create-tables", false, "Whether to create the database tables")
 	flag.BoolVar(&initRedis, "init-redis", false, "Just init redis")
-	flag.BoolVar(&reportProgress, "progress", false, "Just report progress")
+	flag.BoolVar(&reportProgress, "progress", false, "Just report progress (same as -queue=list)")
+	flag.StringVar(&queueCommand, "queue", "", "Administer the redis queues: list, inspect, requeue or purge, followed by repositories or queues")
 	flag.BoolVar(&doSelfTest, "self-test", false, "Just do a self test")
 	flag.BoolVar(&doStableDbCheck, "check-stable-db", false, "Just do a consistency check for the stable db")
 	flag.BoolVar(&doUnstableDbCheck, "check-unstable-db", false, "Just do a consistency check for the unstable db")
@@ -55,15 +74,62 @@ func init() {
 	flag.BoolVar(&skipRedis, "skip-redis", false, "Don't use redis")
 	flag.StringVar(&addRepository, "add-repo", "", "Repo to add to the db")
 	flag.StringVar(&commitsSelect, "commits-select", "empty", "Set of commits to select")
+	flag.IntVar(&chunkSize, "chunk-size", chunkSize, "Split repositories with more selected commits into jobs of this many commits (0: never)")
+	flag.BoolVar(&retryFailed, "retry-failed", false, "Just update the commits with failures again (of -repo or all repositories)")
+	flag.StringVar(&failedStage, "failed-stage", "", "Only select failures in this stage: metadata, blame, functions or persist")
+	flag.StringVar(&failedMatch, "failed-match", "", "Only select failures whose error matches this LIKE pattern, e.g. %timeout%")
+	flag.StringVar(&storeBackend, "store", "postgres", "Storage backend: postgres or sqlite")
+	flag.StringVar(&sqlitePath, "sqlite", "github-data.db", "Database file for the sqlite store")
+	flag.StringVar(&analyzePath, "analyze", "", "Analyze a local clone without db or redis")
+	flag.StringVar(&analyzeRange, "range", "HEAD", "Commit range to analyze, e.g. v1.0..v2.0")
+	flag.StringVar(&analyzeOutput, "out", "", "JSONL file to write analyze results to (default stdout)")
+	flag.StringVar(&exportFunctions, "export-functions", "", "Just export the functions of fixing commits of -repo or all repositories to this JSONL file (- for stdout)")
+	flag.StringVar(&configPath, "config", "", "TOML file with settings, keys are flag names")
+	flag.StringVar(&redisAddress, "redis", redisAddress, "Address of the redis server")
+	flag.StringVar(&coordinatorListen, "coordinator-listen", "", "Run as coordinator, serving the redis queue to workers on this address, e.g. :8080")
+	flag.StringVar(&coordinatorURL, "coordinator", "", "Get jobs from the coordinator at this URL instead of redis")
+	flag.DurationVar(&LeaseTTL, "lease-ttl", LeaseTTL, "How long a repository stays claimed without heartbeat")
+	flag.DurationVar(&shutdownTimeout, "shutdown-timeout", shutdownTimeout, "How long to wait for running commits on SIGINT or SIGTERM")
+	flag.StringVar(&httpAddress, "http", "", "Serve /status and /metrics on this address, e.g. :9100")
+	flag.IntVar(&MaxAttempts, "max-attempts", MaxAttempts, "How often a repository is tried before it goes to the dead list")
+	flag.StringVar(&postgresConnection, "postgres", postgresConnection, "Postgres connection (user:password@host:port)")
+	flag.StringVar(&dbname, "db-name", dbname, "Name of the postgres database")
+	flag.StringVar(&dbSchema, "db-schema", dbSchema, "Postgres schema of the commit tables")
+	flag.DurationVar(&cloneTimeout, "clone-timeout", cloneTimeout, "How long git clone, git pull or copying to the ramdisk may take")
+	flag.DurationVar(&blameTimeout, "blame-timeout", blameTimeout, "How long a git blame may take")
+	flag.Var(&blameStrategy, "blame-strategy", "How fixing commits are blamed: plain or a comma separated list of w (ignore whitespace), M or C (detect moved lines), ignore-revs and cosmetic (skip commits only changing whitespace or comments)")
+	flag.StringVar(&blameIgnoreRevs, "blame-ignore-revs", blameIgnoreRevs, "File of commits skipped by the ignore-revs blame strategy, relative to the repository")
+	flag.StringVar(&blamePolicy, "blame-policy", blamePolicy, "Which blame candidates of a fixing commit are blamed: max (most lines), all or recent")
+	flag.BoolVar(&filterDisclosed, "filter-disclosed", filterDisclosed, "Discard blame candidates committed after the CVE of the fixing commit was published")
+	flag.DurationVar(&logTimeout, "log-timeout", logTimeout, "How long git log --follow may take for a file, or git log -L for a function")
+	flag.BoolVar(&functionHistory, "function-history", functionHistory, "Count past and future changes and authors of changed functions")
+	flag.IntVar(&parserProcs, "parser-procs", parserProcs, "number of helper processes extracting functions (0: in this process, a libclang crash kills it)")
+	flag.DurationVar(&parseTimeout, "parse-timeout", parseTimeout, "How long extracting the functions of a file may take")
+	flag.StringVar(&clangFlags, "clang-flags", "", "Flags passed to libclang for every file, e.g. \"-std=gnu99 -Iinclude -DHAVE_CONFIG_H\"")
+	flag.StringVar(&compileDBName, "compile-db", compileDBName, "Compilation database in the repositories, used for the flags of their files (empty: none)")
+	flag.BoolVar(&parseHelper, "parse-helper", false, "Run as parse helper, used by -parser-procs")
+	flag.DurationVar(&tools.Timeout, "tool-timeout", tools.Timeout, "How long flawfinder or rats may take for a file")
+	flag.StringVar(&RamdiskPath, "ramdisk", RamdiskPath, "Ramdisk to copy repositories to")
+	flag.StringVar(&pythonPath, "python", "/usr/bin/python", "Python interpreter for the analysis tools")
+	flag.StringVar(&ratsPath, "rats", "/usr/bin/rats", "Path to the rats binary")
+	flag.StringVar(&cveFile, "cve-file", "data/cve.xml", "CVE feed in CVRF format")
 
 	runtime.GOMAXPROCS(runtime.NumCPU())
 }
 
 func main() {
-	InitDb()
-	InitRedis()
-
 	flag.Parse()
+	if parseHelper {
+		// responses go to fd 3, libclang writes to stdout
+		if err := RunParseHelper(os.Stdin, os.NewFile(3, "responses")); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if err := LoadConfig(configPath); err != nil {
+		log.Fatal(err)
+	}
+	tools.Configure(pythonPath, ratsPath)
 
 	if logPath != "" {
 		logFile, err := os.OpenFile(logPath, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
@@ -81,9 +147,6 @@ func main() {
 		log.SetLevel(log.WarnLevel)
 	case "error":
 		log.SetLevel(log.ErrorLevel)
-	default:
-		log.SetLevel(log.WarnLevel)
-		log.Warnf("Log level %s is not in [debug info warn error], setting to warn", logLevel)
 	}
 
 	if profilePath != "" {
@@ -95,28 +158,80 @@ func main() {
 			defer pprof.StopCPUProfile()
 		}
 	}
+
+	if parserProcs > 0 {
+		exe, err := os.Executable()
+		if err != nil {
+			log.Fatal(err)
+		}
+		parsers = NewParserPool(parserProcs, parseTimeout, exe, "-parse-helper")
+	}
+
+	if analyzePath != "" {
+		if err := runAnalyze(); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if err := InitStore(); err != nil {
+		log.Fatal(err)
+	}
+	InitRedis()
+	if coordinatorURL != "" {
+		q, err := NewHTTPQueue(coordinatorURL, processname)
+		if err != nil {
+			log.Fatal(err)
+		}
+		JobQueue = q
+	} else if !skipRedis {
+		JobQueue = redisQueue{}
+	}
+	if httpAddress != "" {
+		go ServeStatus(httpAddress)
+	}
+
 	if createTables {
-		DB.CreateTablesIfNotExists()
+		if err := DataStore.CreateTables(); err != nil {
+			log.Fatal(err)
+		}
 	}
 
 	if doSelfTest {
 		SelfTest()
 		return
 	}
+	if (doStableDbCheck || doUnstableDbCheck) && DB == nil {
+		log.Fatal("db consistency checks require the postgres store")
+	}
 	if doStableDbCheck {
 		DbCheck("public.commits")
 		return
 	}
 	if doUnstableDbCheck {
-		DbCheck("unstable.commits")
+		DbCheck(dbSchema + ".commits")
 		return
 	}
 	if reportProgress {
-		PrintProgress()
+		queueCommand = "list"
+	}
+	if queueCommand != "" {
+		if err := RunQueueCommand(os.Stdout, queueCommand, flag.Args()); err != nil {
+			log.Fatal(err)
+		}
 		return
 	}
 	if initRedis {
 		WriteReposToRedis()
+		if coordinatorListen == "" {
+			return
+		}
+	}
+	if coordinatorListen != "" {
+		HandleSignals()
+		if err := RunCoordinator(coordinatorListen); err != nil {
+			log.Fatal(err)
+		}
 		return
 	}
 	if addRepository != "" {
@@ -125,130 +240,310 @@ func main() {
 		}
 		return
 	}
-
-	log.Debugln("gathering known CVEs")
-	KnownCVEs = NewMitreCves()
-	if err := KnownCVEs.Read("data/cve.xml"); err != nil {
-		log.Fatal(err)
+	if exportFunctions != "" {
+		if err := runExportFunctions(); err != nil {
+			log.Fatal(err)
+		}
+		return
 	}
 
+	loadKnownCVEs()
+	commitPipeline = NewCommitPipeline(stageProcs(metadataProcs), stageProcs(blameProcs), stageProcs(persistProcs))
+	commitPipeline.Start()
+
+	if retryFailed {
+		JobQueue = nil
+		commitsSelect = "failed"
+		HandleSignals()
+		if err := RetryFailed(); err != nil {
+			log.Error(err)
+		}
+		return
+	}
 	if onlyOneRepo != "" {
-		handleRepo(onlyOneRepo)
+		HandleSignals()
+		if _, ok := JobQueue.(redisQueue); ok {
+			MarkAsWorking(onlyOneRepo, processname)
+		}
+		if err := handleRepo(onlyOneRepo); err != nil {
+			log.Error(err)
+		}
 		return
 	}
 
-	// main loop
-	for {
-		switch reponame, err := GetNextRepo(); err {
+	if JobQueue == nil {
+		log.Fatal("Nothing to do without redis or a coordinator, use -repo to update a single repository")
+	}
+	HandleSignals()
+
+	var wg sync.WaitGroup
+	for i := 0; i < repoProcs; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			repoWorker()
+		}()
+	}
+	wg.Wait()
+	log.Warn("Shut down")
+}
+
+// repoWorker claims and handles repositories until the queue is empty or the
+// process shuts down
+func repoWorker() {
+	for !ShuttingDown() {
+		if requeued, dead, err := JobQueue.Reap(); err != nil {
+			log.Errorf("Reaping expired leases: %v", err)
+		} else {
+			if len(requeued) > 0 {
+				log.Warnf("Returned %v to the queue, their workers stopped sending heartbeats", requeued)
+			}
+			if len(dead) > 0 {
+				log.Errorf("Gave up on %v after %d attempts", dead, MaxAttempts)
+			}
+		}
+		switch reponame, err := JobQueue.Next(processname); err {
 		case nil:
-			handleRepo(reponame)
+			if err := handleRepo(reponame); err != nil {
+				log.Error(err)
+			}
 		case ErrNil:
 			log.Info("No repositories left")
 			return
 		default:
 			log.Errorf("Error getting repo: %v", err)
+			time.Sleep(5 * time.Second)
 		}
 	}
 }
 
-func handleRepo(reponame string) {
-	log.Infof("Starting %s", reponame)
-	if !skipRedis {
-		MarkAsWorking(reponame, processname)
+func loadKnownCVEs() {
+	log.Debugln("gathering known CVEs")
+	KnownCVEs = NewMitreCves()
+	if err := KnownCVEs.Read(cveFile); err != nil {
+		log.Fatal(err)
 	}
+}
 
-	var (
-		err        error
-		commitRows *sql.Rows
-		wg         sync.WaitGroup
-	)
+func runAnalyze() error {
+	out := os.Stdout
+	if analyzeOutput != "" {
+		f, err := os.Create(analyzeOutput)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	}
+	loadKnownCVEs()
+	return Analyze(analyzePath, analyzeRange, out)
+}
 
-	commitSem := make(chan int, commitProcs)
-	commitPool := &sync.Pool{New: func() interface{} { return new(Commit) }}
+// handleRepo updates a repository and its commits, or only the commits of one
+// chunk of it (see chunkSize). Unless redis is skipped, the job is marked as
+// done afterwards, or returned to the queue if handleRepo fails.
+func handleRepo(job string) (err error) {
+	log.Infof("Starting %s", job)
+	status.Start(job)
+	defer func() { status.Finish(job, err) }()
 
-	log.Debugf("repository %s: querying db", reponame)
-	r, err := NewRepositoryFromDB(reponame)
-	if err != nil {
-		log.Errorf("retrieving %s: %v", reponame, err)
-		if skipRedis {
-			return
-		}
-		ReturnRepo(reponame)
+	// subprocesses of commits still running when handleRepo gives up, or
+	// loses the lease on the job, are killed
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if JobQueue != nil {
+		var leaseLost int32
+		stopHeartbeat := startHeartbeat(JobQueue, job, processname, func() {
+			atomic.StoreInt32(&leaseLost, 1)
+			cancel()
+		})
+		defer func() {
+			stopHeartbeat()
+			if atomic.LoadInt32(&leaseLost) == 1 {
+				err = ErrLeaseLost
+			}
+			switch err {
+			case nil:
+				if e := JobQueue.Done(job, processname); e != nil {
+					log.Errorf("Marking %s as done: %v", job, e)
+				}
+				return
+			case ErrShutdown:
+				// not the repository's fault, don't count the attempt
+				if e := JobQueue.Release(job, processname); e != nil {
+					log.Errorf("Releasing %s: %v", job, e)
+				}
+				return
+			case ErrLeaseLost:
+				// another worker has the job now
+				return
+			}
+			if dead, e := JobQueue.Fail(job, processname, err); e != nil {
+				log.Errorf("Returning %s: %v", job, e)
+			} else if dead {
+				log.Errorf("Gave up on %s after %d attempts", job, MaxAttempts)
+			}
+		}()
 	}
+	reponame, isChunk := ParseJob(job)
+	var wg sync.WaitGroup
 
-	// update repository
-	log.Debugf("repository %s: updating", r.Name)
-	if err := r.Update(); err != nil {
-		log.Errorf("Updating %s: %v", r.String(), err)
+	// the per-repository limit is taken first, so that a repository waiting
+	// for it does not hold a slot in the pipeline
+	repoSem := make(chan int, repoCommitProcs)
+	if repoCommitProcs <= 0 {
+		repoSem = nil
 	}
-	defer RemoveFromRamdisk(r)
-	log.Debugf("%s: saved", r.Name)
 
-	if onlyOneCommit != "" {
-		commitRows, err = DB.Db.Query("SELECT id, sha, type, coalesce(length(patch), 0), coalesce(length(message)) FROM unstable.commits WHERE sha = $2 and repository_id = $1", r.Id, onlyOneCommit)
+	log.Debugf("repository %s: querying db", reponame)
+	r, err := DataStore.Repository(reponame)
+	if err != nil {
+		return fmt.Errorf("retrieving %s: %v", reponame, err)
+	}
+
+	// the copy on the ramdisk is removed only after the subprocesses of
+	// commits still running are killed and the commits have finished
+	defer func() {
+		cancel()
+		wg.Wait()
+		RemoveFromRamdisk(r)
+	}()
+	var selected []selectedCommit
+	if isChunk {
+		// the job that split the repository already added the commits
+		if JobQueue == nil {
+			return fmt.Errorf("%s: chunks need redis or a coordinator", job)
+		}
+		log.Debugf("repository %s: fetching", r.Name)
+		if err := r.Fetch(ctx); err != nil {
+			return fmt.Errorf("fetching %s: %v", r.String(), err)
+		}
+		ids, err := JobQueue.ChunkCommits(job, processname)
+		if err != nil {
+			return err
+		}
+		if selected, err = selectCommitsById(r, ids); err != nil {
+			return fmt.Errorf("retrieving commits for %s: %v", job, err)
+		}
 	} else {
-		q := "SELECT id, sha, type, coalesce(length(patch), 0), coalesce(length(message)) FROM unstable.commits WHERE repository_id = $1"
-		switch commitsSelect {
-		case "all":
-			q += ""
-		case "blamed":
-			q += " and (type = 'blamed_commit')"
-		case "cves": // all commits that mention 'CVE'
-			q += " and (message like '%CVE-____%' and type = 'other_commit')"
-		case "stable": // all commits that would be in stable
-			q += " and (hunk_count <> 0 and patch != '' and message != '' and future_changes <> 0 and id in (select commit_id from unstable.functions))"
-		case "empty":
-			q += " and (future_changes = 0 or additions = 0 or hunk_count = 0 or patch = '' or message = '' or (type = 'fixing_commit' and blamed_commit_id is null))"
-		case "fixing":
-			shas := KnownCVEs.Shas()
-			for i, s := range shas {
-				shas[i] = "'" + s + "'"
-			}
-			q += " and hunk_count = 0 and ( type = 'fixing_commit' or type = 'blamed_commit' or sha IN (" + strings.Join(shas, ", ") + ") )"
-		default:
-			log.Fatalf("invalid flag:", commitsSelect)
+		// update repository
+		log.Debugf("repository %s: updating", r.Name)
+		if err := r.Update(ctx); err != nil {
+			return fmt.Errorf("updating %s: %v", r.String(), err)
 		}
-		commitRows, err = DB.Db.Query(q, r.Id)
-	}
-	if err != nil {
-		log.Errorf("retrieving commits for %s: %v", reponame, err)
-		if skipRedis {
+		log.Debugf("%s: saved", r.Name)
+
+		if selected, err = selectCommits(r); err != nil {
+			return fmt.Errorf("retrieving commits for %s: %v", reponame, err)
+		}
+		if JobQueue != nil && chunkSize > 0 && len(selected) > chunkSize {
+			// leave the commits to whoever claims the chunks
+			_, err = JobQueue.Split(reponame, processname, commitIds(selected))
 			return
 		}
-		ReturnRepo(reponame)
 	}
-	defer commitRows.Close()
-	for commitRows.Next() {
+	status.SetTotal(job, len(selected))
+	interrupted := false
+scheduling:
+	for _, sel := range selected {
+		if ctx.Err() != nil {
+			break scheduling
+		}
 		// update commits
-		commitSem <- 1
+		if repoSem != nil {
+			select {
+			case repoSem <- 1:
+			case <-shutdown:
+				interrupted = true
+				break scheduling
+			}
+		}
 		wg.Add(1)
 		commit := commitPool.Get().(*Commit)
 		commit.Clear()
-		commitRows.Scan(&commit.Id, &commit.Sha, &commit.Type, &commit.PatchLengthFromDB, &commit.MessageLengthFromDB)
+		commit.Id, commit.Sha, commit.Type = sel.Id, sel.Sha, sel.Type
+		commit.PatchLengthFromDB, commit.MessageLengthFromDB = sel.PatchLength, sel.MessageLength
+		commit.Repository = r
+		commit.RepositoryId = r.Id
 
-		go func(commit *Commit, r *Repository) {
-			defer wg.Done()
-			defer commitPool.Put(commit)
-			defer func() { <-commitSem }()
-			defer func() {
-				if e := recover(); e != nil {
-					log.Errorf("Go routine crashed for %+v: %v", commit.Repository, e)
+		cj := &commitJob{ctx: ctx, commit: commit, done: func(c *Commit) {
+			// after losing the lease, the commit belongs to the new worker
+			if ctx.Err() == nil {
+				if err := DataStore.SaveFailures(c); err != nil {
+					log.Errorf("saving failures of %v: %v", c, err)
 				}
-			}()
-			commit.Repository = r
-			if err := commit.Update(); err != nil {
-				log.Warnf("updating %v: %v", commit, err)
 			}
-		}(commit, r)
+			status.CommitDone(job, len(c.Failures) > 0)
+			commitPool.Put(c)
+			if repoSem != nil {
+				<-repoSem
+			}
+			wg.Done()
+		}}
+		if !commitPipeline.Submit(cj, shutdown) {
+			commitPool.Put(commit)
+			if repoSem != nil {
+				<-repoSem
+			}
+			wg.Done()
+			interrupted = true
+			break scheduling
+		}
 	}
-	if err := commitRows.Err(); err != nil {
+	if !drain(&wg, shutdown, shutdownTimeout) {
+		log.Errorf("%s: commits still running after %v, giving up", job, shutdownTimeout)
+		return ErrShutdown
+	}
+	if interrupted {
+		log.Warnf("%s: stopped before all commits were updated", job)
+		return ErrShutdown
+	}
+
+	log.Infof("Finished %s", job)
+	return nil
+}
+
+// selectedCommit is what handleRepo needs to know about a commit to update it
+type selectedCommit struct {
+	Id            int64
+	Sha           string
+	Type          string
+	PatchLength   int
+	MessageLength int
+}
+
+// selectCommits reads the selected commits up front, so that the total is known
+func selectCommits(r *Repository) ([]selectedCommit, error) {
+	return scanSelectedCommits(DataStore.SelectCommits(r, commitsSelect, onlyOneCommit))
+}
+
+func selectCommitsById(r *Repository, ids []int64) ([]selectedCommit, error) {
+	return scanSelectedCommits(DataStore.SelectCommitsById(r, ids))
+}
+
+func scanSelectedCommits(rows *sql.Rows, err error) (selected []selectedCommit, _ error) {
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var c selectedCommit
+		if err = rows.Scan(&c.Id, &c.Sha, &c.Type, &c.PatchLength, &c.MessageLength); err != nil {
+			return nil, err
+		}
+		selected = append(selected, c)
+	}
+	if err = rows.Err(); err != nil {
 		log.Errorf("scan done: %v", err)
-		ReopenDB()
+		DataStore.Reopen()
 	}
-	wg.Wait()
+	return selected, err
+}
 
-	if !skipRedis {
-		MarkAsDone(reponame)
+func commitIds(selected []selectedCommit) []int64 {
+	ids := make([]int64, len(selected))
+	for i, c := range selected {
+		ids[i] = c.Id
 	}
-	log.Infof("Finished %s", reponame)
+	return ids
 }
@@ -5,7 +5,7 @@ import (
 	"regexp"
 )
 
-var isCodeFileRe = regexp.MustCompile(`^.*\.(fort|c|c\+\+|cpp|h|hpp|h|py|sh|pl|cs\+\+|hh)$`)
+var isCodeFileRe = regexp.MustCompile(`^.*\.(fort|c|c\+\+|cpp|h|hpp|h|py|sh|pl|cs\+\+|hh|cc|cxx|hxx|m|mm)$`)
 
 // Determines whether the file contains code based on a simple regular expression.
 func IsCodeFile(file string) bool {
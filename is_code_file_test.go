@@ -9,6 +9,9 @@ func TestIsCodeFile(t *testing.T) {
 		"apache2/apache2_config.c",
 		"apache2/msc_remote_rules.h",
 		"a/b/c/d/e.fort",
+		"src/widget.cc",
+		"Classes/AppDelegate.m",
+		"Classes/Bridge.mm",
 	}
 	docPaths := []string{
 		"README",
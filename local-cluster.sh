@@ -0,0 +1,40 @@
+#!/bin/bash
+# Runs a coordinator and WORKERS local worker processes against a local redis
+# and a shared sqlite database, e.g.
+#
+#   ./github-data -store=sqlite -add-repo=madler/zlib
+#   WORKERS=3 ./local-cluster.sh -commits-select=all
+#
+# Extra arguments are passed to the coordinator and every worker. Ctrl-C stops
+# the workers gracefully, their repositories go back to the queue.
+
+WORKERS=${WORKERS:-2}
+PORT=${PORT:-8080}
+REDIS_PORT=${REDIS_PORT:-6379}
+DB=${DB:-github-data.db}
+
+go build || exit 1
+mkdir -p log
+
+if ! redis-cli -p $REDIS_PORT ping >/dev/null 2>&1; then
+	redis-server --port $REDIS_PORT --save "" --daemonize yes
+fi
+
+COMMON="-store=sqlite -sqlite=$DB -redis=localhost:$REDIS_PORT -log-level=info"
+
+./github-data $COMMON -log=log/coordinator.log -init-redis -coordinator-listen=:$PORT "$@" &
+COORDINATOR=$!
+sleep 1
+
+for i in $(seq 1 $WORKERS); do
+	./github-data $COMMON -log=log/worker-$i.log -name=local-$i \
+		-coordinator=http://localhost:$PORT -http=:$((PORT + i)) "$@" &
+	WORKER_PIDS="$WORKER_PIDS $!"
+done
+
+trap 'kill -TERM $WORKER_PIDS $COORDINATOR 2>/dev/null' INT TERM
+echo "coordinator on :$PORT, workers report /status on :$((PORT + 1))-:$((PORT + WORKERS))"
+# workers quit once the queue is empty
+wait $WORKER_PIDS
+kill -TERM $COORDINATOR
+wait
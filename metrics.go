@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/libgit2/git2go"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"tools.net.cs.uni-bonn.de/social-aspects-of-vulnerabilities/github-data/proc"
+	"tools.net.cs.uni-bonn.de/social-aspects-of-vulnerabilities/github-data/tools"
+)
+
+var httpAddress string
+
+var (
+	stageDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "github_data_stage_duration_seconds",
+		Help:    "Latency of the stages of a commit update",
+		Buckets: prometheus.ExponentialBuckets(0.001, 4, 10),
+	}, []string{"stage"})
+	stageErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "github_data_stage_errors_total",
+		Help: "Failed calls of the stages of a commit update",
+	}, []string{"stage"})
+	stageTimeouts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "github_data_stage_timeouts_total",
+		Help: "Calls of the stages of a commit update whose subprocess timed out",
+	}, []string{"stage"})
+	commitsUpdated = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "github_data_commits_total",
+		Help: "Updated commits by result (ok or failed)",
+	}, []string{"result"})
+	reposHandled = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "github_data_repositories_total",
+		Help: "Handled repositories by result (ok or failed)",
+	}, []string{"result"})
+	parserRestarts = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "github_data_parser_restarts_total",
+		Help: "Parse helpers killed after a crash or timeout",
+	})
+	blameCacheHits = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "github_data_blame_cache_hits_total",
+		Help: "Blames of a file shared with an earlier commit",
+	})
+	pipelineWorkers = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "github_data_pipeline_workers",
+		Help: "Configured goroutines per pipeline stage",
+	}, []string{"stage"})
+	pipelineBusy = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "github_data_pipeline_busy",
+		Help: "Goroutines per pipeline stage working on a commit",
+	}, []string{"stage"})
+	pipelineQueued = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "github_data_pipeline_queued",
+		Help: "Commits waiting for a pipeline stage",
+	}, []string{"stage"})
+)
+
+func init() {
+	prometheus.MustRegister(stageDuration, stageErrors, stageTimeouts, commitsUpdated, reposHandled,
+		parserRestarts, blameCacheHits, pipelineWorkers, pipelineBusy, pipelineQueued)
+}
+
+// observe records the latency and the outcome of a stage, to be deferred as
+//
+//	defer observe("NewBlame", time.Now(), &err)
+func observe(stage string, start time.Time, err *error) {
+	stageDuration.WithLabelValues(stage).Observe(time.Since(start).Seconds())
+	if err != nil && *err != nil {
+		stageErrors.WithLabelValues(stage).Inc()
+		if proc.IsTimeout(*err) {
+			stageTimeouts.WithLabelValues(stage).Inc()
+		}
+	}
+}
+
+func result(failed bool) string {
+	if failed {
+		return "failed"
+	}
+	return "ok"
+}
+
+// toolAnalyze runs an analysis tool and records its latency
+func toolAnalyze(ctx context.Context, t *tools.Tool, repo *git.Repository, file *git.DiffFile) (res []tools.Result, err error) {
+	defer observe("Tool.Analyze", time.Now(), &err)
+	return t.Analyze(ctx, repo, file)
+}
+
+// observedStore records the latency of the database writes
+type observedStore struct {
+	Store
+}
+
+func (s observedStore) InsertCommit(c *Commit) (err error) {
+	defer observe("db.InsertCommit", time.Now(), &err)
+	return s.Store.InsertCommit(c)
+}
+
+func (s observedStore) UpdateCommitColumns(c *Commit, cols ...string) (err error) {
+	defer observe("db.UpdateCommitColumns", time.Now(), &err)
+	return s.Store.UpdateCommitColumns(c, cols...)
+}
+
+func (s observedStore) MarkBlamedCommit(sha string) (id sql.NullInt64, err error) {
+	defer observe("db.MarkBlamedCommit", time.Now(), &err)
+	return s.Store.MarkBlamedCommit(sha)
+}
+
+func (s observedStore) SaveFunctions(c *Commit) (err error) {
+	defer observe("db.SaveFunctions", time.Now(), &err)
+	return s.Store.SaveFunctions(c)
+}
+
+func (s observedStore) SaveBlameCandidates(c *Commit) (err error) {
+	defer observe("db.SaveBlameCandidates", time.Now(), &err)
+	return s.Store.SaveBlameCandidates(c)
+}
+
+func (s observedStore) SaveDeclaredBlames(c *Commit) (err error) {
+	defer observe("db.SaveDeclaredBlames", time.Now(), &err)
+	return s.Store.SaveDeclaredBlames(c)
+}
+
+func (s observedStore) SaveParsedFiles(c *Commit) (err error) {
+	defer observe("db.SaveParsedFiles", time.Now(), &err)
+	return s.Store.SaveParsedFiles(c)
+}
+
+func (s observedStore) SaveToolResults(c *Commit) (err error) {
+	defer observe("db.SaveToolResults", time.Now(), &err)
+	return s.Store.SaveToolResults(c)
+}
+
+func (s observedStore) SaveFailures(c *Commit) (err error) {
+	defer observe("db.SaveFailures", time.Now(), &err)
+	return s.Store.SaveFailures(c)
+}
+
+// RepoProgress is the progress of a repository in /status
+type RepoProgress struct {
+	Name       string        `json:"name"`
+	Started    time.Time     `json:"started"`
+	Total      int           `json:"commits_total"`
+	Done       int           `json:"commits_done"`
+	Failed     int           `json:"commits_failed"`
+	ETA        time.Duration `json:"-"`
+	ETASeconds float64       `json:"eta_seconds"`
+
+	commitsStarted time.Time
+}
+
+// Status is served as JSON on /status
+type Status struct {
+	Worker       string          `json:"worker"`
+	Started      time.Time       `json:"started"`
+	ShuttingDown bool            `json:"shutting_down"`
+	Repositories []*RepoProgress `json:"repositories"`
+}
+
+type statusTracker struct {
+	sync.Mutex
+	started time.Time
+	repos   map[string]*RepoProgress
+}
+
+var status = &statusTracker{started: time.Now(), repos: make(map[string]*RepoProgress)}
+
+func (s *statusTracker) Start(reponame string) {
+	s.Lock()
+	defer s.Unlock()
+	s.repos[reponame] = &RepoProgress{Name: reponame, Started: time.Now()}
+}
+
+func (s *statusTracker) SetTotal(reponame string, total int) {
+	s.Lock()
+	defer s.Unlock()
+	if p, ok := s.repos[reponame]; ok {
+		p.Total = total
+		p.commitsStarted = time.Now()
+	}
+}
+
+func (s *statusTracker) CommitDone(reponame string, failed bool) {
+	commitsUpdated.WithLabelValues(result(failed)).Inc()
+	s.Lock()
+	defer s.Unlock()
+	if p, ok := s.repos[reponame]; ok {
+		p.Done++
+		if failed {
+			p.Failed++
+		}
+	}
+}
+
+func (s *statusTracker) Finish(reponame string, err error) {
+	reposHandled.WithLabelValues(result(err != nil)).Inc()
+	s.Lock()
+	defer s.Unlock()
+	delete(s.repos, reponame)
+}
+
+// Status returns a snapshot, the ETA extrapolates the time per commit so far
+func (s *statusTracker) Status() *Status {
+	s.Lock()
+	defer s.Unlock()
+	st := &Status{Worker: processname, Started: s.started, ShuttingDown: ShuttingDown()}
+	for _, p := range s.repos {
+		cp := *p
+		if cp.Done > 0 && cp.Total > cp.Done {
+			perCommit := time.Since(cp.commitsStarted) / time.Duration(cp.Done)
+			cp.ETA = perCommit * time.Duration(cp.Total-cp.Done)
+			cp.ETASeconds = cp.ETA.Seconds()
+		}
+		st.Repositories = append(st.Repositories, &cp)
+	}
+	sort.Slice(st.Repositories, func(i, j int) bool { return st.Repositories[i].Name < st.Repositories[j].Name })
+	return st
+}
+
+func (s *statusTracker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(s.Status()); err != nil {
+		log.Warnf("writing status: %v", err)
+	}
+}
+
+// ServeStatus serves /status and /metrics on addr
+func ServeStatus(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/status", status)
+	mux.Handle("/metrics", promhttp.Handler())
+	log.Infof("Serving status on %s", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		log.Errorf("status server: %v", err)
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestStatus(t *testing.T) {
+	s := &statusTracker{repos: make(map[string]*RepoProgress)}
+	s.Start("foo/bar")
+	s.SetTotal("foo/bar", 4)
+	s.CommitDone("foo/bar", false)
+	s.CommitDone("foo/bar", true)
+
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest("GET", "/status", nil))
+	var st Status
+	handleErr(t, json.NewDecoder(rec.Body).Decode(&st))
+	if len(st.Repositories) != 1 {
+		t.Fatalf("expected 1 repository, got %+v", st)
+	}
+	p := st.Repositories[0]
+	if p.Name != "foo/bar" || p.Total != 4 || p.Done != 2 || p.Failed != 1 {
+		t.Errorf("unexpected progress %+v", p)
+	}
+	if p.ETASeconds <= 0 {
+		t.Errorf("expected an ETA, got %v", p.ETASeconds)
+	}
+
+	s.Finish("foo/bar", nil)
+	if st := s.Status(); len(st.Repositories) != 0 {
+		t.Errorf("expected no repositories after finish, got %+v", st.Repositories)
+	}
+}
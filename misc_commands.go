@@ -3,11 +3,16 @@ package main
 import (
 	"database/sql"
 	"fmt"
+	"os"
 )
 
 func SelfTest() {
 	var err error
 
+	fmt.Println("Configuration:")
+	PrintConfig(os.Stdout)
+	fmt.Println()
+
 	fmt.Print("Testing redis ...  ")
 	if err = Selftest(); err != nil {
 		panic(err)
@@ -15,7 +20,7 @@ func SelfTest() {
 	fmt.Print("WORKS\n")
 
 	fmt.Print("Testing db ...     ")
-	if _, err = DB.Exec("SELECT count(*) FROM repositories"); err != nil {
+	if _, err = DataStore.RepositoryNames(); err != nil {
 		panic(err)
 	}
 	fmt.Print("WORKS\n")
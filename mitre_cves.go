@@ -3,7 +3,9 @@ package main
 import (
 	"bytes"
 	"encoding/xml"
+	"io/ioutil"
 	"regexp"
+	"time"
 
 	"code.google.com/p/go-charset/charset"
 	_ "code.google.com/p/go-charset/data"
@@ -40,16 +42,39 @@ type Result struct {
 }
 
 type Vulnerability struct {
-	CVE  string   `xml:"CVE"`
-	URLs []string `xml:"References>Reference>URL"`
+	CVE   string              `xml:"CVE"`
+	URLs  []string            `xml:"References>Reference>URL"`
+	Notes []VulnerabilityNote `xml:"Notes>Note"`
+}
+
+// VulnerabilityNote is a note of a CVRF vulnerability, like its description
+// or the dates it was published and modified
+type VulnerabilityNote struct {
+	Title string `xml:"Title,attr"`
+	Text  string `xml:",chardata"`
+}
+
+// Published returns the day the vulnerability was published
+func (v *Vulnerability) Published() (time.Time, bool) {
+	for _, note := range v.Notes {
+		if note.Title == "Published" {
+			t, err := time.Parse("2006-01-02", note.Text)
+			return t, err == nil
+		}
+	}
+	return time.Time{}, false
 }
 
 type MitreCves struct {
-	data map[string](map[string]string) // map[repo][commit] = cve id
+	data      map[string](map[string]string) // map[repo][commit] = cve id
+	published map[string]time.Time           // by cve id
 }
 
 func NewMitreCves() *MitreCves {
-	return &MitreCves{data: make(map[string](map[string]string))}
+	return &MitreCves{
+		data:      make(map[string](map[string]string)),
+		published: make(map[string]time.Time),
+	}
 }
 
 func (mc *MitreCves) Read(fname string) (err error) {
@@ -58,7 +83,7 @@ func (mc *MitreCves) Read(fname string) (err error) {
 	gitRe := regexp.MustCompile(`^https?://.+/\?p=(.+).git;a=commit;h=(\w+)$`)
 	linuxRe := regexp.MustCompile(`^linux/kernel`)
 
-	file, err := Asset(fname)
+	file, err := ReadCveFile(fname)
 	if err != nil {
 		return
 	}
@@ -71,6 +96,9 @@ func (mc *MitreCves) Read(fname string) (err error) {
 
 	// look for github urls in the vulnerabilites
 	for _, vuln := range res.Vulnerabilities {
+		if published, ok := vuln.Published(); ok {
+			mc.published[vuln.CVE] = published
+		}
 		for _, url := range vuln.URLs {
 			var repo, sha string
 
@@ -105,6 +133,14 @@ func (mc *MitreCves) Read(fname string) (err error) {
 	return nil
 }
 
+// ReadCveFile reads a CVE feed from disk, falling back to the embedded copy
+func ReadCveFile(fname string) ([]byte, error) {
+	if file, err := ioutil.ReadFile(fname); err == nil {
+		return file, nil
+	}
+	return Asset(fname)
+}
+
 func (mc *MitreCves) Lookup(repo, sha string) (val string, ok bool) {
 	// if repo doesn't exist return false
 	if _, ok = mc.data[repo]; !ok {
@@ -117,6 +153,17 @@ func (mc *MitreCves) Lookup(repo, sha string) (val string, ok bool) {
 	return
 }
 
+// Published returns the day the first of the CVEs in cves (like the CVE field
+// of a commit) was published
+func (mc *MitreCves) Published(cves string) (first time.Time, ok bool) {
+	for _, cve := range CvePattern.FindAllString(cves, -1) {
+		if published, found := mc.published[cve]; found && (!ok || published.Before(first)) {
+			first, ok = published, true
+		}
+	}
+	return
+}
+
 func (mc *MitreCves) LookupCommit(c *Commit) (val string, ok bool) {
 	return mc.Lookup(c.Repository.Name, c.Sha)
 }
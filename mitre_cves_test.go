@@ -3,6 +3,7 @@ package main
 import (
 	"log"
 	"testing"
+	"time"
 )
 
 type td struct {
@@ -36,3 +37,22 @@ func TestMitreCveCommit(t *testing.T) {
 		}
 	}
 }
+
+func TestMitreCvePublished(t *testing.T) {
+	cves := NewMitreCves()
+	if err := cves.Read("data/cve.xml"); err != nil {
+		t.Fatal(err)
+	}
+	published, ok := cves.Published("CVE-2014-3568")
+	if !ok || published.Format("2006-01-02") != "2014-10-18" {
+		t.Errorf("expected CVE-2014-3568 to be published on 2014-10-18, got %v %v", published, ok)
+	}
+	// the first of several CVEs counts, unknown ones are skipped
+	first, ok := cves.Published("CVE-2014-3568, CVE-2014-0160, CVE-1999-99999")
+	if !ok || first.After(published) || first.Before(time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("expected the first publication in 2014, got %v %v", first, ok)
+	}
+	if _, ok := cves.Published("CVE-1999-99999"); ok {
+		t.Error("expected no publication date of an unknown CVE")
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"time"
+
+	"github.com/libgit2/git2go"
+
+	"tools.net.cs.uni-bonn.de/social-aspects-of-vulnerabilities/github-data/proc"
+)
+
+// libclang can crash or hang on odd input. With -parser-procs > 0 functions
+// are extracted by long-lived helper processes (this binary started with
+// -parse-helper), which read one JSON request per line from stdin and write
+// one JSON response per line to fd 3, since libclang prints to stdout. A
+// helper that crashes or exceeds -parse-timeout is killed and restarted for
+// the next file, the file is recorded as parse_failed.
+var (
+	parseHelper  bool
+	parserProcs  = runtime.NumCPU()
+	parseTimeout = time.Minute
+	parsers      *ParserPool
+)
+
+// Outcomes of a ParsedFile
+const (
+	ParseOK     = "parsed"
+	ParseFailed = "parse_failed"
+)
+
+// ParsedFile records whether the functions of a file version (Oid) could be
+// extracted
+type ParsedFile struct {
+	Id          int64  `json:"-" db:"id"`
+	CommitId    int64  `json:"-" db:"commit_id"`
+	FileName    string `json:"file_name" db:"file_name"`
+	Oid         string `json:"oid" db:"oid"`
+	Status      string `json:"status" db:"status"`
+	Error       string `json:"error,omitempty" db:"error"`
+	Diagnostics int    `json:"diagnostics" db:"diagnostics"` // warnings and errors of libclang
+	Errors      int    `json:"errors" db:"errors"`
+}
+
+type parseRequest struct {
+	File     string   `json:"file"`
+	Contents string   `json:"contents"`
+	Args     []string `json:"args,omitempty"`
+}
+
+type parseResponse struct {
+	Functions   []*Function `json:"functions"`
+	Diagnostics int         `json:"diagnostics"`
+	Errors      int         `json:"errors"`
+	Error       string      `json:"error,omitempty"`
+}
+
+// RunParseHelper answers parse requests from in on out until in is closed
+func RunParseHelper(in io.Reader, out io.Writer) error {
+	dec := json.NewDecoder(in)
+	enc := json.NewEncoder(out)
+	for {
+		var req parseRequest
+		if err := dec.Decode(&req); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		var res parseResponse
+		fs, err := functionsForFilename(req.File, map[string]string{req.File: req.Contents}, req.Args...)
+		if err != nil {
+			res.Error = err.Error()
+		} else {
+			res.Functions, res.Diagnostics, res.Errors = fs.Functions(), fs.Diagnostics, fs.Errors
+		}
+		if err := enc.Encode(&res); err != nil {
+			return err
+		}
+	}
+}
+
+// functionsForFile extracts the functions of a file with the flags of the
+// repository and records whether it could be parsed
+func (c *Commit) functionsForFile(ctx context.Context, repo *git.Repository, file *git.DiffFile) (*Functions, error) {
+	fs, err := FunctionsForFile(ctx, repo, file, c.Repository.ClangArgs(file.Path)...)
+	pf := ParsedFile{CommitId: c.Id, FileName: file.Path, Oid: file.Oid.String(), Status: ParseOK}
+	if err != nil {
+		pf.Status, pf.Error = ParseFailed, err.Error()
+	} else {
+		pf.Diagnostics, pf.Errors = fs.Diagnostics, fs.Errors
+	}
+	c.ParsedFiles = append(c.ParsedFiles, pf)
+	return fs, err
+}
+
+// ParserPool hands files to a fixed number of helper processes
+type ParserPool struct {
+	command []string
+	timeout time.Duration
+	idle    chan *parser
+}
+
+// NewParserPool returns a pool of n helpers running command, they are
+// started on first use
+func NewParserPool(n int, timeout time.Duration, command ...string) *ParserPool {
+	p := &ParserPool{command: command, timeout: timeout, idle: make(chan *parser, n)}
+	for i := 0; i < n; i++ {
+		p.idle <- new(parser)
+	}
+	return p
+}
+
+// Parse returns the functions of a file. If the helper crashes, times out or
+// ctx is done, the helper is killed and an error returned.
+func (p *ParserPool) Parse(ctx context.Context, fname string, contents []byte, args []string) (*Functions, error) {
+	var h *parser
+	select {
+	case h = <-p.idle:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	defer func() { p.idle <- h }()
+
+	if h.cmd == nil {
+		if err := h.start(p.command); err != nil {
+			return nil, fmt.Errorf("starting parse helper: %v", err)
+		}
+	}
+	parent := ctx
+	if p.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.timeout)
+		defer cancel()
+	}
+
+	var res parseResponse
+	done := make(chan error, 1)
+	go func() {
+		if err := h.enc.Encode(&parseRequest{File: fname, Contents: string(contents), Args: args}); err != nil {
+			done <- err
+			return
+		}
+		done <- h.dec.Decode(&res)
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			werr := h.stop()
+			parserRestarts.Inc()
+			return nil, fmt.Errorf("parse helper crashed on %s (%v): %s", fname, werr, h.stderr)
+		}
+	case <-ctx.Done():
+		h.cmd.Kill()
+		<-done
+		h.stop()
+		parserRestarts.Inc()
+		if parent.Err() == nil {
+			return nil, &proc.TimeoutError{Cmd: "parsing " + fname, Timeout: p.timeout}
+		}
+		return nil, parent.Err()
+	}
+	if res.Error != "" {
+		return nil, errors.New(res.Error)
+	}
+	fs := NewFunctions()
+	for _, f := range res.Functions {
+		fs.Add(f)
+	}
+	fs.Diagnostics, fs.Errors = res.Diagnostics, res.Errors
+	return fs, nil
+}
+
+// parser is a helper process, started on first use and after it was killed
+type parser struct {
+	cmd       *proc.Cmd
+	enc       *json.Encoder
+	dec       *json.Decoder
+	responses *os.File
+	stderr    *tailBuffer
+}
+
+func (h *parser) start(command []string) error {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	cmd := proc.Command(context.Background(), 0, command[0], command[1:]...)
+	cmd.ExtraFiles = []*os.File{w}
+	h.stderr = &tailBuffer{max: 4096}
+	cmd.Stdout, cmd.Stderr = h.stderr, h.stderr
+	stdin, err := cmd.StdinPipe()
+	if err == nil {
+		err = cmd.Start()
+	}
+	w.Close()
+	if err != nil {
+		r.Close()
+		return err
+	}
+	h.cmd, h.responses = cmd, r
+	h.enc, h.dec = json.NewEncoder(stdin), json.NewDecoder(r)
+	return nil
+}
+
+// stop kills the helper and returns how it exited
+func (h *parser) stop() error {
+	h.cmd.Kill()
+	err := h.cmd.Wait()
+	h.responses.Close()
+	h.cmd = nil
+	return err
+}
+
+// tailBuffer keeps the last max bytes written to it
+type tailBuffer struct {
+	buf []byte
+	max int
+}
+
+func (t *tailBuffer) Write(b []byte) (int, error) {
+	t.buf = append(t.buf, b...)
+	if len(t.buf) > t.max {
+		t.buf = t.buf[len(t.buf)-t.max:]
+	}
+	return len(b), nil
+}
+
+func (t *tailBuffer) String() string {
+	return string(t.buf)
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"tools.net.cs.uni-bonn.de/social-aspects-of-vulnerabilities/github-data/proc"
+)
+
+// TestParseHelperProcess is not a test, it is started by TestParserPool as a
+// fake parse helper
+func TestParseHelperProcess(t *testing.T) {
+	if os.Getenv("TEST_PARSE_HELPER") != "1" {
+		return
+	}
+	dec := json.NewDecoder(os.Stdin)
+	enc := json.NewEncoder(os.NewFile(3, "responses"))
+	for {
+		var req parseRequest
+		if err := dec.Decode(&req); err != nil {
+			os.Exit(0)
+		}
+		switch req.Contents {
+		case "crash":
+			fmt.Fprintln(os.Stderr, "segmentation fault")
+			os.Exit(139)
+		case "hang":
+			time.Sleep(time.Minute)
+		}
+		fmt.Println("libclang noise on stdout")
+		enc.Encode(&parseResponse{Functions: []*Function{{Name: req.File, StartLine: 1, EndLine: 3}}})
+	}
+}
+
+func TestParserPool(t *testing.T) {
+	t.Setenv("TEST_PARSE_HELPER", "1")
+	p := NewParserPool(1, 500*time.Millisecond, os.Args[0], "-test.run=TestParseHelperProcess")
+	ctx := context.Background()
+
+	parse := func(fname, contents string) {
+		fs, err := p.Parse(ctx, fname, []byte(contents), nil)
+		if err != nil {
+			t.Fatalf("%s: %v", fname, err)
+		}
+		if _, ok := fs.Named(fname); !ok {
+			t.Errorf("%s: expected a function named after the file, got %v", fname, fs)
+		}
+	}
+
+	parse("a.c", "int a() {}")
+	_, err := p.Parse(ctx, "crash.c", []byte("crash"), nil)
+	if err == nil || !strings.Contains(err.Error(), "segmentation fault") {
+		t.Errorf("expected the crash with the helper's stderr, got %v", err)
+	}
+	parse("b.c", "int b() {}")
+	_, err = p.Parse(ctx, "hang.c", []byte("hang"), nil)
+	if !proc.IsTimeout(err) {
+		t.Errorf("expected a timeout, got %v", err)
+	}
+	parse("c.c", "int c() {}")
+}
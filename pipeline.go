@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Commits are updated in a pipeline of stages, each with its own pool of
+// goroutines: metadata (diff, functions and tools), blame and persist. The
+// stages are connected by channels as large as the next pool, so a slow
+// stage holds back the ones before it. A stage count of 0 uses
+// -commit-threads.
+var (
+	metadataProcs int
+	blameProcs    int
+	persistProcs  int
+
+	commitPipeline *Pipeline
+)
+
+// commitJob is a commit on its way through the pipeline. Once a stage fails
+// or skips the commit, the remaining stages pass it on untouched. done is
+// called after the last stage. Canceling ctx kills the commit's subprocesses.
+type commitJob struct {
+	ctx    context.Context
+	commit *Commit
+	skip   bool
+	done   func(c *Commit)
+}
+
+type pipelineStage struct {
+	name  string
+	procs int
+	run   func(ctx context.Context, c *Commit) (skip bool, err error)
+	in    chan *commitJob
+}
+
+// Pipeline runs commitJobs through its stages in order
+type Pipeline struct {
+	stages []*pipelineStage
+}
+
+// NewCommitPipeline returns the pipeline of Commit.Update with the given
+// number of goroutines per stage
+func NewCommitPipeline(metadata, blame, persist int) *Pipeline {
+	return newPipeline(
+		&pipelineStage{name: StageMetadata, procs: metadata, run: func(ctx context.Context, c *Commit) (bool, error) {
+			return c.updateMetadata(ctx)
+		}},
+		&pipelineStage{name: StageBlame, procs: blame, run: func(ctx context.Context, c *Commit) (bool, error) {
+			return false, c.updateBlame(ctx)
+		}},
+		&pipelineStage{name: StagePersist, procs: persist, run: func(ctx context.Context, c *Commit) (bool, error) {
+			return false, c.persist()
+		}},
+	)
+}
+
+func newPipeline(stages ...*pipelineStage) *Pipeline {
+	for _, s := range stages {
+		s.in = make(chan *commitJob, s.procs)
+	}
+	return &Pipeline{stages: stages}
+}
+
+// Start starts the goroutines of all stages, they run as long as the process
+func (p *Pipeline) Start() {
+	for i, s := range p.stages {
+		var next *pipelineStage
+		if i+1 < len(p.stages) {
+			next = p.stages[i+1]
+		}
+		pipelineWorkers.WithLabelValues(s.name).Set(float64(s.procs))
+		for j := 0; j < s.procs; j++ {
+			go s.work(next)
+		}
+	}
+}
+
+// Submit queues a job for the first stage. It blocks while the stage is full
+// and returns false if stop was closed before the job was taken.
+func (p *Pipeline) Submit(j *commitJob, stop <-chan struct{}) bool {
+	first := p.stages[0]
+	select {
+	case first.in <- j:
+		pipelineQueued.WithLabelValues(first.name).Set(float64(len(first.in)))
+		return true
+	case <-stop:
+		return false
+	}
+}
+
+func (s *pipelineStage) work(next *pipelineStage) {
+	for j := range s.in {
+		pipelineQueued.WithLabelValues(s.name).Set(float64(len(s.in)))
+		if j.ctx.Err() != nil {
+			// handleRepo gave up on the commit
+			j.skip = true
+		}
+		if !j.skip {
+			pipelineBusy.WithLabelValues(s.name).Inc()
+			j.skip = s.process(j.ctx, j.commit)
+			pipelineBusy.WithLabelValues(s.name).Dec()
+		}
+		if next == nil {
+			j.done(j.commit)
+			continue
+		}
+		next.in <- j
+		pipelineQueued.WithLabelValues(next.name).Set(float64(len(next.in)))
+	}
+}
+
+// process runs the stage on a commit and reports whether the remaining stages
+// should skip it. Errors and panics are recorded as failures of the commit.
+func (s *pipelineStage) process(ctx context.Context, c *Commit) (skip bool) {
+	defer func() {
+		if e := recover(); e != nil {
+			log.Errorf("%s crashed for %v: %v", s.name, c, e)
+			c.Fail(c.stage, fmt.Errorf("panic: %v", e), debug.Stack())
+			skip = true
+		}
+	}()
+	skip, err := s.run(ctx, c)
+	if err != nil {
+		log.Warnf("updating %v: %v", c, err)
+		c.Fail(c.stage, err, nil)
+		return true
+	}
+	return skip
+}
+
+// stageProcs returns the number of goroutines of a stage
+func stageProcs(procs int) int {
+	if procs <= 0 {
+		return commitProcs
+	}
+	return procs
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPipeline(t *testing.T) {
+	var (
+		running, maxRunning int32
+		persisted           int32
+	)
+	slow := func(ctx context.Context, c *Commit) (bool, error) {
+		n := atomic.AddInt32(&running, 1)
+		defer atomic.AddInt32(&running, -1)
+		for {
+			max := atomic.LoadInt32(&maxRunning)
+			if n <= max || atomic.CompareAndSwapInt32(&maxRunning, max, n) {
+				break
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+		return false, nil
+	}
+	p := newPipeline(
+		&pipelineStage{name: "first", procs: 4, run: func(ctx context.Context, c *Commit) (bool, error) {
+			c.stage = "first"
+			switch c.Sha {
+			case "fails":
+				return false, errors.New("broken")
+			case "panics":
+				panic("boom")
+			case "large":
+				return true, nil
+			}
+			return false, nil
+		}},
+		&pipelineStage{name: "slow", procs: 2, run: slow},
+		&pipelineStage{name: "last", procs: 1, run: func(ctx context.Context, c *Commit) (bool, error) {
+			atomic.AddInt32(&persisted, 1)
+			return false, nil
+		}},
+	)
+	p.Start()
+
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		done = make(map[string]*Commit)
+	)
+	repo := &Repository{Name: "foo/bar"}
+	shas := []string{"a", "fails", "b", "panics", "c", "large", "d", "e"}
+	for _, sha := range shas {
+		wg.Add(1)
+		j := &commitJob{ctx: context.Background(), commit: &Commit{Sha: sha, Repository: repo}, done: func(c *Commit) {
+			mu.Lock()
+			done[c.Sha] = c
+			mu.Unlock()
+			wg.Done()
+		}}
+		if !p.Submit(j, nil) {
+			t.Fatal("submit without stop should not fail")
+		}
+	}
+	wg.Wait()
+
+	if len(done) != len(shas) {
+		t.Errorf("expected %d commits done, got %d", len(shas), len(done))
+	}
+	if persisted != 5 {
+		t.Errorf("expected 5 commits to reach the last stage, got %d", persisted)
+	}
+	if maxRunning > 2 {
+		t.Errorf("slow stage ran %d commits at once, limit is 2", maxRunning)
+	}
+	for _, sha := range []string{"fails", "panics"} {
+		if f := done[sha].Failures; len(f) != 1 || f[0].Stage != "first" {
+			t.Errorf("%s: expected one failure in the first stage, got %+v", sha, f)
+		}
+	}
+	if f := done["large"].Failures; len(f) != 0 {
+		t.Errorf("skipped commits are no failures, got %+v", f)
+	}
+
+	stop := make(chan struct{})
+	close(stop)
+	blocked := newPipeline(&pipelineStage{name: "blocked", procs: 0})
+	if blocked.Submit(&commitJob{commit: &Commit{}}, stop) {
+		t.Error("submit to a full stage should give up on stop")
+	}
+}
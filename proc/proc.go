@@ -0,0 +1,84 @@
+// Package proc runs external commands under a context. When the context is
+// done or the timeout of the command hits, the whole process group is
+// killed, so children like git's helpers don't outlive the command.
+package proc
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// TimeoutError is returned by Run if the command took longer than its timeout
+type TimeoutError struct {
+	Cmd     string
+	Timeout time.Duration
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("%s: timed out after %v", e.Cmd, e.Timeout)
+}
+
+// IsTimeout reports whether err is a TimeoutError
+func IsTimeout(err error) bool {
+	_, ok := err.(*TimeoutError)
+	return ok
+}
+
+// Cmd is an exec.Cmd bound to a context and a timeout (0: none)
+type Cmd struct {
+	*exec.Cmd
+	Timeout time.Duration
+	ctx     context.Context
+}
+
+// Command returns a Cmd running name with args in its own process group
+func Command(ctx context.Context, timeout time.Duration, name string, args ...string) *Cmd {
+	cmd := exec.Command(name, args...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	return &Cmd{Cmd: cmd, Timeout: timeout, ctx: ctx}
+}
+
+func (c *Cmd) String() string {
+	return strings.Join(c.Args, " ")
+}
+
+// Run starts the command and waits for it. If the context is done first, the
+// process group is killed and the context's error, or a TimeoutError if the
+// timeout hit, is returned.
+func (c *Cmd) Run() error {
+	ctx := c.ctx
+	if c.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Timeout)
+		defer cancel()
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := c.Start(); err != nil {
+		return err
+	}
+	done := make(chan error, 1)
+	go func() { done <- c.Wait() }()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+	}
+	c.Kill()
+	<-done
+	if ctx.Err() == context.DeadlineExceeded && c.Timeout > 0 && c.ctx.Err() == nil {
+		return &TimeoutError{Cmd: c.String(), Timeout: c.Timeout}
+	}
+	return ctx.Err()
+}
+
+// Kill kills the process group of a started command
+func (c *Cmd) Kill() error {
+	return syscall.Kill(-c.Process.Pid, syscall.SIGKILL)
+}
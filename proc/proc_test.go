@@ -0,0 +1,50 @@
+package proc
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRun(t *testing.T) {
+	var out bytes.Buffer
+	cmd := Command(context.Background(), time.Second, "echo", "hello")
+	cmd.Stdout = &out
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "hello\n" {
+		t.Errorf("unexpected output %q", out.String())
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	var out bytes.Buffer
+	// the child keeps stdout open, Run only returns if it is killed as well
+	cmd := Command(context.Background(), 50*time.Millisecond, "sh", "-c", "sleep 10 & sleep 10")
+	cmd.Stdout = &out
+	start := time.Now()
+	err := cmd.Run()
+	if !IsTimeout(err) {
+		t.Fatalf("expected a timeout, got %v", err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("Run returned after %v, children were not killed", d)
+	}
+}
+
+func TestCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+	err := Command(ctx, time.Minute, "sleep", "10").Run()
+	if err != context.Canceled {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+	if err := Command(ctx, 0, "true").Run(); err != context.Canceled {
+		t.Errorf("a done context should not start the command, got %v", err)
+	}
+}
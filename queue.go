@@ -0,0 +1,73 @@
+package main
+
+import (
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Queue hands out jobs (repositories or chunks of them, see ParseJob) to
+// workers. Next returns ErrNil if there is nothing left. The other methods
+// return ErrLeaseLost if the job was given to another worker.
+type Queue interface {
+	Next(worker string) (job string, err error)
+	Renew(job, worker string) error
+	Done(job, worker string) error
+	// Fail returns the job after an error, dead is true if it was given up
+	Fail(job, worker string, cause error) (dead bool, err error)
+	// Release returns the job without counting the attempt
+	Release(job, worker string) error
+	// Reap returns the jobs of workers that stopped sending heartbeats
+	Reap() (requeued, dead []string, err error)
+
+	ChunkCommits(job, worker string) ([]int64, error)
+	Split(reponame, worker string, ids []int64) (chunks int, err error)
+}
+
+// JobQueue is nil if neither redis nor a coordinator is used
+var JobQueue Queue
+
+// redisQueue talks to redis directly
+type redisQueue struct{}
+
+func (redisQueue) Next(worker string) (string, error) { return GetNextRepo(worker) }
+func (redisQueue) Renew(job, worker string) error     { return RenewLease(job, worker) }
+func (redisQueue) Done(job, worker string) error      { return MarkAsDone(job, worker) }
+func (redisQueue) Release(job, worker string) error   { return ReleaseRepo(job, worker) }
+func (redisQueue) Reap() ([]string, []string, error)  { return ReapExpiredLeases() }
+func (redisQueue) ChunkCommits(job, worker string) ([]int64, error) {
+	return ChunkCommits(job, worker)
+}
+func (redisQueue) Fail(job, worker string, cause error) (bool, error) {
+	return ReturnRepo(job, worker, cause)
+}
+func (redisQueue) Split(reponame, worker string, ids []int64) (int, error) {
+	return EnqueueChunks(reponame, worker, ids)
+}
+
+// startHeartbeat renews the lease on a job until stop is called. If the lease
+// was lost, lost is called and the heartbeat stops.
+func startHeartbeat(q Queue, job, worker string, lost func()) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(LeaseTTL / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				switch err := q.Renew(job, worker); err {
+				case nil:
+				case ErrLeaseLost:
+					log.Errorf("%s: lease lost, the job was given to another worker", job)
+					lost()
+					return
+				default:
+					log.Warnf("%s: renewing lease: %v", job, err)
+				}
+			}
+		}
+	}()
+	return func() { close(done) }
+}
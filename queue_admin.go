@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+var (
+	queueCommand  string
+	queueCommands = []string{"list", "inspect", "requeue", "purge"}
+	queueNames    = []string{"init", "working", "done", "dead"}
+	queueKeys     = map[string]string{
+		"init":    RedisInitKey,
+		"working": RedisWorkingKey,
+		"done":    RedisDoneKey,
+		"dead":    RedisDeadKey,
+	}
+)
+
+// QueueEntry is what redis knows about a repository
+type QueueEntry struct {
+	Name        string
+	Queue       string
+	Worker      string
+	Attempts    int
+	LeaseExpiry time.Time
+	LastError   string
+}
+
+func (e *QueueEntry) String() string {
+	s := fmt.Sprintf("%-40s %-8s attempts=%d", e.Name, e.Queue, e.Attempts)
+	if e.Worker != "" {
+		s += fmt.Sprintf(" worker=%s lease=%v", e.Worker, e.LeaseExpiry.Sub(time.Now()).Seconds())
+	}
+	if e.LastError != "" {
+		s += fmt.Sprintf(" error=%q", e.LastError)
+	}
+	return s
+}
+
+// QueueEntries returns the repositories in one of the queues
+func QueueEntries(queue string) ([]string, error) {
+	conn := pool.Get()
+	defer conn.Close()
+
+	switch queue {
+	case "working":
+		return redis.Strings(conn.Do("HKEYS", RedisWorkingKey))
+	case "init", "done", "dead":
+		return redis.Strings(conn.Do("LRANGE", queueKeys[queue], 0, -1))
+	default:
+		return nil, fmt.Errorf("unknown queue %s, use one of %v", queue, queueNames)
+	}
+}
+
+// InspectRepo looks a repository up in all queues. Queue is empty if the
+// repository is in none of them.
+func InspectRepo(reponame string) (*QueueEntry, error) {
+	e := &QueueEntry{Name: reponame}
+	for _, queue := range queueNames {
+		entries, err := QueueEntries(queue)
+		if err != nil {
+			return nil, err
+		}
+		if contains(entries, reponame) {
+			e.Queue = queue
+			break
+		}
+	}
+
+	conn := pool.Get()
+	defer conn.Close()
+
+	var err error
+	if e.Attempts, err = redis.Int(conn.Do("HGET", RedisAttemptsKey, reponame)); err != nil && err != ErrNil {
+		return nil, err
+	}
+	if e.LastError, err = redis.String(conn.Do("HGET", RedisErrorsKey, reponame)); err != nil && err != ErrNil {
+		return nil, err
+	}
+	if e.Worker, err = redis.String(conn.Do("HGET", RedisWorkingKey, reponame)); err != nil && err != ErrNil {
+		return nil, err
+	}
+	expiry, err := redis.Int64(conn.Do("ZSCORE", RedisLeasesKey, reponame))
+	if err != nil && err != ErrNil {
+		return nil, err
+	}
+	if err == nil {
+		e.LeaseExpiry = time.Unix(expiry, 0)
+	}
+	return e, nil
+}
+
+// RunQueueCommand administers the redis queues:
+//
+//	list [queue...]          counts of all queues, or the entries of some
+//	inspect repo...          state, attempts and last error of repositories
+//	requeue repo|queue...    put repositories (or all in a queue) back into init
+//	purge repo|queue...      remove repositories (or all in a queue)
+func RunQueueCommand(w io.Writer, cmd string, args []string) error {
+	switch cmd {
+	case "list":
+		if len(args) == 0 {
+			return printQueueSummary(w)
+		}
+		for _, queue := range args {
+			entries, err := QueueEntries(queue)
+			if err != nil {
+				return err
+			}
+			if err := printQueueEntries(w, entries); err != nil {
+				return err
+			}
+		}
+		return nil
+	case "inspect":
+		return printQueueEntries(w, args)
+	case "requeue", "purge":
+		repos, err := expandQueueArgs(args)
+		if err != nil {
+			return err
+		}
+		for _, repo := range repos {
+			if cmd == "requeue" {
+				err = RequeueRepo(repo)
+			} else {
+				err = PurgeRepo(repo)
+			}
+			if err != nil {
+				return fmt.Errorf("%s %s: %v", cmd, repo, err)
+			}
+		}
+		fmt.Fprintf(w, "%s: %d repositories\n", cmd, len(repos))
+		return nil
+	default:
+		return fmt.Errorf("unknown queue command %s, use one of %v", cmd, queueCommands)
+	}
+}
+
+func printQueueSummary(w io.Writer) error {
+	for _, queue := range queueNames {
+		entries, err := QueueEntries(queue)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "%6d repositories %s\n", len(entries), queue)
+	}
+	working, err := QueueEntries("working")
+	if err != nil {
+		return err
+	}
+	return printQueueEntries(w, working)
+}
+
+func printQueueEntries(w io.Writer, repos []string) error {
+	for _, repo := range repos {
+		e, err := InspectRepo(repo)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(w, e)
+	}
+	return nil
+}
+
+// expandQueueArgs replaces queue names by the repositories in them
+func expandQueueArgs(args []string) (repos []string, err error) {
+	for _, arg := range args {
+		if _, ok := queueKeys[arg]; !ok {
+			repos = append(repos, arg)
+			continue
+		}
+		entries, err := QueueEntries(arg)
+		if err != nil {
+			return nil, err
+		}
+		repos = append(repos, entries...)
+	}
+	return
+}
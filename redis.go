@@ -1,7 +1,7 @@
 package main
 
 import (
-	"fmt"
+	"errors"
 	"time"
 
 	"github.com/garyburd/redigo/redis"
@@ -9,11 +9,174 @@ import (
 
 var pool *redis.Pool
 var ErrNil = redis.ErrNil
+var ErrLeaseLost = errors.New("lease lost")
+var redisAddress = "131.220.109.52:6386"
+
+// LeaseTTL is how long a claimed repository stays with a worker without a heartbeat
+var LeaseTTL = 10 * time.Minute
+
+// MaxAttempts is how often a repository is claimed before it goes to the dead list
+var MaxAttempts = 3
 
 const (
-	RedisInitKey    = "ghprojectInit"
-	RedisDoneKey    = "ghprojectDone"
-	RedisWorkingKey = "ghprojectWorking"
+	RedisInitKey       = "ghprojectInit"
+	RedisDoneKey       = "ghprojectDone"
+	RedisDeadKey       = "ghprojectDead"
+	RedisWorkingKey    = "ghprojectWorking"    // hash repo -> worker
+	RedisLeasesKey     = "ghprojectLeases"     // sorted set repo -> lease expiry (unix time)
+	RedisAttemptsKey   = "ghprojectAttempts"   // hash repo -> number of claims
+	RedisErrorsKey     = "ghprojectErrors"     // hash repo -> last error
+	RedisChunksKey     = "ghprojectChunks"     // hash chunk job -> commit ids
+	RedisChunksLeftKey = "ghprojectChunksLeft" // hash repo -> number of unfinished chunks
+)
+
+// chunkGoneLua counts a chunk of a split repository that will not be done as
+// finished, so that the repository is done once the other chunks are
+const chunkGoneLua = `
+	local function chunk_gone(chunk, chunksLeft, done)
+		local repo = string.match(chunk, '^(.*)#%d+$')
+		if not repo or redis.call('HEXISTS', chunksLeft, repo) == 0 then
+			return
+		end
+		if redis.call('HINCRBY', chunksLeft, repo, -1) <= 0 then
+			redis.call('HDEL', chunksLeft, repo)
+			redis.call('RPUSH', done, repo)
+		end
+	end
+`
+
+// releaseLua takes a repository away from its worker and records the error.
+// It goes back to init, or to dead once it used up its attempts.
+// KEYS: working, leases, attempts, errors, init, dead, chunks left, done
+const releaseLua = chunkGoneLua + `
+	local function release(repo, cause, maxAttempts)
+		redis.call('HDEL', KEYS[1], repo)
+		redis.call('ZREM', KEYS[2], repo)
+		redis.call('HSET', KEYS[4], repo, cause)
+		local attempts = tonumber(redis.call('HGET', KEYS[3], repo) or '0')
+		if attempts >= maxAttempts then
+			redis.call('RPUSH', KEYS[6], repo)
+			chunk_gone(repo, KEYS[7], KEYS[8])
+			return true
+		end
+		redis.call('RPUSH', KEYS[5], repo)
+		return false
+	end
+`
+
+var (
+	// KEYS: init, working, leases, attempts; ARGV: worker, expiry
+	claimScript = redis.NewScript(4, `
+		local repo = redis.call('RPOP', KEYS[1])
+		if not repo then
+			return false
+		end
+		redis.call('HSET', KEYS[2], repo, ARGV[1])
+		redis.call('ZADD', KEYS[3], ARGV[2], repo)
+		redis.call('HINCRBY', KEYS[4], repo, 1)
+		return repo`)
+	// KEYS: working, leases; ARGV: repo, worker, expiry
+	renewScript = redis.NewScript(2, `
+		if redis.call('HGET', KEYS[1], ARGV[1]) ~= ARGV[2] then
+			return 0
+		end
+		redis.call('ZADD', KEYS[2], ARGV[3], ARGV[1])
+		return 1`)
+	// KEYS: working, leases, attempts, init; ARGV: repo, worker
+	releaseScript = redis.NewScript(4, `
+		if redis.call('HGET', KEYS[1], ARGV[1]) ~= ARGV[2] then
+			return -1
+		end
+		redis.call('HDEL', KEYS[1], ARGV[1])
+		redis.call('ZREM', KEYS[2], ARGV[1])
+		if tonumber(redis.call('HGET', KEYS[3], ARGV[1]) or '0') > 0 then
+			redis.call('HINCRBY', KEYS[3], ARGV[1], -1)
+		end
+		redis.call('RPUSH', KEYS[4], ARGV[1])
+		return 1`)
+	// ARGV: repo, cause, max attempts, worker
+	returnScript = redis.NewScript(8, releaseLua+`
+		if redis.call('HGET', KEYS[1], ARGV[1]) ~= ARGV[4] then
+			return -1
+		end
+		if release(ARGV[1], ARGV[2], tonumber(ARGV[3])) then
+			return 1
+		end
+		return 0`)
+	// ARGV: now, max attempts; returns the requeued and the dead repositories
+	reapScript = redis.NewScript(8, releaseLua+`
+		local requeued, dead = {}, {}
+		for _, repo in ipairs(redis.call('ZRANGEBYSCORE', KEYS[2], '-inf', ARGV[1])) do
+			if release(repo, 'lease expired', tonumber(ARGV[2])) then
+				table.insert(dead, repo)
+			else
+				table.insert(requeued, repo)
+			end
+		end
+		return {requeued, dead}`)
+	// KEYS: working, leases, done, chunks, chunks left; ARGV: job, repo, is chunk, worker
+	doneScript = redis.NewScript(5, `
+		if redis.call('HGET', KEYS[1], ARGV[1]) ~= ARGV[4] then
+			return -1
+		end
+		redis.call('HDEL', KEYS[1], ARGV[1])
+		redis.call('ZREM', KEYS[2], ARGV[1])
+		if ARGV[3] == '1' then
+			redis.call('HDEL', KEYS[4], ARGV[1])
+		end
+		if redis.call('HEXISTS', KEYS[5], ARGV[2]) == 1 then
+			-- the repository was split, its job counts as one more chunk and
+			-- whichever finishes last makes it done
+			if redis.call('HINCRBY', KEYS[5], ARGV[2], -1) > 0 then
+				return 0
+			end
+			redis.call('HDEL', KEYS[5], ARGV[2])
+		end
+		redis.call('RPUSH', KEYS[3], ARGV[2])
+		return 1`)
+	// KEYS: init, done, dead, working, leases, attempts, errors, chunks, chunks
+	// left; ARGV: repo or chunk, requeue
+	removeScript = redis.NewScript(9, chunkGoneLua+`
+		local function remove(job)
+			redis.call('LREM', KEYS[1], 0, job)
+			redis.call('LREM', KEYS[2], 0, job)
+			local dead = redis.call('LREM', KEYS[3], 0, job) > 0
+			redis.call('HDEL', KEYS[4], job)
+			redis.call('ZREM', KEYS[5], job)
+			redis.call('HDEL', KEYS[6], job)
+			redis.call('HDEL', KEYS[7], job)
+			return dead
+		end
+		local job, requeue = ARGV[1], ARGV[2] == '1'
+		local dead = remove(job)
+		local repo = string.match(job, '^(.*)#%d+$')
+		if repo then
+			if redis.call('HEXISTS', KEYS[8], job) == 1 then
+				if not requeue then
+					redis.call('HDEL', KEYS[8], job)
+					if not dead then
+						chunk_gone(job, KEYS[9], KEYS[2])
+					end
+				elseif dead then
+					-- the repository waits for the chunk again
+					redis.call('HINCRBY', KEYS[9], repo, 1)
+					redis.call('LREM', KEYS[2], 0, repo)
+				end
+			end
+		else
+			-- the chunks go with the repository, its next job splits it again
+			for _, chunk in ipairs(redis.call('HKEYS', KEYS[8])) do
+				if string.sub(chunk, 1, #job + 1) == job .. '#' then
+					remove(chunk)
+					redis.call('HDEL', KEYS[8], chunk)
+				end
+			end
+			redis.call('HDEL', KEYS[9], job)
+		end
+		if requeue then
+			redis.call('RPUSH', KEYS[1], job)
+		end
+		return 1`)
 )
 
 func InitRedis() {
@@ -25,7 +188,7 @@ func newPool() *redis.Pool {
 		MaxIdle:     3,
 		IdleTimeout: 240 * time.Second,
 		Dial: func() (redis.Conn, error) {
-			return redis.Dial("tcp", "131.220.109.52:6386")
+			return redis.Dial("tcp", redisAddress)
 		},
 		TestOnBorrow: func(c redis.Conn, t time.Time) error {
 			_, err := c.Do("PING")
@@ -34,79 +197,175 @@ func newPool() *redis.Pool {
 	}
 }
 
+func leaseExpiry() int64 {
+	return time.Now().Add(LeaseTTL).Unix()
+}
+
 func MarkAsWorking(reponame, tag string) {
 	conn := pool.Get()
 	defer conn.Close()
 
-	conn.Do("HSET", RedisWorkingKey, reponame, tag)
+	conn.Send("MULTI")
+	conn.Send("HSET", RedisWorkingKey, reponame, tag)
+	conn.Send("ZADD", RedisLeasesKey, leaseExpiry(), reponame)
+	conn.Do("EXEC")
+}
+
+// MarkAsDone finishes a job of a worker. A repository goes to the done list
+// once the job of the whole repository and all of its chunks are done. It
+// returns ErrLeaseLost if the job has been handed to someone else meanwhile.
+func MarkAsDone(job, tag string) error {
+	conn := pool.Get()
+	defer conn.Close()
+
+	reponame, isChunk := ParseJob(job)
+	return leaseResult(redis.Int(doneScript.Do(conn,
+		RedisWorkingKey, RedisLeasesKey, RedisDoneKey, RedisChunksKey, RedisChunksLeftKey,
+		job, reponame, isChunk, tag,
+	)))
 }
 
-func MarkAsDone(reponame string) {
+// ReturnRepo gives up on a repository of a worker after a failure. It is
+// retried unless it already failed MaxAttempts times, in which case it goes to
+// the dead list and ReturnRepo returns true.
+func ReturnRepo(reponame, tag string, cause error) (dead bool, err error) {
 	conn := pool.Get()
 	defer conn.Close()
 
-	conn.Do("HDEL", RedisWorkingKey, reponame)
-	conn.Do("RPUSH", RedisDoneKey, reponame)
+	n, err := redis.Int(returnScript.Do(conn,
+		RedisWorkingKey, RedisLeasesKey, RedisAttemptsKey, RedisErrorsKey, RedisInitKey, RedisDeadKey, RedisChunksLeftKey, RedisDoneKey,
+		reponame, cause.Error(), MaxAttempts, tag,
+	))
+	return n == 1, leaseResult(n, err)
 }
 
-func ReturnRepo(reponame string) {
+// ReleaseRepo puts a repository of a worker back into init without counting
+// the attempt, e.g. because the worker shuts down
+func ReleaseRepo(reponame, tag string) error {
 	conn := pool.Get()
 	defer conn.Close()
 
-	conn.Do("HDEL", RedisWorkingKey, reponame)
-	conn.Do("RPUSH", RedisInitKey, reponame)
+	return leaseResult(redis.Int(releaseScript.Do(conn,
+		RedisWorkingKey, RedisLeasesKey, RedisAttemptsKey, RedisInitKey,
+		reponame, tag,
+	)))
+}
+
+// leaseResult turns the -1 of a script into ErrLeaseLost
+func leaseResult(n int, err error) error {
+	if err == nil && n == -1 {
+		return ErrLeaseLost
+	}
+	return err
 }
 
-func GetNextRepo() (string, error) {
+// GetNextRepo claims the next repository for a worker. The claim is a lease
+// that expires after LeaseTTL unless it is renewed with RenewLease.
+func GetNextRepo(tag string) (string, error) {
 	conn := pool.Get()
 	defer conn.Close()
 
-	return redis.String(conn.Do("RPOP", RedisInitKey))
+	return redis.String(claimScript.Do(conn,
+		RedisInitKey, RedisWorkingKey, RedisLeasesKey, RedisAttemptsKey,
+		tag, leaseExpiry(),
+	))
 }
 
-func PrintProgress() {
+// RenewLease extends the lease of a worker on a repository. It returns
+// ErrLeaseLost if the repository has been handed to someone else meanwhile.
+func RenewLease(reponame, tag string) error {
 	conn := pool.Get()
 	defer conn.Close()
 
-	left, err := conn.Do("LLEN", RedisInitKey)
+	ok, err := redis.Bool(renewScript.Do(conn,
+		RedisWorkingKey, RedisLeasesKey,
+		reponame, tag, leaseExpiry(),
+	))
 	if err != nil {
-		panic(err)
+		return err
+	}
+	if !ok {
+		return ErrLeaseLost
 	}
-	fmt.Printf("%3d repositories left\n", left.(int64))
+	return nil
+}
 
-	done, _ := conn.Do("LLEN", RedisDoneKey)
-	fmt.Printf("%3d repositories done\n", done.(int64))
+// ReapExpiredLeases takes repositories away from workers that stopped sending
+// heartbeats. They are requeued, or moved to the dead list after MaxAttempts.
+func ReapExpiredLeases() (requeued, dead []string, err error) {
+	conn := pool.Get()
+	defer conn.Close()
 
-	if working, err := redis.Strings(conn.Do("HGETALL", RedisWorkingKey)); err == nil {
-		for i := 0; i < len(working); i += 2 {
-			fmt.Printf("%v -> %v\n", working[i+1], working[i])
-		}
+	res, err := redis.Values(reapScript.Do(conn,
+		RedisWorkingKey, RedisLeasesKey, RedisAttemptsKey, RedisErrorsKey, RedisInitKey, RedisDeadKey, RedisChunksLeftKey, RedisDoneKey,
+		time.Now().Unix(), MaxAttempts,
+	))
+	if err != nil {
+		return
+	}
+	if requeued, err = redis.Strings(res[0], nil); err != nil {
+		return
 	}
+	dead, err = redis.Strings(res[1], nil)
+	return
 }
 
-func WriteReposToRedis() {
-	var rname string
+// Attempts returns how often a repository has been claimed
+func Attempts(reponame string) (int, error) {
+	conn := pool.Get()
+	defer conn.Close()
 
+	n, err := redis.Int(conn.Do("HGET", RedisAttemptsKey, reponame))
+	if err == ErrNil {
+		return 0, nil
+	}
+	return n, err
+}
+
+// RequeueRepo removes a repository from every queue, forgets its attempts and
+// errors and puts it back into init. The chunks of a repository are removed
+// with it, a chunk itself keeps its commits.
+func RequeueRepo(reponame string) error {
+	return removeRepo(reponame, true)
+}
+
+// PurgeRepo removes a repository, and its chunks, from every queue
+func PurgeRepo(reponame string) error {
+	return removeRepo(reponame, false)
+}
+
+func removeRepo(reponame string, requeue bool) error {
+	conn := pool.Get()
+	defer conn.Close()
+
+	_, err := removeScript.Do(conn,
+		RedisInitKey, RedisDoneKey, RedisDeadKey, RedisWorkingKey, RedisLeasesKey, RedisAttemptsKey, RedisErrorsKey, RedisChunksKey, RedisChunksLeftKey,
+		reponame, requeue,
+	)
+	return err
+}
+
+func WriteReposToRedis() {
 	conn := pool.Get()
 	defer conn.Close()
 
-	repos, err := DB.Db.Query("SELECT name FROM repositories WHERE language in ('C', 'C++')")
+	repos, err := DataStore.RepositoryNames()
 	if err != nil {
 		panic(err)
 	}
-	defer repos.Close()
 	conn.Do("DEL", RedisInitKey)
 	conn.Do("DEL", RedisWorkingKey)
 	conn.Do("DEL", RedisDoneKey)
-	for repos.Next() {
-		if err := repos.Scan(&rname); err != nil {
-			panic(err)
-		}
+	conn.Do("DEL", RedisDeadKey)
+	conn.Do("DEL", RedisLeasesKey)
+	conn.Do("DEL", RedisAttemptsKey)
+	conn.Do("DEL", RedisErrorsKey)
+	conn.Do("DEL", RedisChunksKey)
+	conn.Do("DEL", RedisChunksLeftKey)
+	// repositories are split by their own job, after it added their commits
+	for _, rname := range repos {
 		conn.Do("RPUSH", RedisInitKey, rname)
 	}
-	if err := repos.Close(); err != nil {
-		panic(err)
-	}
 }
 
 func Selftest() error {
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/garyburd/redigo/redis"
+)
+
+func newTestRedis(t *testing.T) func() {
+	s, err := miniredis.Run()
+	handleErr(t, err)
+	oldAddress, oldPool := redisAddress, pool
+	redisAddress = s.Addr()
+	InitRedis()
+	return func() {
+		pool.Close()
+		s.Close()
+		redisAddress, pool = oldAddress, oldPool
+	}
+}
+
+func TestLeases(t *testing.T) {
+	defer newTestRedis(t)()
+	conn := pool.Get()
+	defer conn.Close()
+	_, err := conn.Do("RPUSH", RedisInitKey, "foo/bar")
+	handleErr(t, err)
+
+	repo, err := GetNextRepo("worker1")
+	handleErr(t, err)
+	if repo != "foo/bar" {
+		t.Fatalf("expected foo/bar, got %s", repo)
+	}
+	if _, err := GetNextRepo("worker2"); err != ErrNil {
+		t.Fatalf("expected an empty queue, got %v", err)
+	}
+	handleErr(t, RenewLease(repo, "worker1"))
+	if err := RenewLease(repo, "worker2"); err != ErrLeaseLost {
+		t.Errorf("worker2 should not own the lease, got %v", err)
+	}
+
+	// nothing expired yet
+	reaped, _, err := ReapExpiredLeases()
+	handleErr(t, err)
+	if len(reaped) != 0 {
+		t.Errorf("expected no expired leases, got %v", reaped)
+	}
+
+	// let worker1 die
+	_, err = conn.Do("ZADD", RedisLeasesKey, time.Now().Add(-time.Minute).Unix(), repo)
+	handleErr(t, err)
+	reaped, _, err = ReapExpiredLeases()
+	handleErr(t, err)
+	if len(reaped) != 1 || reaped[0] != repo {
+		t.Fatalf("expected %s to be reaped, got %v", repo, reaped)
+	}
+	if err := RenewLease(repo, "worker1"); err != ErrLeaseLost {
+		t.Errorf("worker1 should have lost its lease, got %v", err)
+	}
+
+	repo, err = GetNextRepo("worker2")
+	handleErr(t, err)
+	if n, _ := Attempts(repo); n != 2 {
+		t.Errorf("expected 2 attempts, got %d", n)
+	}
+	// worker1 must not finish or return the job of worker2
+	if err := MarkAsDone(repo, "worker1"); err != ErrLeaseLost {
+		t.Errorf("worker1 should not finish %s, got %v", repo, err)
+	}
+	if _, err := ReturnRepo(repo, "worker1", errors.New("too late")); err != ErrLeaseLost {
+		t.Errorf("worker1 should not return %s, got %v", repo, err)
+	}
+	if err := ReleaseRepo(repo, "worker1"); err != ErrLeaseLost {
+		t.Errorf("worker1 should not release %s, got %v", repo, err)
+	}
+	handleErr(t, MarkAsDone(repo, "worker2"))
+	if n, _ := redis.Int(conn.Do("ZCARD", RedisLeasesKey)); n != 0 {
+		t.Errorf("expected no leases after done, got %d", n)
+	}
+}
+
+func TestDeadLetter(t *testing.T) {
+	defer newTestRedis(t)()
+	conn := pool.Get()
+	defer conn.Close()
+	_, err := conn.Do("RPUSH", RedisInitKey, "foo/bar")
+	handleErr(t, err)
+
+	MaxAttempts = 2
+	defer func() { MaxAttempts = 3 }()
+	for i := 1; i <= MaxAttempts; i++ {
+		repo, err := GetNextRepo("worker")
+		handleErr(t, err)
+		dead, err := ReturnRepo(repo, "worker", errors.New("clone failed"))
+		handleErr(t, err)
+		if dead != (i == MaxAttempts) {
+			t.Errorf("attempt %d: dead should be %v", i, !dead)
+		}
+	}
+	if _, err := GetNextRepo("worker"); err != ErrNil {
+		t.Errorf("dead repository should not be handed out, got %v", err)
+	}
+
+	e, err := InspectRepo("foo/bar")
+	handleErr(t, err)
+	if e.Queue != "dead" || e.Attempts != 2 || e.LastError != "clone failed" {
+		t.Errorf("unexpected entry %+v", e)
+	}
+
+	var out bytes.Buffer
+	handleErr(t, RunQueueCommand(&out, "list", nil))
+	if !strings.Contains(out.String(), "1 repositories dead") {
+		t.Errorf("unexpected summary:\n%s", out.String())
+	}
+	handleErr(t, RunQueueCommand(&out, "requeue", []string{"dead"}))
+	e, err = InspectRepo("foo/bar")
+	handleErr(t, err)
+	if e.Queue != "init" || e.Attempts != 0 || e.LastError != "" {
+		t.Errorf("unexpected entry after requeue %+v", e)
+	}
+	handleErr(t, RunQueueCommand(&out, "purge", []string{"foo/bar"}))
+	if e, _ = InspectRepo("foo/bar"); e.Queue != "" {
+		t.Errorf("foo/bar should be purged, is in %s", e.Queue)
+	}
+}
+
+func TestReleaseRepo(t *testing.T) {
+	defer newTestRedis(t)()
+	conn := pool.Get()
+	defer conn.Close()
+	_, err := conn.Do("RPUSH", RedisInitKey, "foo/bar")
+	handleErr(t, err)
+
+	repo, err := GetNextRepo("worker")
+	handleErr(t, err)
+	handleErr(t, ReleaseRepo(repo, "worker"))
+	e, err := InspectRepo(repo)
+	handleErr(t, err)
+	if e.Queue != "init" || e.Attempts != 0 || e.Worker != "" {
+		t.Errorf("unexpected entry after release %+v", e)
+	}
+}
+
+func TestHeartbeatLeaseLost(t *testing.T) {
+	defer newTestRedis(t)()
+	oldTTL := LeaseTTL
+	defer func() { LeaseTTL = oldTTL }()
+	LeaseTTL = 30 * time.Millisecond
+
+	// nobody holds foo/bar, so the first renewal fails
+	lost := make(chan struct{})
+	stop := startHeartbeat(redisQueue{}, "foo/bar", "worker", func() { close(lost) })
+	defer stop()
+	select {
+	case <-lost:
+	case <-time.After(time.Second):
+		t.Error("the heartbeat should report the lost lease")
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"os"
 	"os/exec"
@@ -9,8 +10,7 @@ import (
 	"runtime"
 	"sort"
 	"strings"
-
-	"database/sql"
+	"sync"
 
 	_ "github.com/lib/pq"
 
@@ -20,11 +20,15 @@ import (
 
 	"github.com/google/go-github/github"
 	"github.com/libgit2/git2go"
+
+	"tools.net.cs.uni-bonn.de/social-aspects-of-vulnerabilities/github-data/proc"
 )
 
 type Repository struct {
 	gitRepository    *git.Repository `db:"-" json"-"`
-	onRamdisk        bool            `db:"-" json"-"` // whether repo is on ramdisk, false by default
+	onRamdisk        bool            `db:"-" json:"-"` // whether repo is on ramdisk, false by default
+	compileDB        *CompileDB      `db:"-" json:"-"` // see ClangArgs
+	compileDBLoaded  bool            `db:"-" json:"-"`
 	Commits          []Commit        `db:"-" json"-"`
 	Id               int64           `json:"-" db:"id" table:"repositories"`
 	Name             string          `json:"full_name" db:"name"`
@@ -45,32 +49,28 @@ type Repository struct {
 
 var (
 	RepoBasePath = "repos/"
+	RamdiskPath  = "/run/shm"
+	// cloneTimeout is how long git clone, git pull or copying to the ramdisk
+	// may take
+	cloneTimeout = time.Hour
 )
 
-func NewRepositoryFromDB(reponame string) (*Repository, error) {
-	r := new(Repository)
-	row := DB.Db.QueryRow("SELECT id, name, language, git_url FROM repositories WHERE name = $1", reponame)
-	if err := row.Scan(&r.Id, &r.Name, &r.Language, &r.GitUrl); err != nil {
-		log.Error("error in new repo from db")
-		return nil, err
-	}
-	return r, nil
-}
-
 func (r *Repository) GetId() int64 {
 	return r.Id
 }
 
-func (r *Repository) Update() (err error) {
+func (r *Repository) Update(ctx context.Context) (err error) {
 	log.Debugf("%v: clone()", r)
-	if err = r.clone(); err != nil {
+	if err = r.clone(ctx); err != nil {
 		return
 	}
 
-	r.CopyToRamdisk()
+	if err = r.CopyToRamdisk(ctx); proc.IsTimeout(err) {
+		return
+	}
 
-	log.Debugf("%v: DB.Update()", r)
-	if _, err = DB.Update(r); err != nil {
+	log.Debugf("%v: DataStore.UpdateRepository()", r)
+	if err = DataStore.UpdateRepository(r); err != nil {
 		return
 	}
 	log.Debugf("%v: addAllCommits()", r)
@@ -93,28 +93,16 @@ func (r *Repository) String() string {
 func (r *Repository) addAllCommits() (err error) {
 	var (
 		e              error
-		sha            = new(string)
-		rows           *sql.Rows
 		commitShasInDB []string
 	)
 
 	for {
-		rows, e = DB.Db.Query("SELECT sha FROM unstable.commits WHERE repository_id = $1", r.Id)
+		commitShasInDB, e = DataStore.CommitShas(r)
 		if e == nil {
 			break
 		}
 		log.Errorf("add all commits: %v", e)
-		ReopenDB()
-	}
-	defer rows.Close()
-	for rows.Next() {
-		rows.Scan(sha)
-		commitShasInDB = append(commitShasInDB, *sha)
-
-	}
-	if err := rows.Err(); err != nil {
-		log.Errorf("scan done: %v", err)
-		ReopenDB()
+		DataStore.Reopen()
 	}
 	sort.Strings(commitShasInDB)
 	commitsBeforeInsert := len(commitShasInDB)
@@ -186,31 +174,14 @@ func (r *Repository) addCveCommits(ignoreCommits []string) ([]string, error) {
 			continue
 		}
 		ignoreCommits, _, _ = r.addCommitWithType(co, ignoreCommits, "fixing_commit")
-		shas = append(shas, "'"+sha+"'")
-	}
-	// mark all CVE commits as fixing
-	if _, err := DB.Db.Exec(`
-		UPDATE	unstable.commits SET type = 'other_commit'
-		WHERE	type = 'fixing_commit' AND repository_id = $1`,
-		r.Id,
-	); err != nil {
-		log.Warn(err)
-	}
-	if len(shas) == 0 {
-		return ignoreCommits, nil
+		shas = append(shas, sha)
 	}
-	q := `
-	UPDATE	unstable.commits SET type = 'fixing_commit'
-	WHERE	sha IN (` + strings.Join(shas, ", ") + `)  AND repository_id = $1;
-	`
-	res, err := DB.Db.Exec(q, r.Id)
+	cnt, err := DataStore.MarkFixingCommits(r, shas)
 	if err != nil {
-		log.Warn(err, q)
+		log.Warn(err)
 		return ignoreCommits, err
 	}
-	if cnt, err := res.RowsAffected(); err == nil {
-		log.Debugf("Marked %d commits as 'fixing'\n", cnt)
-	}
+	log.Debugf("Marked %d commits as 'fixing'\n", cnt)
 	return ignoreCommits, nil
 }
 
@@ -235,7 +206,7 @@ func (r *Repository) addCommitWithType(co *git.Commit, ignoreCommits []string, _
 		CommitterName:  fixInvalidUtf8(co.Committer().Name),
 		CommitterWhen:  co.Committer().When,
 	}
-	if e := DB.Insert(newCommit); e != nil {
+	if e := DataStore.InsertCommit(newCommit); e != nil {
 		log.Warnf("%s %s: inserting failed: %v", r.String(), newCommit.Sha, e)
 	}
 	log.Debugf("%s: inserted commit %s (%d total)", r.String(), newCommit.Sha, len(ignoreCommits))
@@ -257,7 +228,29 @@ func (r *Repository) CloneUrl() (string, error) {
 	}
 }
 
-func (r *Repository) clone() error {
+// cloneLocks serializes clones and pulls of the same repository, a worker may
+// handle several chunks of it at the same time
+var cloneLocks = struct {
+	sync.Mutex
+	byName map[string]*sync.Mutex
+}{byName: make(map[string]*sync.Mutex)}
+
+func cloneLock(name string) *sync.Mutex {
+	cloneLocks.Lock()
+	defer cloneLocks.Unlock()
+	l, ok := cloneLocks.byName[name]
+	if !ok {
+		l = new(sync.Mutex)
+		cloneLocks.byName[name] = l
+	}
+	return l
+}
+
+func (r *Repository) clone(ctx context.Context) error {
+	l := cloneLock(r.Name)
+	l.Lock()
+	defer l.Unlock()
+
 	dir := path.Join(RepoBasePath, r.Name)
 	url, err := r.CloneUrl()
 	if err != nil {
@@ -270,31 +263,50 @@ func (r *Repository) clone() error {
 	if err != nil { // repository doesn't exist -> clone
 		start := time.Now()
 		log.Debugf("git clone %s %s", url, dir)
-		cloneCmd := exec.Command("git", "clone", url, dir)
+		cloneCmd := proc.Command(ctx, cloneTimeout, "git", "clone", url, dir)
 		cloneCmd.Stderr = errBuf
 		cloneCmd.Dir = "."
 		if err := cloneCmd.Run(); err != nil {
-			fmt.Errorf("git clone %s failed (%v):\n%s", r.Name, err, errBuf)
+			if proc.IsTimeout(err) {
+				return err
+			}
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return fmt.Errorf("git clone %s failed (%v):\n%s", r.Name, err, errBuf)
 		}
 		log.Debugf("git clone %s took %s", r.Name, time.Since(start))
 		r.gitRepository, err = git.OpenRepository(dir)
 		if err != nil {
-			fmt.Errorf("after git clone %s failed (%v):\n%s", r.Name, err, errBuf)
+			return fmt.Errorf("after git clone %s failed (%v):\n%s", r.Name, err, errBuf)
 		}
 	} else {
 		start := time.Now()
 		r.gitRepository = gitRepo
-		pullCmd := exec.Command("git", "pull")
+		pullCmd := proc.Command(ctx, cloneTimeout, "git", "pull")
 		pullCmd.Dir = gitRepo.Workdir()
 		pullCmd.Stderr = errBuf
 		if err := pullCmd.Run(); err != nil {
-			fmt.Errorf("git clone %s failed (%v):\n%s", r.Name, err, errBuf)
+			if proc.IsTimeout(err) {
+				return err
+			}
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return fmt.Errorf("git pull %s failed (%v):\n%s", r.Name, err, errBuf)
 		}
 		log.Debugf("git pull %s took %s", r.Name, time.Since(start))
 	}
 	return nil
 }
 
+// Fetch clones or pulls the repository without touching the database. The
+// ramdisk is not used, since several chunks of a repository may be handled
+// by the same worker at once.
+func (r *Repository) Fetch(ctx context.Context) error {
+	return r.clone(ctx)
+}
+
 func (r *Repository) IsGithubRepo() bool {
 	return r.GitUrl == ""
 }
@@ -323,20 +335,23 @@ func (r *Repository) Dir() string {
 	return path.Join(RepoBasePath, r.Name)
 }
 
-func (r *Repository) CopyToRamdisk() (err error) {
+func (r *Repository) CopyToRamdisk(ctx context.Context) (err error) {
 	errBuf := new(bytes.Buffer)
-	shm := "/run/shm"
-	// check if /run/shm exists
+	shm := RamdiskPath
+	// check if the ramdisk exists
 	if _, err = os.Stat(shm); err != nil {
 		return fmt.Errorf("%s not found: %v", shm, err)
 	}
 	src := path.Join(RepoBasePath, r.Name)
 	dest := path.Join(shm, r.Owner())
-	exec.Command("rm", "-rf", "dest").Run()
+	exec.Command("rm", "-rf", path.Join(shm, r.Name)).Run()
 	exec.Command("mkdir", "-p", path.Join(shm, r.Name)).Run()
-	cp := exec.Command("cp", "-a", src, dest)
+	cp := proc.Command(ctx, cloneTimeout, "cp", "-a", src, dest)
 	cp.Stderr = errBuf
 	if err = cp.Run(); err != nil {
+		if proc.IsTimeout(err) {
+			return err
+		}
 		return fmt.Errorf("Error copying from %s to %s: %v\n%s", src, dest, err, errBuf)
 	}
 	log.Infof("%v: copied %s to %s", r, src, dest)
@@ -363,7 +378,8 @@ func RemoveFromRamdisk(r *Repository) {
 		r.gitRepository.Free()
 		r.gitRepository = nil
 	}
-	dest := path.Join("/run/shm/", r.Owner())
+	// only remove this repository, others of the same owner may still be in use
+	dest := path.Join(RamdiskPath, r.Name)
 	rm := exec.Command("rm", "-rf", dest)
 	rm.Run()
 }
@@ -371,17 +387,15 @@ func RemoveFromRamdisk(r *Repository) {
 func (r *Repository) addAuthorContributions() (err error) {
 	var (
 		e             error
-		rows          *sql.Rows
+		authors       map[int64]string
 		emptyCommits  int64 = 1
-		allCommits    int64 = 0
 		contribByName       = make(map[string][]int64)
 	)
 
-	cntRow := DB.Db.QueryRow("SELECT count(*) FROM unstable.commits WHERE repository_id = $1 and (author_contributions_percent IS NULL or author_contributions_percent = 0)", r.Id)
-	err = cntRow.Scan(&emptyCommits)
+	emptyCommits, err = DataStore.CountMissingAuthorContributions(r)
 	if err != nil {
 		log.Errorf("Getting count of commits with empty author contrib: %v", err)
-		ReopenDB()
+		DataStore.Reopen()
 	} else if emptyCommits == 0 {
 		log.Infof("%v: skipping addAuthorContributions, db up to date", r)
 		return nil
@@ -389,35 +403,21 @@ func (r *Repository) addAuthorContributions() (err error) {
 	log.Debugf("%s: %d commits with empty author contrib", r, emptyCommits)
 
 	for {
-		rows, e = DB.Db.Query("SELECT id, author_email FROM unstable.commits WHERE repository_id = $1", r.Id)
-		if err == nil {
+		authors, e = DataStore.CommitAuthors(r)
+		if e == nil {
 			break
 		}
 		log.Errorf("addAuthorContributions(): %v", e)
-		ReopenDB()
-	}
-	defer rows.Close()
-	for rows.Next() {
-		var (
-			id    int64
-			email string
-		)
-		allCommits++
-		if err := rows.Scan(&id, &email); err != nil {
-			return fmt.Errorf("row scan: %v", err)
-		}
-		contribByName[email] = append(contribByName[email], id)
+		DataStore.Reopen()
 	}
-	if err := rows.Err(); err != nil {
-		log.Errorf("scan done: %v", err)
-		ReopenDB()
+	for id, email := range authors {
+		contribByName[email] = append(contribByName[email], id)
 	}
 
 	for _, ids := range contribByName {
-		contrib := float64(len(ids)) / float64(allCommits)
+		contrib := float64(len(ids)) / float64(len(authors))
 		for _, id := range ids {
-			commit := &Commit{Id: id}
-			err = PersistColumn(commit, "author_contributions_percent", contrib)
+			err = DataStore.SetAuthorContribution(id, contrib)
 		}
 	}
 
@@ -436,7 +436,7 @@ func AddRepository(reponame string) error {
 	if err != nil {
 		return fmt.Errorf("retrieving repo from github: %v %v %v", req, res, err)
 	}
-	if e := DB.Insert(r); e != nil {
+	if e := DataStore.InsertRepository(r); e != nil {
 		log.Warnf("%v: inserting failed: %v", r, e)
 	}
 
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// ErrShutdown is returned by handleRepo if it stopped before all commits were updated
+var ErrShutdown = errors.New("interrupted by shutdown")
+
+var (
+	shutdownTimeout = 2 * time.Minute
+	shutdown        = make(chan struct{})
+	shutdownOnce    sync.Once
+)
+
+// HandleSignals starts a graceful shutdown on SIGINT or SIGTERM. A second
+// signal quits immediately.
+func HandleSignals() {
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-sigs
+		log.Warnf("Got %v, waiting up to %v for running commits, send again to quit immediately", sig, shutdownTimeout)
+		Shutdown()
+		<-sigs
+		log.Error("Quitting immediately")
+		os.Exit(1)
+	}()
+}
+
+// Shutdown stops scheduling new repositories and commits
+func Shutdown() {
+	shutdownOnce.Do(func() { close(shutdown) })
+}
+
+func ShuttingDown() bool {
+	select {
+	case <-shutdown:
+		return true
+	default:
+		return false
+	}
+}
+
+// drain waits for wg. Once stop is closed it waits at most timeout longer and
+// returns false if the wait group did not finish in time.
+func drain(wg *sync.WaitGroup, stop <-chan struct{}, timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-stop:
+	}
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
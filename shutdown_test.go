@@ -0,0 +1,28 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDrain(t *testing.T) {
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+
+	wg.Add(1)
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		wg.Done()
+	}()
+	if !drain(&wg, stop, 0) {
+		t.Error("drain should wait for the wait group without a shutdown")
+	}
+
+	wg.Add(1)
+	close(stop)
+	if drain(&wg, stop, 10*time.Millisecond) {
+		t.Error("drain should give up after the timeout")
+	}
+	wg.Done()
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"database/sql"
+
+	"github.com/coopernurse/gorp"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+var sqliteSchema = []string{
+	`CREATE TABLE IF NOT EXISTS repositories (
+		id                INTEGER PRIMARY KEY AUTOINCREMENT,
+		name              TEXT NOT NULL UNIQUE,
+		description       TEXT,
+		pushed_at         DATETIME,
+		created_at        DATETIME,
+		updated_at        DATETIME,
+		forks_count       INTEGER,
+		stargazers_count  INTEGER,
+		watchers_count    INTEGER,
+		subscribers_count INTEGER,
+		open_issues_count INTEGER,
+		size              INTEGER,
+		language          TEXT,
+		default_branch    TEXT,
+		git_url           TEXT
+	)`,
+	`CREATE TABLE IF NOT EXISTS commits (
+		id                           INTEGER PRIMARY KEY AUTOINCREMENT,
+		repository_id                INTEGER NOT NULL REFERENCES repositories(id),
+		blamed_commit_id             INTEGER REFERENCES commits(id),
+		type                         TEXT NOT NULL DEFAULT 'other_commit',
+		sha                          TEXT NOT NULL,
+		url                          TEXT,
+		author_email                 TEXT,
+		author_name                  TEXT,
+		author_when                  DATETIME,
+		committer_email              TEXT,
+		committer_name               TEXT,
+		committer_when               DATETIME,
+		additions                    INTEGER DEFAULT 0,
+		deletions                    INTEGER DEFAULT 0,
+		past_changes                 INTEGER DEFAULT 0,
+		future_changes               INTEGER DEFAULT 0,
+		past_different_authors       INTEGER DEFAULT 0,
+		future_different_authors     INTEGER DEFAULT 0,
+		author_contributions_percent REAL,
+		message                      TEXT,
+		patch                        TEXT,
+		hunk_count                   INTEGER DEFAULT 0,
+		files_changed                INTEGER DEFAULT 0,
+		cve                          TEXT,
+		patch_keywords               TEXT,
+		disclosure_filtered          BOOLEAN NOT NULL DEFAULT 0
+	)`,
+	`CREATE INDEX IF NOT EXISTS commits_repository_id ON commits (repository_id)`,
+	`CREATE INDEX IF NOT EXISTS commits_sha ON commits (sha)`,
+	`CREATE TABLE IF NOT EXISTS functions (
+		id             INTEGER PRIMARY KEY AUTOINCREMENT,
+		commit_id      INTEGER NOT NULL REFERENCES commits(id),
+		name           TEXT,
+		qualified_name TEXT,
+		signature      TEXT,
+		file_name      TEXT,
+		start_line     INTEGER,
+		end_line       INTEGER,
+		state          TEXT,
+		lines_added    INTEGER DEFAULT 0,
+		lines_deleted  INTEGER DEFAULT 0,
+		past_changes             INTEGER DEFAULT 0,
+		future_changes           INTEGER DEFAULT 0,
+		past_different_authors   INTEGER DEFAULT 0,
+		future_different_authors INTEGER DEFAULT 0,
+		complexity     INTEGER,
+		max_nesting    INTEGER,
+		params         INTEGER,
+		statements     INTEGER,
+		derefs         INTEGER,
+		memory_calls   INTEGER,
+		-- change of the metrics of modified functions
+		delta_complexity   INTEGER DEFAULT 0,
+		delta_max_nesting  INTEGER DEFAULT 0,
+		delta_params       INTEGER DEFAULT 0,
+		delta_statements   INTEGER DEFAULT 0,
+		delta_derefs       INTEGER DEFAULT 0,
+		delta_memory_calls INTEGER DEFAULT 0
+	)`,
+	`CREATE INDEX IF NOT EXISTS functions_commit_id ON functions (commit_id)`,
+	`CREATE TABLE IF NOT EXISTS tool_results (
+		id        INTEGER PRIMARY KEY AUTOINCREMENT,
+		commit_id INTEGER NOT NULL REFERENCES commits(id),
+		file_name TEXT,
+		line      INTEGER,
+		reason    TEXT,
+		found_by  TEXT
+	)`,
+	`CREATE INDEX IF NOT EXISTS tool_results_commit_id ON tool_results (commit_id)`,
+	`CREATE TABLE IF NOT EXISTS commit_failures (
+		id            INTEGER PRIMARY KEY AUTOINCREMENT,
+		commit_id     INTEGER NOT NULL REFERENCES commits(id),
+		repository_id INTEGER NOT NULL REFERENCES repositories(id),
+		sha           TEXT NOT NULL,
+		stage         TEXT NOT NULL,
+		message       TEXT,
+		stack         TEXT,
+		created_at    DATETIME
+	)`,
+	`CREATE INDEX IF NOT EXISTS commit_failures_commit_id ON commit_failures (commit_id)`,
+	`CREATE TABLE IF NOT EXISTS parsed_files (
+		id          INTEGER PRIMARY KEY AUTOINCREMENT,
+		commit_id   INTEGER NOT NULL REFERENCES commits(id),
+		file_name   TEXT NOT NULL,
+		oid         TEXT NOT NULL,
+		status      TEXT NOT NULL,
+		error       TEXT,
+		diagnostics INTEGER DEFAULT 0,
+		errors      INTEGER DEFAULT 0
+	)`,
+	`CREATE INDEX IF NOT EXISTS parsed_files_commit_id ON parsed_files (commit_id)`,
+	`CREATE TABLE IF NOT EXISTS blame_candidates (
+		id             INTEGER PRIMARY KEY AUTOINCREMENT,
+		commit_id      INTEGER NOT NULL REFERENCES commits(id),
+		sha            TEXT NOT NULL,
+		committer_when DATETIME,
+		blamed_lines   INTEGER NOT NULL,
+		files          TEXT,
+		lines          TEXT,
+		selected       BOOLEAN NOT NULL DEFAULT 0,
+		strategy       TEXT,
+		after_disclosure BOOLEAN NOT NULL DEFAULT 0
+	)`,
+	`CREATE INDEX IF NOT EXISTS blame_candidates_commit_id ON blame_candidates (commit_id)`,
+	`CREATE TABLE IF NOT EXISTS declared_blames (
+		id           INTEGER PRIMARY KEY AUTOINCREMENT,
+		commit_id    INTEGER NOT NULL REFERENCES commits(id),
+		declared_sha TEXT NOT NULL,
+		sha          TEXT,
+		subject      TEXT,
+		heuristic    BOOLEAN NOT NULL DEFAULT 0
+	)`,
+	`CREATE INDEX IF NOT EXISTS declared_blames_commit_id ON declared_blames (commit_id)`,
+}
+
+// sqliteStore keeps everything in a single file, so that the full pipeline
+// can run without a postgres server
+type sqliteStore struct {
+	*sqlStore
+	path string
+}
+
+func NewSqliteStore(path string) (*sqliteStore, error) {
+	s := &sqliteStore{
+		sqlStore: &sqlStore{
+			repositories: "repositories",
+			commits:      "commits",
+			functions:    "functions",
+			toolResults:  "tool_results",
+			failures:     "commit_failures",
+			parsedFiles:  "parsed_files",
+			candidates:   "blame_candidates",
+			declared:     "declared_blames",
+		},
+		path: path,
+	}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	if err := s.CreateTables(); err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *sqliteStore) open() error {
+	// WAL allows readers while a commit goroutine writes, the busy timeout
+	// serializes concurrent writers
+	conn, err := sql.Open("sqlite3", "file:"+s.path+"?_busy_timeout=30000&_journal_mode=WAL&_foreign_keys=1")
+	if err != nil {
+		return err
+	}
+	s.dbmap = &gorp.DbMap{Db: conn, Dialect: gorp.SqliteDialect{}}
+	s.dbmap.AddTableWithName(Commit{}, s.commits).SetKeys(true, "id")
+	s.dbmap.AddTableWithName(Repository{}, s.repositories).SetKeys(true, "id")
+	return nil
+}
+
+func (s *sqliteStore) CreateTables() error {
+	for _, q := range sqliteSchema {
+		if _, err := s.dbmap.Db.Exec(q); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *sqliteStore) Reopen() error {
+	s.Close()
+	return s.open()
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"tools.net.cs.uni-bonn.de/social-aspects-of-vulnerabilities/github-data/tools"
+)
+
+func newTestSqliteStore(t *testing.T) (*sqliteStore, func()) {
+	dir, err := ioutil.TempDir("", "github-data")
+	handleErr(t, err)
+	s, err := NewSqliteStore(path.Join(dir, "test.db"))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return s, func() {
+		s.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestSqliteStore(t *testing.T) {
+	s, cleanup := newTestSqliteStore(t)
+	defer cleanup()
+
+	handleErr(t, s.InsertRepository(&Repository{Name: "foo/bar", Language: "C"}))
+	r, err := s.Repository("foo/bar")
+	handleErr(t, err)
+	if r.Id == 0 || r.Language != "C" {
+		t.Fatalf("unexpected repository %+v", r)
+	}
+	names, err := s.RepositoryNames()
+	handleErr(t, err)
+	if len(names) != 1 || names[0] != "foo/bar" {
+		t.Errorf("expected [foo/bar], got %v", names)
+	}
+
+	fixing := &Commit{RepositoryId: r.Id, Sha: "aaaa", Type: "other_commit"}
+	blamed := &Commit{RepositoryId: r.Id, Sha: "bbbb", Type: "other_commit"}
+	handleErr(t, s.InsertCommit(fixing))
+	handleErr(t, s.InsertCommit(blamed))
+
+	shas, err := s.CommitShas(r)
+	handleErr(t, err)
+	if len(shas) != 2 {
+		t.Errorf("expected 2 commits, got %v", shas)
+	}
+
+	cnt, err := s.MarkFixingCommits(r, []string{"aaaa"})
+	handleErr(t, err)
+	if cnt != 1 {
+		t.Errorf("expected 1 fixing commit, got %d", cnt)
+	}
+	id, err := s.MarkBlamedCommit("bbbb")
+	handleErr(t, err)
+	if !id.Valid || id.Int64 != blamed.Id {
+		t.Errorf("expected blamed id %d, got %v", blamed.Id, id)
+	}
+
+	fixing.Message = "fix CVE-2014-0160"
+	fixing.HunkCount = 3
+	fixing.Repository = r
+	fixing.CVE = "CVE-2014-0160"
+	fixing.BlamedCommitId = id
+	fixing.DisclosureFiltered = true
+	fixing.SetPatchKeywords()
+	handleErr(t, s.UpdateCommitColumns(fixing, "Message", "HunkCount", "PatchKeywords", "CVE", "BlamedCommitId", "DisclosureFiltered"))
+
+	fixing.Functions = []*Function{{Name: "foo", FileName: "foo.c", StartLine: 1, EndLine: 3, State: "modified",
+		LinesAdded: 2, LinesDeleted: 1,
+		Metrics: FunctionMetrics{Complexity: 4, MemoryCalls: 1}, Previous: &FunctionMetrics{Complexity: 2, MemoryCalls: 1}}}
+	fixing.ToolResults = []tools.Result{{FileName: "foo.c", Line: 2, Reason: "strcpy", FoundBy: "rats"}}
+	handleErr(t, s.SaveFunctions(fixing))
+	handleErr(t, s.SaveFunctions(fixing)) // replaces the old rows
+	handleErr(t, s.SaveToolResults(fixing))
+	fixing.BlameCandidates = []*BlameCandidate{
+		{Sha: "bbbb", BlamedLines: 2, Files: "foo.c", Lines: "foo.c:1,foo.c:2", Selected: true, Strategy: "w,cosmetic"},
+		{Sha: "cccc", BlamedLines: 1, Files: "foo.c", Lines: "foo.c:7", AfterDisclosure: true},
+	}
+	handleErr(t, s.SaveBlameCandidates(fixing))
+	handleErr(t, s.SaveBlameCandidates(fixing)) // replaces the old rows
+	var candidates, selected int
+	handleErr(t, s.dbmap.Db.QueryRow("SELECT count(*), sum(selected) FROM blame_candidates WHERE commit_id = ?", fixing.Id).Scan(&candidates, &selected))
+	if candidates != 2 || selected != 1 {
+		t.Errorf("expected 2 blame candidates, 1 selected, got %d and %d", candidates, selected)
+	}
+	var strategy string
+	handleErr(t, s.dbmap.Db.QueryRow("SELECT strategy FROM blame_candidates WHERE sha = 'bbbb'").Scan(&strategy))
+	if strategy != "w,cosmetic" {
+		t.Errorf("expected the strategy of the blame, got %q", strategy)
+	}
+	var after, filtered bool
+	handleErr(t, s.dbmap.Db.QueryRow("SELECT after_disclosure FROM blame_candidates WHERE sha = 'cccc'").Scan(&after))
+	handleErr(t, s.dbmap.Db.QueryRow("SELECT disclosure_filtered FROM commits WHERE id = ?", fixing.Id).Scan(&filtered))
+	if !after || !filtered {
+		t.Errorf("expected the disclosure filter to be recorded, got %v and %v", after, filtered)
+	}
+	fixing.DeclaredBlames = []*DeclaredBlame{
+		{DeclaredSha: "bbbb", Sha: "bbbb", Subject: "add foo", Heuristic: true},
+		{DeclaredSha: "dddddddddddd", Subject: "from another tree"},
+	}
+	handleErr(t, s.SaveDeclaredBlames(fixing))
+	handleErr(t, s.SaveDeclaredBlames(fixing)) // replaces the old rows
+	var declared, resolved int
+	handleErr(t, s.dbmap.Db.QueryRow("SELECT count(*), count(NULLIF(sha, '')) FROM declared_blames WHERE commit_id = ?", fixing.Id).Scan(&declared, &resolved))
+	if declared != 2 || resolved != 1 {
+		t.Errorf("expected 2 declared blames, 1 resolved, got %d and %d", declared, resolved)
+	}
+
+	var n int
+	handleErr(t, s.dbmap.Db.QueryRow("SELECT count(*) FROM functions WHERE commit_id = ?", fixing.Id).Scan(&n))
+	if n != 1 {
+		t.Errorf("expected 1 function, got %d", n)
+	}
+	var complexity, delta, added, deleted int
+	handleErr(t, s.dbmap.Db.QueryRow("SELECT complexity, delta_complexity, lines_added, lines_deleted FROM functions WHERE commit_id = ?",
+		fixing.Id).Scan(&complexity, &delta, &added, &deleted))
+	if complexity != 4 || delta != 2 {
+		t.Errorf("expected complexity 4 up by 2, got %d and %d", complexity, delta)
+	}
+	if added != 2 || deleted != 1 {
+		t.Errorf("expected 2 lines added and 1 deleted, got %d and %d", added, deleted)
+	}
+
+	fixed, err := s.FixedFunctions(r)
+	handleErr(t, err)
+	if len(fixed) != 1 || fixed[0].Name != "foo" || fixed[0].Sha != "aaaa" || fixed[0].BlamedSha != "bbbb" ||
+		fixed[0].CVE != "CVE-2014-0160" || fixed[0].EndLine != 3 {
+		t.Errorf("expected foo fixed by aaaa and blamed on bbbb, got %+v", fixed)
+	}
+
+	rows, err := s.SelectCommits(r, "blamed", "")
+	handleErr(t, err)
+	defer rows.Close()
+	n = 0
+	for rows.Next() {
+		var (
+			c                    Commit
+			patchLen, messageLen int
+		)
+		handleErr(t, rows.Scan(&c.Id, &c.Sha, &c.Type, &patchLen, &messageLen))
+		if c.Sha != "bbbb" {
+			t.Errorf("expected bbbb to be blamed, got %s", c.Sha)
+		}
+		n++
+	}
+	handleErr(t, rows.Err())
+	if n != 1 {
+		t.Errorf("expected 1 blamed commit, got %d", n)
+	}
+
+	missing, err := s.CountMissingAuthorContributions(r)
+	handleErr(t, err)
+	if missing != 2 {
+		t.Errorf("expected 2 commits without author contributions, got %d", missing)
+	}
+	handleErr(t, s.SetAuthorContribution(fixing.Id, 0.5))
+	missing, err = s.CountMissingAuthorContributions(r)
+	handleErr(t, err)
+	if missing != 1 {
+		t.Errorf("expected 1 commit without author contributions, got %d", missing)
+	}
+}
+
+func TestSqliteFailures(t *testing.T) {
+	s, cleanup := newTestSqliteStore(t)
+	defer cleanup()
+
+	r := &Repository{Name: "foo/bar", Language: "C"}
+	handleErr(t, s.InsertRepository(r))
+	ok := &Commit{RepositoryId: r.Id, Sha: "aaaa", Type: "other_commit", Repository: r}
+	failed := &Commit{RepositoryId: r.Id, Sha: "bbbb", Type: "other_commit", Repository: r}
+	handleErr(t, s.InsertCommit(ok))
+	handleErr(t, s.InsertCommit(failed))
+
+	failed.Fail(StageFunctions, errors.New("parse timeout"), nil)
+	failed.Fail(StagePersist, errors.New("connection reset"), []byte("goroutine 1"))
+	handleErr(t, s.SaveFailures(failed))
+	handleErr(t, s.SaveFailures(ok))
+
+	count := func() (n int) {
+		rows, err := s.SelectCommits(r, "failed", "")
+		handleErr(t, err)
+		defer rows.Close()
+		for rows.Next() {
+			n++
+		}
+		return
+	}
+	if n := count(); n != 1 {
+		t.Errorf("expected 1 failed commit, got %d", n)
+	}
+
+	failedStage, failedMatch = StageFunctions, "%timeout%"
+	defer func() { failedStage, failedMatch = "", "" }()
+	if n := count(); n != 1 {
+		t.Errorf("expected 1 commit with a parse timeout, got %d", n)
+	}
+	names, err := s.FailedRepositories()
+	handleErr(t, err)
+	if len(names) != 1 || names[0] != "foo/bar" {
+		t.Errorf("expected [foo/bar], got %v", names)
+	}
+	failedMatch = "%segfault%"
+	if n := count(); n != 0 {
+		t.Errorf("expected no commit with a segfault, got %d", n)
+	}
+
+	// a successful retry clears the failures
+	failed.Failures = nil
+	handleErr(t, s.SaveFailures(failed))
+	failedStage, failedMatch = "", ""
+	if n := count(); n != 0 {
+		t.Errorf("expected no failed commits after retry, got %d", n)
+	}
+}
@@ -0,0 +1,526 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/coopernurse/gorp"
+)
+
+// Store persists repositories, commits and the information gathered for them
+type Store interface {
+	CreateTables() error
+	Reopen() error
+	Close() error
+
+	Repository(name string) (*Repository, error)
+	RepositoryNames() ([]string, error)
+	InsertRepository(r *Repository) error
+	UpdateRepository(r *Repository) error
+
+	CommitShas(r *Repository) ([]string, error)
+	// SelectCommits returns id, sha, type, patch length and message length of
+	// the commits in a selection (see -commits-select), or of a single sha
+	SelectCommits(r *Repository, selection, sha string) (*sql.Rows, error)
+	// SelectCommitsById returns the same columns as SelectCommits
+	SelectCommitsById(r *Repository, ids []int64) (*sql.Rows, error)
+	InsertCommit(c *Commit) error
+	UpdateCommitColumns(c *Commit, cols ...string) error
+	MarkFixingCommits(r *Repository, shas []string) (int64, error)
+	MarkBlamedCommit(sha string) (sql.NullInt64, error)
+
+	CountMissingAuthorContributions(r *Repository) (int64, error)
+	CommitAuthors(r *Repository) (map[int64]string, error)
+	SetAuthorContribution(commitId int64, contrib float64) error
+
+	SaveFunctions(c *Commit) error
+	// SaveParsedFiles replaces the parse outcomes recorded for a commit
+	SaveParsedFiles(c *Commit) error
+	// SaveBlameCandidates replaces the blame candidates of a commit
+	SaveBlameCandidates(c *Commit) error
+	// SaveDeclaredBlames replaces the Fixes: trailers of a commit
+	SaveDeclaredBlames(c *Commit) error
+	SaveToolResults(c *Commit) error
+	// SaveFailures replaces the failures recorded for a commit
+	SaveFailures(c *Commit) error
+	// FailedRepositories returns the names of the repositories with failures
+	// matching -failed-stage and -failed-match
+	FailedRepositories() ([]string, error)
+	// FixedFunctions returns the functions changed by the fixing commits of
+	// a repository that have a blamed commit
+	FixedFunctions(r *Repository) ([]FixedFunction, error)
+}
+
+var (
+	DataStore     Store
+	storeBackend  = "postgres"
+	storeBackends = []string{"postgres", "sqlite"}
+	sqlitePath    = "github-data.db"
+)
+
+func InitStore() (err error) {
+	switch storeBackend {
+	case "postgres":
+		if err = InitDb(); err != nil {
+			return
+		}
+		DataStore = NewPostgresStore()
+	case "sqlite":
+		DataStore, err = NewSqliteStore(sqlitePath)
+	default:
+		err = fmt.Errorf("unknown store %s, use postgres or sqlite", storeBackend)
+	}
+	if err == nil {
+		DataStore = observedStore{DataStore}
+	}
+	return
+}
+
+// sqlStore implements Store on top of gorp, using only portable SQL
+type sqlStore struct {
+	dbmap        *gorp.DbMap
+	repositories string
+	commits      string
+	functions    string
+	toolResults  string
+	failures     string
+	parsedFiles  string
+	candidates   string
+	declared     string
+}
+
+// rebind replaces every ? in q with the bind variable of the dialect
+func (s *sqlStore) rebind(q string) string {
+	var (
+		buf bytes.Buffer
+		i   int
+	)
+	for _, r := range q {
+		if r == '?' {
+			buf.WriteString(s.dbmap.Dialect.BindVar(i))
+			i++
+			continue
+		}
+		buf.WriteRune(r)
+	}
+	return buf.String()
+}
+
+func (s *sqlStore) Close() error {
+	return s.dbmap.Db.Close()
+}
+
+func (s *sqlStore) Repository(name string) (*Repository, error) {
+	r := new(Repository)
+	row := s.dbmap.Db.QueryRow(s.rebind(fmt.Sprintf(
+		"SELECT id, name, language, git_url FROM %s WHERE name = ?", s.repositories)),
+		name,
+	)
+	if err := row.Scan(&r.Id, &r.Name, &r.Language, &r.GitUrl); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (s *sqlStore) RepositoryNames() (names []string, err error) {
+	rows, err := s.dbmap.Db.Query(fmt.Sprintf(
+		"SELECT name FROM %s WHERE language in ('C', 'C++')", s.repositories))
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		if err = rows.Scan(&name); err != nil {
+			return
+		}
+		names = append(names, name)
+	}
+	return names, rows.Err()
+}
+
+func (s *sqlStore) InsertRepository(r *Repository) error {
+	return s.dbmap.Insert(r)
+}
+
+func (s *sqlStore) UpdateRepository(r *Repository) (err error) {
+	_, err = s.dbmap.Update(r)
+	return
+}
+
+func (s *sqlStore) CommitShas(r *Repository) (shas []string, err error) {
+	rows, err := s.dbmap.Db.Query(s.rebind(fmt.Sprintf(
+		"SELECT sha FROM %s WHERE repository_id = ?", s.commits)),
+		r.Id,
+	)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var sha string
+		if err = rows.Scan(&sha); err != nil {
+			return
+		}
+		shas = append(shas, sha)
+	}
+	return shas, rows.Err()
+}
+
+func (s *sqlStore) SelectCommits(r *Repository, selection, sha string) (*sql.Rows, error) {
+	q := fmt.Sprintf(
+		"SELECT id, sha, type, coalesce(length(patch), 0), coalesce(length(message), 0) FROM %s WHERE repository_id = ?",
+		s.commits,
+	)
+	if sha != "" {
+		return s.dbmap.Db.Query(s.rebind(q+" and sha = ?"), r.Id, sha)
+	}
+	if selection == "failed" {
+		where, args := failuresWhere()
+		q += " and id in (select commit_id from " + s.failures + where + ")"
+		return s.dbmap.Db.Query(s.rebind(q), append([]interface{}{r.Id}, args...)...)
+	}
+	cond, err := commitsSelectCondition(selection, s.functions)
+	if err != nil {
+		return nil, err
+	}
+	return s.dbmap.Db.Query(s.rebind(q+cond), r.Id)
+}
+
+func (s *sqlStore) SelectCommitsById(r *Repository, ids []int64) (*sql.Rows, error) {
+	strs := make([]string, len(ids))
+	for i, id := range ids {
+		strs[i] = strconv.FormatInt(id, 10)
+	}
+	q := fmt.Sprintf(
+		"SELECT id, sha, type, coalesce(length(patch), 0), coalesce(length(message), 0) FROM %s WHERE repository_id = ? and id in (%s)",
+		s.commits, strings.Join(strs, ", "),
+	)
+	return s.dbmap.Db.Query(s.rebind(q), r.Id)
+}
+
+var commitSelections = []string{"all", "blamed", "cves", "stable", "empty", "fixing", "failed"}
+
+// commitsSelectCondition returns the sql condition for a set of commits. The
+// failed selection depends on query arguments and is handled by SelectCommits.
+func commitsSelectCondition(selection, functionsTable string) (string, error) {
+	switch selection {
+	case "all":
+		return "", nil
+	case "blamed":
+		return " and (type = 'blamed_commit')", nil
+	case "cves": // all commits that mention 'CVE'
+		return " and (message like '%CVE-____%' and type = 'other_commit')", nil
+	case "stable": // all commits that would be in stable
+		return " and (hunk_count <> 0 and patch != '' and message != '' and future_changes <> 0 and id in (select commit_id from " + functionsTable + "))", nil
+	case "empty":
+		return " and (future_changes = 0 or additions = 0 or hunk_count = 0 or patch = '' or message = '' or (type = 'fixing_commit' and blamed_commit_id is null))", nil
+	case "fixing":
+		shas := KnownCVEs.Shas()
+		for i, s := range shas {
+			shas[i] = "'" + s + "'"
+		}
+		return " and hunk_count = 0 and ( type = 'fixing_commit' or type = 'blamed_commit' or sha IN (" + strings.Join(shas, ", ") + ") )", nil
+	default:
+		return "", fmt.Errorf("invalid commit selection: %s", selection)
+	}
+}
+
+func (s *sqlStore) InsertCommit(c *Commit) error {
+	return s.dbmap.Insert(c)
+}
+
+func (s *sqlStore) UpdateCommitColumns(c *Commit, cols ...string) (err error) {
+	q, vals, err := persistColumnsSql(s.commits, s.dbmap.Dialect, c, cols...)
+	if err != nil {
+		return
+	}
+	_, err = s.dbmap.Db.Exec(q, vals...)
+	return
+}
+
+func (s *sqlStore) MarkFixingCommits(r *Repository, shas []string) (cnt int64, err error) {
+	// mark all CVE commits as fixing
+	if _, err := s.dbmap.Db.Exec(s.rebind(fmt.Sprintf(`
+		UPDATE	%s SET type = 'other_commit'
+		WHERE	type = 'fixing_commit' AND repository_id = ?`, s.commits)),
+		r.Id,
+	); err != nil {
+		log.Warn(err)
+	}
+	if len(shas) == 0 {
+		return 0, nil
+	}
+	args := []interface{}{r.Id}
+	for _, sha := range shas {
+		args = append(args, sha)
+	}
+	q := fmt.Sprintf(`
+	UPDATE	%s SET type = 'fixing_commit'
+	WHERE	repository_id = ? AND sha IN (?%s)`,
+		s.commits, strings.Repeat(", ?", len(shas)-1),
+	)
+	res, err := s.dbmap.Db.Exec(s.rebind(q), args...)
+	if err != nil {
+		return 0, fmt.Errorf("%v: %s", err, q)
+	}
+	return res.RowsAffected()
+}
+
+func (s *sqlStore) MarkBlamedCommit(sha string) (id sql.NullInt64, err error) {
+	if _, err = s.dbmap.Db.Exec(s.rebind(fmt.Sprintf(
+		"UPDATE %s SET type = 'blamed_commit' WHERE sha = ?", s.commits)),
+		sha,
+	); err != nil {
+		return
+	}
+	err = s.dbmap.Db.QueryRow(s.rebind(fmt.Sprintf(
+		"SELECT id FROM %s WHERE sha = ?", s.commits)),
+		sha,
+	).Scan(&id)
+	return
+}
+
+func (s *sqlStore) CountMissingAuthorContributions(r *Repository) (cnt int64, err error) {
+	err = s.dbmap.Db.QueryRow(s.rebind(fmt.Sprintf(
+		"SELECT count(*) FROM %s WHERE repository_id = ? and (author_contributions_percent IS NULL or author_contributions_percent = 0)", s.commits)),
+		r.Id,
+	).Scan(&cnt)
+	return
+}
+
+func (s *sqlStore) CommitAuthors(r *Repository) (authors map[int64]string, err error) {
+	rows, err := s.dbmap.Db.Query(s.rebind(fmt.Sprintf(
+		"SELECT id, author_email FROM %s WHERE repository_id = ?", s.commits)),
+		r.Id,
+	)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	authors = make(map[int64]string)
+	for rows.Next() {
+		var (
+			id    int64
+			email string
+		)
+		if err = rows.Scan(&id, &email); err != nil {
+			return nil, fmt.Errorf("row scan: %v", err)
+		}
+		authors[id] = email
+	}
+	return authors, rows.Err()
+}
+
+func (s *sqlStore) SetAuthorContribution(commitId int64, contrib float64) (err error) {
+	_, err = s.dbmap.Db.Exec(s.rebind(fmt.Sprintf(
+		"UPDATE %s SET author_contributions_percent = ? WHERE id = ?", s.commits)),
+		contrib, commitId,
+	)
+	return
+}
+
+func (s *sqlStore) SaveFunctions(c *Commit) (err error) {
+	txn, err := s.dbmap.Db.Begin()
+	if err != nil {
+		return
+	}
+	defer txn.Rollback()
+	// clear old functions
+	if _, err = txn.Exec(s.rebind(fmt.Sprintf("DELETE FROM %s WHERE commit_id = ?", s.functions)), c.Id); err != nil {
+		return fmt.Errorf("%v: deleting old functions failed: %v", c, err)
+	}
+	stmt, err := txn.Prepare(s.rebind(fmt.Sprintf(
+		"INSERT INTO %s (commit_id, name, qualified_name, signature, file_name, start_line, end_line, state, lines_added, lines_deleted, "+
+			"past_changes, future_changes, past_different_authors, future_different_authors, "+
+			"complexity, max_nesting, params, statements, derefs, memory_calls, "+
+			"delta_complexity, delta_max_nesting, delta_params, delta_statements, delta_derefs, delta_memory_calls) "+
+			"VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)", s.functions)))
+	if err != nil {
+		return
+	}
+	defer stmt.Close()
+	for _, f := range c.Functions {
+		m, d := f.Metrics, f.Delta()
+		if _, err = stmt.Exec(c.Id, f.Name, f.QualifiedName, f.Signature, f.FileName, f.StartLine, f.EndLine, f.State, f.LinesAdded, f.LinesDeleted,
+			f.PastChanges, f.FutureChanges, f.PastDifferentAuthors, f.FutureDifferentAuthors,
+			m.Complexity, m.MaxNesting, m.Params, m.Statements, m.Derefs, m.MemoryCalls,
+			d.Complexity, d.MaxNesting, d.Params, d.Statements, d.Derefs, d.MemoryCalls); err != nil {
+			log.Errorf("Error saving %v: %v", f, err)
+		}
+	}
+	return txn.Commit()
+}
+
+func (s *sqlStore) SaveParsedFiles(c *Commit) (err error) {
+	txn, err := s.dbmap.Db.Begin()
+	if err != nil {
+		return
+	}
+	defer txn.Rollback()
+	// clear old outcomes
+	if _, err = txn.Exec(s.rebind(fmt.Sprintf("DELETE FROM %s WHERE commit_id = ?", s.parsedFiles)), c.Id); err != nil {
+		return fmt.Errorf("%v: deleting old parsed files failed: %v", c, err)
+	}
+	stmt, err := txn.Prepare(s.rebind(fmt.Sprintf(
+		"INSERT INTO %s (commit_id, file_name, oid, status, error, diagnostics, errors) VALUES (?, ?, ?, ?, ?, ?, ?)", s.parsedFiles)))
+	if err != nil {
+		return
+	}
+	defer stmt.Close()
+	for _, f := range c.ParsedFiles {
+		if _, err = stmt.Exec(c.Id, f.FileName, f.Oid, f.Status, f.Error, f.Diagnostics, f.Errors); err != nil {
+			return fmt.Errorf("%v: saving parsed file %s: %v", c, f.FileName, err)
+		}
+	}
+	return txn.Commit()
+}
+
+func (s *sqlStore) SaveBlameCandidates(c *Commit) (err error) {
+	txn, err := s.dbmap.Db.Begin()
+	if err != nil {
+		return
+	}
+	defer txn.Rollback()
+	// clear old candidates
+	if _, err = txn.Exec(s.rebind(fmt.Sprintf("DELETE FROM %s WHERE commit_id = ?", s.candidates)), c.Id); err != nil {
+		return fmt.Errorf("%v: deleting old blame candidates failed: %v", c, err)
+	}
+	stmt, err := txn.Prepare(s.rebind(fmt.Sprintf(
+		"INSERT INTO %s (commit_id, sha, committer_when, blamed_lines, files, lines, selected, strategy, after_disclosure) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)", s.candidates)))
+	if err != nil {
+		return
+	}
+	defer stmt.Close()
+	for _, b := range c.BlameCandidates {
+		if _, err = stmt.Exec(c.Id, b.Sha, b.When, b.BlamedLines, b.Files, b.Lines, b.Selected, b.Strategy, b.AfterDisclosure); err != nil {
+			return fmt.Errorf("%v: saving blame candidate %s: %v", c, b.Sha, err)
+		}
+	}
+	return txn.Commit()
+}
+
+func (s *sqlStore) SaveDeclaredBlames(c *Commit) (err error) {
+	txn, err := s.dbmap.Db.Begin()
+	if err != nil {
+		return
+	}
+	defer txn.Rollback()
+	// clear old trailers
+	if _, err = txn.Exec(s.rebind(fmt.Sprintf("DELETE FROM %s WHERE commit_id = ?", s.declared)), c.Id); err != nil {
+		return fmt.Errorf("%v: deleting old declared blames failed: %v", c, err)
+	}
+	stmt, err := txn.Prepare(s.rebind(fmt.Sprintf(
+		"INSERT INTO %s (commit_id, declared_sha, sha, subject, heuristic) VALUES (?, ?, ?, ?, ?)", s.declared)))
+	if err != nil {
+		return
+	}
+	defer stmt.Close()
+	for _, d := range c.DeclaredBlames {
+		if _, err = stmt.Exec(c.Id, d.DeclaredSha, d.Sha, d.Subject, d.Heuristic); err != nil {
+			return fmt.Errorf("%v: saving declared blame %s: %v", c, d.DeclaredSha, err)
+		}
+	}
+	return txn.Commit()
+}
+
+func (s *sqlStore) SaveToolResults(c *Commit) (err error) {
+	txn, err := s.dbmap.Db.Begin()
+	if err != nil {
+		return
+	}
+	defer txn.Rollback()
+	// clear old results
+	if _, err = txn.Exec(s.rebind(fmt.Sprintf("DELETE FROM %s WHERE commit_id = ?", s.toolResults)), c.Id); err != nil {
+		return fmt.Errorf("%v: deleting old tool results failed: %v", c, err)
+	}
+	stmt, err := txn.Prepare(s.rebind(fmt.Sprintf(
+		"INSERT INTO %s (commit_id, file_name, line, reason, found_by) VALUES (?, ?, ?, ?, ?)", s.toolResults)))
+	if err != nil {
+		return
+	}
+	defer stmt.Close()
+	for _, r := range c.ToolResults {
+		if _, err = stmt.Exec(c.Id, r.FileName, r.Line, r.Reason, r.FoundBy); err != nil {
+			log.Errorf("Error saving %v: %v", r, err)
+		}
+	}
+	if err = txn.Commit(); err != nil {
+		return
+	}
+	log.Debugf("%v: Inserted %d tool results\n", c, len(c.ToolResults))
+	return
+}
+
+func (s *sqlStore) SaveFailures(c *Commit) (err error) {
+	txn, err := s.dbmap.Db.Begin()
+	if err != nil {
+		return
+	}
+	defer txn.Rollback()
+	// clear old failures
+	if _, err = txn.Exec(s.rebind(fmt.Sprintf("DELETE FROM %s WHERE commit_id = ?", s.failures)), c.Id); err != nil {
+		return fmt.Errorf("%v: deleting old failures failed: %v", c, err)
+	}
+	stmt, err := txn.Prepare(s.rebind(fmt.Sprintf(
+		"INSERT INTO %s (commit_id, repository_id, sha, stage, message, stack, created_at) VALUES (?, ?, ?, ?, ?, ?, ?)", s.failures)))
+	if err != nil {
+		return
+	}
+	defer stmt.Close()
+	for _, f := range c.Failures {
+		if _, err = stmt.Exec(f.CommitId, f.RepositoryId, f.Sha, f.Stage, f.Message, f.Stack, f.CreatedAt); err != nil {
+			return fmt.Errorf("%v: saving failure: %v", c, err)
+		}
+	}
+	return txn.Commit()
+}
+
+func (s *sqlStore) FailedRepositories() (names []string, err error) {
+	where, args := failuresWhere()
+	rows, err := s.dbmap.Db.Query(s.rebind(fmt.Sprintf(
+		"SELECT name FROM %s WHERE id in (select repository_id from %s%s)", s.repositories, s.failures, where)),
+		args...,
+	)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		if err = rows.Scan(&name); err != nil {
+			return
+		}
+		names = append(names, name)
+	}
+	return names, rows.Err()
+}
+
+func (s *sqlStore) FixedFunctions(r *Repository) (fs []FixedFunction, err error) {
+	rows, err := s.dbmap.Db.Query(s.rebind(fmt.Sprintf(`
+	SELECT	c.sha, coalesce(c.cve, ''), b.sha, f.name, coalesce(f.qualified_name, ''), coalesce(f.signature, ''),
+		f.file_name, f.start_line, f.end_line, f.state
+	FROM	%s c JOIN %s b ON b.id = c.blamed_commit_id JOIN %s f ON f.commit_id = c.id
+	WHERE	c.repository_id = ? AND c.type = 'fixing_commit'
+	ORDER BY c.id, f.id`, s.commits, s.commits, s.functions)),
+		r.Id,
+	)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var f FixedFunction
+		if err = rows.Scan(&f.Sha, &f.CVE, &f.BlamedSha, &f.Name, &f.QualifiedName, &f.Signature,
+			&f.FileName, &f.StartLine, &f.EndLine, &f.State); err != nil {
+			return
+		}
+		fs = append(fs, f)
+	}
+	return fs, rows.Err()
+}
@@ -34,7 +34,7 @@ func data_flawfinder_py() ([]byte, error) {
 	)
 }
 
-var _data_rats_wrapper_py = []byte("\x1f\x8b\x08\x00\x00\x09\x6e\x88\x00\xff\x6c\xcd\x3d\x8b\xc3\x30\x0c\x06\xe0\xdd\xbf\xc2\x64\x49\x0c\x87\xb3\x1f\xdc\x7a\x63\xa7\x6e\xa5\x14\xc7\x91\x89\x68\xfd\x81\x24\x93\xe6\xdf\xd7\xfd\x1a\x0a\xd5\x26\x9e\x57\x7a\x31\x96\x4c\xa2\x79\x63\x15\x28\x47\x2d\x10\x4b\xc0\x0b\xe8\x17\xec\x5c\x84\x79\x0f\xf7\xc5\xd1\xf6\xdf\xe4\x99\xe3\x3a\x15\xca\x1e\x98\xdf\x49\xbf\x80\x3f\x9f\x72\x95\x52\x45\xa9\x15\x65\xf9\x72\x3c\x70\x0d\x01\xaf\x7f\xbd\xf5\xbd\xd1\x8e\x75\xf8\x55\xba\x4d\xb0\x2b\xa1\x34\xde\xd8\xb2\xcc\x98\x2c\x81\x9b\x07\x63\x1e\x5a\x08\xd3\x67\xc1\x70\xe8\xc6\xca\x34\x4e\x98\x46\x72\xc2\xdd\x4f\x7b\x91\x5a\xdd\xd1\xa8\x5b\x00\x00\x00\xff\xff\x02\x5e\xbe\xff\xd3\x00\x00\x00")
+var _data_rats_wrapper_py = []byte("\x1f\x8b\x08\x00\x00\x09\x6e\x88\x02\xff\x6d\x8e\x3d\x0f\x82\x40\x0c\x86\xf7\xfb\x15\x0d\x8b\x5c\x62\x20\xac\x26\x38\x3a\x3a\xb9\x11\x63\x4e\xe8\x49\x23\x1c\x97\xf6\x4e\xe5\xdf\xcb\x47\x18\x4c\xec\xd6\xbe\x1f\x4f\xa9\xf7\x03\x07\x90\x51\x94\xe5\xa1\x87\x80\xbd\xb7\xd4\x21\xd0\x2a\x9c\x4d\x8f\xcd\x05\xe7\xc5\xf0\x78\x9a\x94\xd5\x27\xf1\xee\x79\xa8\x51\x64\x73\xd6\x2d\xd6\xcf\xdb\x10\x83\x8f\x41\x29\x36\x41\xa0\x9c\x7b\x33\xc3\x8f\x57\x55\x5c\x81\x2c\x74\xe8\xd2\xed\xa4\xe1\x08\x05\x60\x27\x08\x49\x1e\x85\xf3\x3b\xb9\x7c\x8e\x25\x4a\xbd\x29\xb4\x7f\xd0\xa9\x44\x6b\xe9\x53\xee\xb2\x7a\xa7\xc1\x08\xd8\x83\x82\x69\x6c\xf6\x66\x0a\xb8\x54\x4b\x68\xc8\x65\x8c\xa6\x49\xb5\x5e\x54\xcf\xe4\x7e\xdf\x4b\xab\x99\xb3\x9f\x72\x6e\x62\x5c\xb5\xfa\x02\xc4\xf6\x57\x92\x06\x01\x00\x00")
 
 func data_rats_wrapper_py() ([]byte, error) {
 	return bindata_read(
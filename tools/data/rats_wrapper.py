@@ -2,6 +2,8 @@ import sys
 from tempfile import NamedTemporaryFile
 from subprocess import check_output
 
+rats = sys.argv[1] if len(sys.argv) > 1 else "/usr/bin/rats"
+
 with NamedTemporaryFile(suffix='.c') as f:
     f.write(sys.stdin.read())
-    print check_output(["/usr/bin/rats", f.name])
+    print check_output([rats, f.name])
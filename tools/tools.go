@@ -3,13 +3,16 @@ package tools
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"io/ioutil"
-	"os/exec"
 	"regexp"
 	"sort"
 	"strconv"
+	"time"
 
 	"github.com/libgit2/git2go"
+
+	"tools.net.cs.uni-bonn.de/social-aspects-of-vulnerabilities/github-data/proc"
 )
 
 type Tool struct {
@@ -20,10 +23,10 @@ type Tool struct {
 }
 
 type Result struct {
-	FileName string
-	Line     uint
-	Reason   string
-	FoundBy  string
+	FileName string `json:"file_name"`
+	Line     uint   `json:"line"`
+	Reason   string `json:"reason"`
+	FoundBy  string `json:"found_by"`
 }
 
 type ByLine []Result
@@ -34,6 +37,11 @@ func (r ByLine) Less(i, j int) bool { return r[i].Line < r[j].Line }
 
 var Flawfinder, Rats *Tool
 
+var ratsWrapper string
+
+// Timeout is how long a tool may take for one file
+var Timeout = 2 * time.Minute
+
 func init() {
 	script, err := Asset("data/flawfinder.py")
 	if err != nil {
@@ -70,22 +78,30 @@ func init() {
 		regex:   regexp.MustCompile(`^-:(\d+):  (.*)$`),
 	}
 
+	ratsWrapper = ratsWrapperScript.Name()
 	Rats = &Tool{
 		name:    "rats",
 		command: "/usr/bin/python",
-		args:    []string{ratsWrapperScript.Name()},
+		args:    []string{ratsWrapper},
 		regex:   regexp.MustCompile(`.+:(\d+): (.*)$`),
 	}
 }
 
-func (t *Tool) Analyze(repo *git.Repository, file *git.DiffFile) (res []Result, err error) {
+// Configure sets the python interpreter running the tools and the rats binary
+func Configure(python, rats string) {
+	Flawfinder.command = python
+	Rats.command = python
+	Rats.args = []string{ratsWrapper, rats}
+}
+
+func (t *Tool) Analyze(ctx context.Context, repo *git.Repository, file *git.DiffFile) (res []Result, err error) {
 	blob, err := repo.LookupBlob(file.Oid)
 	if err != nil {
 		return
 	}
 	fname := file.Path
 
-	return t.run(blob.Contents(), fname)
+	return t.run(ctx, blob.Contents(), fname)
 }
 
 func ResultsAtLine(results []Result, line uint) (r []Result) {
@@ -104,8 +120,8 @@ func Merge(a, b []Result) []Result {
 	return rs
 }
 
-func (t *Tool) run(input []byte, fname string) (results []Result, err error) {
-	cmd := exec.Command(t.command, t.args...)
+func (t *Tool) run(ctx context.Context, input []byte, fname string) (results []Result, err error) {
+	cmd := proc.Command(ctx, Timeout, t.command, t.args...)
 	cmd.Stdin = bytes.NewReader(input)
 	var out bytes.Buffer
 	cmd.Stdout = &out
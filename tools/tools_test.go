@@ -1,6 +1,7 @@
 package tools
 
 import (
+	"context"
 	"testing"
 
 	"github.com/libgit2/git2go"
@@ -13,7 +14,7 @@ func TestAnalyzeFlawfinder(t *testing.T) {
 	handleErr(t, err)
 	file := &git.DiffFile{Path: "malloc.c.h", Oid: oid}
 	handleErr(t, err)
-	results, err := Flawfinder.Analyze(repo, file)
+	results, err := Flawfinder.Analyze(context.Background(), repo, file)
 	handleErr(t, err)
 
 	if len(results) != 15 {
@@ -41,7 +42,7 @@ func TestAnalyzeRats(t *testing.T) {
 	handleErr(t, err)
 	file := &git.DiffFile{Path: "malloc.c.h", Oid: oid}
 	handleErr(t, err)
-	results, err := Rats.Analyze(repo, file)
+	results, err := Rats.Analyze(context.Background(), repo, file)
 	handleErr(t, err)
 
 	if len(results) != 6 {
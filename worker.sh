@@ -1,5 +1,5 @@
 #!/bin/bash
 
 mkdir -p log
-./github-data -log=import.log -log-level=info -name=$(hostname) -commit-threads=50 -commits-select=all
+./github-data -log=import.log -log-level=info -name=$(hostname) -repo-threads=4 -commit-threads=100 -repo-commit-threads=50 -commits-select=all ${COORDINATOR:+-coordinator=$COORDINATOR}
 